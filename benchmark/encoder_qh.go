@@ -13,7 +13,7 @@ func EncodeQH(tc TestCase) EncodedResult {
 		Host:    tc.Request.Host,
 		Path:    tc.Request.Path,
 		Version: qh.Version,
-		Headers: tc.Request.Headers,
+		Headers: toQHHeader(tc.Request.Headers),
 		Body:    nil,
 	}
 	reqBytes := req.Format()
@@ -21,7 +21,7 @@ func EncodeQH(tc TestCase) EncodedResult {
 	resp := &qh.Response{
 		Version:    qh.Version,
 		StatusCode: tc.Response.StatusCode,
-		Headers:    tc.Response.Headers,
+		Headers:    toQHHeader(tc.Response.Headers),
 		Body:       nil,
 	}
 	respBytes := resp.Format()
@@ -37,6 +37,14 @@ func EncodeQH(tc TestCase) EncodedResult {
 	}
 }
 
+func toQHHeader(headers map[string]string) qh.Header {
+	h := make(qh.Header, len(headers))
+	for name, value := range headers {
+		h.Set(name, value)
+	}
+	return h
+}
+
 func methodFromString(method string) qh.Method {
 	switch method {
 	case "GET":
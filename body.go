@@ -0,0 +1,220 @@
+package qh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/qo-proto/qotp"
+)
+
+const (
+	streamChunkSize      = 32 * 1024            // read size (and so maximum chunk size) when streaming a body
+	sendBufferRetryDelay = 1 * time.Millisecond // wait before retrying a write to a full QOTP send buffer
+)
+
+// appendChunk appends a single body chunk (<varint:len><data>) to buf.
+// An empty data slice produces the terminating chunk.
+func appendChunk(buf []byte, data []byte) []byte {
+	buf = AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// writeAll writes data to the stream, waiting for the QOTP send buffer to
+// drain if it cannot take all of it at once.
+func writeAll(stream *qotp.Stream, data []byte) error {
+	for len(data) > 0 {
+		n, err := stream.Write(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) > 0 {
+			time.Sleep(sendBufferRetryDelay)
+		}
+	}
+	return nil
+}
+
+// writeChunked writes the message head followed by the contents of body as
+// a sequence of chunks and the terminating empty chunk.
+func writeChunked(stream *qotp.Stream, head []byte, body io.Reader) error {
+	if err := writeAll(stream, head); err != nil {
+		return err
+	}
+
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if writeErr := writeAll(stream, appendChunk(nil, buf[:n])); writeErr != nil {
+				return writeErr
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return writeAll(stream, appendChunk(nil, nil))
+		}
+		if err != nil {
+			return fmt.Errorf("reading body: %w", err)
+		}
+	}
+}
+
+// bodyDecoder incrementally decodes the body section of a message as stream
+// data arrives. It handles both a single length-prefixed body and a sequence
+// of chunks terminated by an empty chunk.
+type bodyDecoder struct {
+	chunked   bool
+	remaining uint64 // bytes left in the current chunk (or the whole body)
+	haveLen   bool   // whether remaining holds a length that was read
+	pending   []byte // incomplete length varint carried over from the last call
+	done      bool
+}
+
+func newBodyDecoder(chunked bool) *bodyDecoder {
+	return &bodyDecoder{chunked: chunked}
+}
+
+// decode consumes data and passes body bytes to out. It reports true once
+// the end of the body has been reached.
+func (d *bodyDecoder) decode(data []byte, out func([]byte)) (bool, error) {
+	if len(d.pending) > 0 {
+		data = append(d.pending, data...)
+		d.pending = nil
+	}
+
+	for !d.done {
+		if !d.haveLen {
+			if len(data) == 0 {
+				return false, nil
+			}
+			length, n, err := ReadUvarint(data, 0)
+			if errors.Is(err, errVarintIncomplete) {
+				d.pending = append([]byte(nil), data...)
+				return false, nil
+			}
+			if err != nil {
+				return false, fmt.Errorf("reading body length: %w", err)
+			}
+			data = data[n:]
+			if length == 0 {
+				d.done = true
+				break
+			}
+			d.remaining = length
+			d.haveLen = true
+		}
+
+		take := min(d.remaining, uint64(len(data)))
+		if take > 0 {
+			out(data[:take])
+			data = data[take:]
+			d.remaining -= take
+		}
+		if d.remaining > 0 {
+			return false, nil
+		}
+		d.haveLen = false
+		if !d.chunked {
+			d.done = true
+		}
+	}
+
+	if len(data) > 0 {
+		return true, fmt.Errorf("%d unexpected bytes after end of body", len(data))
+	}
+	return true, nil
+}
+
+// ErrRequestBodyTooLarge is returned when reading a streamed request body
+// that exceeds the server's WithMaxRequestBodySize limit.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// bodyPipe hands a message body from the QOTP loop to a reader. Writes never
+// block, so a slow reader cannot stall the loop; data is buffered in memory
+// until it is read. The server bounds the buffer with buffered, see
+// Server.readStream.
+type bodyPipe struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	buf     []byte
+	err     error  // set when the writer is done; io.EOF on a complete body
+	closed  bool   // set when the reader is closed
+	onClose func() // called once if the reader closes before the body is complete
+}
+
+func newBodyPipe(onClose func()) *bodyPipe {
+	p := &bodyPipe{onClose: onClose}
+	p.cond.L = &p.mu
+	return p
+}
+
+func (p *bodyPipe) write(data []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.err != nil {
+		return
+	}
+	p.buf = append(p.buf, data...)
+	p.cond.Broadcast()
+}
+
+// buffered returns the number of bytes written but not read yet.
+func (p *bodyPipe) buffered() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buf)
+}
+
+// finish ends the body. A nil error marks the body as complete.
+func (p *bodyPipe) finish(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+// Read reads body data, blocking until data is available or the body ends.
+func (p *bodyPipe) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.buf) == 0 && p.err == nil && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p.buf) == 0 {
+		return 0, p.err
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+// Close discards any remaining body data. If the body was not yet complete,
+// the onClose callback is run so the writer can stop feeding it.
+func (p *bodyPipe) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.buf = nil
+	incomplete := p.err == nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	if incomplete && p.onClose != nil {
+		p.onClose()
+	}
+	return nil
+}
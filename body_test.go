@@ -0,0 +1,90 @@
+package qh
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBodyDecoder(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunked bool
+		data    []byte
+		body    string
+		done    bool
+	}{
+		{"Fixed length", false, []byte{0x05, 'h', 'e', 'l', 'l', 'o'}, "hello", true},
+		{"Fixed length partial", false, []byte{0x05, 'h', 'e'}, "he", false},
+		{"Empty fixed length", false, []byte{0x00}, "", true},
+		{"Chunks", true, []byte{0x02, 'a', 'b', 0x01, 'c', 0x00}, "abc", true},
+		{"Chunks without terminator", true, []byte{0x02, 'a', 'b'}, "ab", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Feed one byte at a time to exercise varints and chunks split across reads.
+			dec := newBodyDecoder(tt.chunked)
+			var body []byte
+			var done bool
+			for i := range tt.data {
+				var err error
+				done, err = dec.decode(tt.data[i:i+1], func(b []byte) { body = append(body, b...) })
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.body, string(body))
+			require.Equal(t, tt.done, done)
+		})
+	}
+}
+
+func TestBodyDecoderTrailingData(t *testing.T) {
+	dec := newBodyDecoder(true)
+	_, err := dec.decode([]byte{0x01, 'a', 0x00, 0xFF}, func([]byte) {})
+	require.Error(t, err)
+}
+
+func TestBodyPipe(t *testing.T) {
+	p := newBodyPipe(nil)
+	go func() {
+		p.write([]byte("hello "))
+		p.write([]byte("world"))
+		p.finish(nil)
+	}()
+
+	data, err := io.ReadAll(p)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(data))
+}
+
+func TestBodyPipeError(t *testing.T) {
+	p := newBodyPipe(nil)
+	errBroken := errors.New("broken")
+	p.write([]byte("partial"))
+	p.finish(errBroken)
+
+	data, err := io.ReadAll(p)
+	require.ErrorIs(t, err, errBroken)
+	require.Equal(t, "partial", string(data))
+}
+
+func TestBodyPipeCloseBeforeComplete(t *testing.T) {
+	closed := 0
+	p := newBodyPipe(func() { closed++ })
+	p.write([]byte("data"))
+
+	require.NoError(t, p.Close())
+	require.NoError(t, p.Close())
+	require.Equal(t, 1, closed, "onClose must run once")
+
+	_, err := p.Read(make([]byte, 4))
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// Closing a complete body does not signal the sender.
+	done := newBodyPipe(func() { closed++ })
+	done.finish(nil)
+	require.NoError(t, done.Close())
+	require.Equal(t, 1, closed)
+}
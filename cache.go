@@ -0,0 +1,454 @@
+package qh
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheAge caps max-age values, so they don't overflow a time.Duration.
+const maxCacheAge = 100 * 365 * 24 * time.Hour
+
+// Cache stores the cached responses of a Client, see WithCache. Keys are
+// request URLs and values are encoded responses. Implementations must be
+// safe for concurrent use.
+type Cache interface {
+	// Get returns the value stored for key, if any.
+	Get(key string) ([]byte, bool)
+	// Set stores value for key, replacing the previous value.
+	Set(key string, value []byte)
+	// Delete removes the value stored for key, if any.
+	Delete(key string)
+}
+
+// WithCache makes the client cache responses to GET requests in cache,
+// following the HTTP caching rules (RFC 9111) for a private cache:
+//
+//   - A response is stored if it has a max-age or expires for which it is
+//     fresh, or an etag or last-modified to revalidate it with, and neither
+//     the request nor the response has "cache-control: no-store". Responses
+//     marked private are stored, since the cache is not shared.
+//   - A fresh response is returned without a request. A stale one, or one
+//     marked no-cache, is revalidated with if-none-match and
+//     if-modified-since, and a 304 Not Modified answer returns the cached
+//     response with updated headers.
+//   - The response headers named by vary must match between the request and
+//     the cached one. "vary: *" is never cached.
+//   - Requests that set if-none-match or if-modified-since themselves bypass
+//     the cache, and successful unsafe requests such as POST remove the
+//     cached response for their URL.
+//
+// Set-cookie headers are not stored.
+func WithCache(cache Cache) ClientOption {
+	return func(c *Client) {
+		c.cache = cache
+	}
+}
+
+// cachedResponse is a response stored in a Cache, encoded as JSON.
+type cachedResponse struct {
+	StatusCode   int       `json:"status"`
+	Headers      Header    `json:"headers"`
+	Body         []byte    `json:"body"`
+	Vary         Header    `json:"vary,omitempty"` // request headers named by vary
+	RequestTime  time.Time `json:"request_time"`
+	ResponseTime time.Time `json:"response_time"`
+}
+
+// cacheableStatus holds the statuses that may be stored without being
+// explicitly allowed (RFC 9110, section 15.1).
+var cacheableStatus = []int{
+	StatusOK, 203, StatusNoContent, StatusMultipleChoices, StatusMovedPermanently, StatusPermanentRedirect,
+	StatusNotFound, StatusMethodNotAllowed, StatusGone, StatusURITooLong, 501,
+}
+
+// cachedRoundTrip sends req to origin like roundTripWithRetry, answering it
+// from the cache if possible. u is the URL of req.
+func (c *Client) cachedRoundTrip(ctx context.Context, origin string, u *URL, req *Request) (*Response, error) {
+	if c.cache == nil || req.BodyReader != nil {
+		return c.roundTripWithRetry(ctx, origin, req)
+	}
+	key := u.String()
+	switch req.Method {
+	case POST, PUT, PATCH, DELETE:
+		resp, err := c.roundTripWithRetry(ctx, origin, req)
+		if err == nil && resp.StatusCode < 400 {
+			// The unsafe request may have changed the resource.
+			c.cache.Delete(key)
+		}
+		return resp, err
+	}
+	reqControl := parseCacheControl(req.Headers)
+	if req.Method != GET || reqControl.has("no-store") ||
+		req.Headers.Has("if-none-match") || req.Headers.Has("if-modified-since") {
+		return c.roundTripWithRetry(ctx, origin, req)
+	}
+
+	entry := c.loadCacheEntry(key, req)
+	if entry != nil && entry.fresh(time.Now(), reqControl) {
+		slog.Debug("Serving response from cache", "url", key)
+		return entry.response(), nil
+	}
+
+	sent := req
+	if entry != nil {
+		sent = entry.conditionalRequest(req)
+	}
+	requestTime := time.Now()
+	resp, err := c.roundTripWithRetry(ctx, origin, sent)
+	if err != nil {
+		return nil, err
+	}
+	responseTime := time.Now()
+
+	if resp.StatusCode == StatusNotModified && entry != nil {
+		slog.Debug("Cached response revalidated", "url", key)
+		entry.update(resp.Headers, requestTime, responseTime)
+		c.storeCacheEntry(key, entry)
+		return entry.response(), nil
+	}
+	if isCacheable(reqControl, resp) {
+		c.storeCacheEntry(key, newCachedResponse(req, resp, requestTime, responseTime))
+	} else if entry != nil {
+		c.cache.Delete(key)
+	}
+	return resp, nil
+}
+
+// loadCacheEntry returns the entry stored for key if it matches the vary
+// headers of req, or nil.
+func (c *Client) loadCacheEntry(key string, req *Request) *cachedResponse {
+	data, ok := c.cache.Get(key)
+	if !ok {
+		return nil
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil {
+		slog.Warn("Dropping invalid cache entry", "url", key, "error", err)
+		c.cache.Delete(key)
+		return nil
+	}
+	for name, values := range entry.Vary {
+		if !slices.Equal(req.Headers.Values(name), values) {
+			return nil
+		}
+	}
+	return &entry
+}
+
+func (c *Client) storeCacheEntry(key string, entry *cachedResponse) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Warn("Failed to encode cache entry", "url", key, "error", err)
+		return
+	}
+	c.cache.Set(key, data)
+}
+
+// isCacheable reports whether resp to a request with the cache-control
+// directives reqControl may be stored.
+func isCacheable(reqControl cacheControl, resp *Response) bool {
+	respControl := parseCacheControl(resp.Headers)
+	if reqControl.has("no-store") || respControl.has("no-store") ||
+		!slices.Contains(cacheableStatus, resp.StatusCode) {
+		return false
+	}
+	for _, name := range varyNames(resp.Headers) {
+		if name == "*" {
+			return false
+		}
+	}
+	return respControl.has("max-age") || resp.Headers.Has("expires") ||
+		resp.Headers.Has("etag") || resp.Headers.Has("last-modified")
+}
+
+func newCachedResponse(req *Request, resp *Response, requestTime, responseTime time.Time) *cachedResponse {
+	headers := resp.Headers.Clone()
+	headers.Del("set-cookie")
+	var vary Header
+	for _, name := range varyNames(resp.Headers) {
+		if vary == nil {
+			vary = Header{}
+		}
+		vary[name] = req.Headers.Values(name)
+	}
+	return &cachedResponse{
+		StatusCode:   resp.StatusCode,
+		Headers:      headers,
+		Body:         resp.Body,
+		Vary:         vary,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+}
+
+// response returns a copy of the stored response.
+func (e *cachedResponse) response() *Response {
+	return &Response{
+		Version:    Version,
+		StatusCode: e.StatusCode,
+		Headers:    e.Headers.Clone(),
+		Body:       slices.Clone(e.Body),
+	}
+}
+
+// fresh reports whether the entry may be returned at now without
+// revalidation, given the cache-control directives of the request.
+func (e *cachedResponse) fresh(now time.Time, reqControl cacheControl) bool {
+	respControl := parseCacheControl(e.Headers)
+	if respControl.has("no-cache") || reqControl.has("no-cache") {
+		return false
+	}
+	lifetime := e.freshnessLifetime(respControl)
+	if maxAge, ok := reqControl.seconds("max-age"); ok {
+		lifetime = min(lifetime, maxAge)
+	}
+	return e.age(now) < lifetime
+}
+
+// freshnessLifetime returns how long the response is fresh after it was
+// generated (RFC 9111, section 4.2.1).
+func (e *cachedResponse) freshnessLifetime(respControl cacheControl) time.Duration {
+	if maxAge, ok := respControl.seconds("max-age"); ok {
+		return maxAge
+	}
+	expires := e.Headers.Get("expires")
+	if expires == "" {
+		return 0
+	}
+	expiresAt, err := http.ParseTime(expires)
+	if err != nil {
+		return 0 // invalid dates such as "-1" mean already expired
+	}
+	date := e.ResponseTime
+	if d, err := http.ParseTime(e.Headers.Get("date")); err == nil {
+		date = d
+	}
+	return expiresAt.Sub(date)
+}
+
+// age returns the current age of the response (RFC 9111, section 4.2.3).
+func (e *cachedResponse) age(now time.Time) time.Duration {
+	age := e.ResponseTime.Sub(e.RequestTime)
+	if seconds, err := strconv.Atoi(e.Headers.Get("age")); err == nil && seconds > 0 {
+		age += time.Duration(seconds) * time.Second
+	}
+	return age + now.Sub(e.ResponseTime)
+}
+
+// conditionalRequest returns req with the validators of the entry, so the
+// server can answer with 304 Not Modified.
+func (e *cachedResponse) conditionalRequest(req *Request) *Request {
+	etag, lastModified := e.Headers.Get("etag"), e.Headers.Get("last-modified")
+	if etag == "" && lastModified == "" {
+		return req
+	}
+	conditional := *req
+	conditional.Headers = req.Headers.Clone()
+	if etag != "" {
+		conditional.Headers.Set("if-none-match", etag)
+	}
+	if lastModified != "" {
+		conditional.Headers.Set("if-modified-since", lastModified)
+	}
+	return &conditional
+}
+
+// update applies the headers of a 304 Not Modified response to the entry.
+func (e *cachedResponse) update(headers Header, requestTime, responseTime time.Time) {
+	for name, values := range headers {
+		switch name {
+		case "content-encoding", "content-length", "set-cookie":
+			continue
+		}
+		e.Headers[name] = slices.Clone(values)
+	}
+	e.RequestTime, e.ResponseTime = requestTime, responseTime
+}
+
+// varyNames returns the lowercase header names listed by the vary headers.
+func varyNames(headers Header) []string {
+	var names []string
+	for _, value := range headers.Values("vary") {
+		for name := range strings.SplitSeq(value, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// cacheControl holds the directives of cache-control headers, lowercase,
+// mapped to their unquoted arguments.
+type cacheControl map[string]string
+
+func parseCacheControl(headers Header) cacheControl {
+	cc := cacheControl{}
+	for _, value := range headers.Values("cache-control") {
+		for directive := range strings.SplitSeq(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds returns the argument of a directive such as max-age as a
+// duration. ok is false if the directive is missing or invalid.
+func (cc cacheControl) seconds(directive string) (d time.Duration, ok bool) {
+	seconds, err := strconv.ParseInt(cc[directive], 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(min(seconds, int64(maxCacheAge/time.Second))) * time.Second, true
+}
+
+// MemoryCache is a Cache that keeps values in memory. Once their total size
+// exceeds the limit, the least recently used values are dropped.
+type MemoryCache struct {
+	maxSize int
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // of *memoryCacheItem, most recently used first
+	entries map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key   string
+	value []byte
+}
+
+// NewMemoryCache returns a MemoryCache holding up to maxSize bytes of
+// values. A maxSize of 0 or less means no limit.
+func NewMemoryCache(maxSize int) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get implements Cache.
+func (m *MemoryCache) Get(key string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheItem).value, true
+}
+
+// Set implements Cache.
+func (m *MemoryCache) Set(key string, value []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+	m.entries[key] = m.lru.PushFront(&memoryCacheItem{key: key, value: value})
+	m.size += len(value)
+	for m.maxSize > 0 && m.size > m.maxSize {
+		m.remove(m.lru.Back().Value.(*memoryCacheItem).key)
+	}
+}
+
+// Delete implements Cache.
+func (m *MemoryCache) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(key)
+}
+
+func (m *MemoryCache) remove(key string) {
+	elem, ok := m.entries[key]
+	if !ok {
+		return
+	}
+	m.lru.Remove(elem)
+	delete(m.entries, key)
+	m.size -= len(elem.Value.(*memoryCacheItem).value)
+}
+
+// DiskCache is a Cache that keeps each value in a file of a directory, so
+// cached responses survive restarts. Files are named after the SHA-256 hash
+// of their key. Errors are logged, and a value that cannot be read counts
+// as missing.
+type DiskCache struct {
+	dir string
+}
+
+// NewDiskCache returns a DiskCache storing its files in dir, which is
+// created if it does not exist.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	return &DiskCache{dir: dir}, nil
+}
+
+// Get implements Cache.
+func (d *DiskCache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Failed to read cache file", "error", err)
+		}
+		return nil, false
+	}
+	return data, true
+}
+
+// Set implements Cache. The value is written to a temporary file first, so
+// readers never see a partial value.
+func (d *DiskCache) Set(key string, value []byte) {
+	tmp, err := os.CreateTemp(d.dir, ".tmp-*")
+	if err != nil {
+		slog.Warn("Failed to create cache file", "error", err)
+		return
+	}
+	_, err = tmp.Write(value)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), d.path(key))
+	}
+	if err != nil {
+		slog.Warn("Failed to write cache file", "error", err)
+		_ = os.Remove(tmp.Name())
+	}
+}
+
+// Delete implements Cache.
+func (d *DiskCache) Delete(key string) {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove cache file", "error", err)
+	}
+}
+
+func (d *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
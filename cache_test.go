@@ -0,0 +1,210 @@
+package qh
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedResponseFresh(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		headers    Header
+		reqControl string
+		stored     time.Duration // how long ago the response arrived
+		want       bool
+	}{
+		{"MaxAge", Header{"cache-control": {"max-age=60"}}, "", 30 * time.Second, true},
+		{"MaxAgeExpired", Header{"cache-control": {"max-age=60"}}, "", 90 * time.Second, false},
+		{"AgeHeader", Header{"cache-control": {"max-age=60"}, "age": {"40"}}, "", 30 * time.Second, false},
+		{"Expires", Header{
+			"date":    {"Wed, 01 Jan 2025 11:00:00 GMT"},
+			"expires": {"Wed, 01 Jan 2025 12:00:00 GMT"},
+		}, "", 30 * time.Second, true},
+		{"ExpiresInvalid", Header{"expires": {"-1"}}, "", 0, false},
+		{"MaxAgeOverridesExpires", Header{
+			"cache-control": {"max-age=0"},
+			"expires":       {"Thu, 01 Jan 2099 00:00:00 GMT"},
+		}, "", 0, false},
+		{"NoCache", Header{"cache-control": {"no-cache, max-age=60"}}, "", 0, false},
+		{"OnlyValidators", Header{"etag": {`"v1"`}}, "", 0, false},
+		{"RequestNoCache", Header{"cache-control": {"max-age=60"}}, "no-cache", 0, false},
+		{"RequestMaxAge", Header{"cache-control": {"max-age=60"}}, "max-age=10", 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := &cachedResponse{
+				Headers:      tt.headers,
+				RequestTime:  now.Add(-tt.stored),
+				ResponseTime: now.Add(-tt.stored),
+			}
+			reqControl := parseCacheControl(Header{"cache-control": {tt.reqControl}})
+			assert.Equal(t, tt.want, entry.fresh(now, reqControl))
+		})
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	m := NewMemoryCache(10)
+	m.Set("a", []byte("1234"))
+	m.Set("b", []byte("1234"))
+	_, ok := m.Get("a") // a is now used more recently than b
+	require.True(t, ok)
+	m.Set("c", []byte("1234"))
+
+	_, ok = m.Get("b")
+	assert.False(t, ok, "least recently used value should be dropped")
+	value, ok := m.Get("a")
+	require.True(t, ok)
+	assert.Equal(t, []byte("1234"), value)
+
+	m.Delete("a")
+	_, ok = m.Get("a")
+	assert.False(t, ok)
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir)
+	require.NoError(t, err)
+
+	_, ok := d.Get("qh://example.com/")
+	assert.False(t, ok)
+	d.Set("qh://example.com/", []byte("value"))
+	d.Set("qh://example.com/", []byte("new value"))
+
+	reopened, err := NewDiskCache(dir)
+	require.NoError(t, err)
+	value, ok := reopened.Get("qh://example.com/")
+	require.True(t, ok)
+	assert.Equal(t, []byte("new value"), value)
+
+	reopened.Delete("qh://example.com/")
+	_, ok = d.Get("qh://example.com/")
+	assert.False(t, ok)
+}
+
+func TestClientCache(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	hits := map[string]int{}
+	hit := func(req *Request) int {
+		mu.Lock()
+		defer mu.Unlock()
+		hits[req.Path]++
+		return hits[req.Path]
+	}
+	hitsOf := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+	respond := func(headers map[string]string) ResponseFunc {
+		return func(req *Request) *Response {
+			return NewResponse(StatusOK, fmt.Appendf(nil, "response %d", hit(req)), headers)
+		}
+	}
+	srv.HandleFunc("/max-age", GET, respond(map[string]string{"cache-control": "private, max-age=60"}))
+	srv.HandleFunc("/max-age", POST, respond(nil))
+	srv.HandleFunc("/no-store", GET, respond(map[string]string{"cache-control": "no-store, max-age=60"}))
+	srv.HandleFunc("/vary", GET, respond(map[string]string{"cache-control": "max-age=60", "vary": "x-lang"}))
+	srv.HandleFunc("/etag", GET, func(req *Request) *Response {
+		n := hit(req)
+		if req.Headers.Get("if-none-match") == `"v1"` {
+			return NewResponse(StatusNotModified, nil, map[string]string{"etag": `"v1"`, "x-check": "revalidated"})
+		}
+		return NewResponse(StatusOK, fmt.Appendf(nil, "response %d", n), map[string]string{"etag": `"v1"`})
+	})
+	srv.HandleFunc("/last-modified", GET, func(req *Request) *Response {
+		n := hit(req)
+		lastModified := "Wed, 01 Jan 2025 00:00:00 GMT"
+		if req.Headers.Get("if-modified-since") == lastModified {
+			return NewResponse(StatusNotModified, nil, nil)
+		}
+		return NewResponse(StatusOK, fmt.Appendf(nil, "response %d", n), map[string]string{
+			"last-modified": lastModified,
+		})
+	})
+
+	send := func(t *testing.T, client *Client, method Method, path string, headers map[string]string) *Response {
+		t.Helper()
+		req, err := NewRequest(method, "qh://"+addr+path, nil)
+		require.NoError(t, err)
+		for name, value := range headers {
+			req.Headers.Set(name, value)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, err := client.DoContext(ctx, req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	client := NewClient(WithCache(NewMemoryCache(0)))
+	defer client.Close()
+
+	t.Run("Fresh", func(t *testing.T) {
+		assert.Equal(t, "response 1", string(send(t, client, GET, "/max-age", nil).Body))
+		assert.Equal(t, "response 1", string(send(t, client, GET, "/max-age", nil).Body))
+		assert.Equal(t, 1, hitsOf("/max-age"))
+
+		assert.Equal(t, "response 2", string(send(t, client, GET, "/max-age", map[string]string{
+			"cache-control": "no-cache",
+		}).Body))
+	})
+
+	t.Run("UnsafeRequestInvalidates", func(t *testing.T) {
+		send(t, client, POST, "/max-age", nil)
+		assert.Equal(t, "response 4", string(send(t, client, GET, "/max-age", nil).Body))
+	})
+
+	t.Run("NoStore", func(t *testing.T) {
+		send(t, client, GET, "/no-store", nil)
+		send(t, client, GET, "/no-store", nil)
+		assert.Equal(t, 2, hitsOf("/no-store"))
+	})
+
+	t.Run("Vary", func(t *testing.T) {
+		en := map[string]string{"x-lang": "en"}
+		assert.Equal(t, "response 1", string(send(t, client, GET, "/vary", en).Body))
+		assert.Equal(t, "response 1", string(send(t, client, GET, "/vary", en).Body))
+		assert.Equal(t, "response 2", string(send(t, client, GET, "/vary", map[string]string{"x-lang": "de"}).Body))
+	})
+
+	t.Run("RevalidatesETag", func(t *testing.T) {
+		send(t, client, GET, "/etag", nil)
+		resp := send(t, client, GET, "/etag", nil)
+		assert.Equal(t, StatusOK, resp.StatusCode)
+		assert.Equal(t, "response 1", string(resp.Body))
+		assert.Equal(t, "revalidated", resp.Headers.Get("x-check"))
+		assert.Equal(t, 2, hitsOf("/etag"))
+	})
+
+	t.Run("RevalidatesLastModified", func(t *testing.T) {
+		send(t, client, GET, "/last-modified", nil)
+		resp := send(t, client, GET, "/last-modified", nil)
+		assert.Equal(t, StatusOK, resp.StatusCode)
+		assert.Equal(t, "response 1", string(resp.Body))
+		assert.Equal(t, 2, hitsOf("/last-modified"))
+	})
+
+	t.Run("DiskSurvivesClient", func(t *testing.T) {
+		dir := t.TempDir()
+		for range 2 {
+			disk, err := NewDiskCache(dir)
+			require.NoError(t, err)
+			client := NewClient(WithCache(disk))
+			resp := send(t, client, GET, "/max-age", nil)
+			require.NoError(t, client.Close())
+			assert.Equal(t, "response 5", string(resp.Body))
+		}
+	})
+}
@@ -2,18 +2,18 @@ package qh
 
 import (
 	"context"
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"net/url"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	"github.com/qo-proto/qotp"
 )
@@ -24,28 +24,84 @@ const (
 	defaultMaxRedirects    = 10
 	DefaultAcceptEncoding  = "zstd, br, gzip"
 
-	x25519KeySize         = 32 // X25519 public key size in bytes
-	maxDNSTXTRecordLength = 80
+	x25519KeySize         = 32  // X25519 public key size in bytes
+	maxDNSTXTRecordLength = 255 // one TXT character-string, room for several keys
 )
 
 // Client is a QH protocol client that manages connections to QH servers.
 // It supports connection establishment with optional 0-RTT via DNS-based key exchange,
 // automatic response decompression, and redirect handling.
+//
+// Connections are pooled per server endpoint and key, see getConn, so one
+// Client can talk to any number of origins.
 type Client struct {
-	listener        *qotp.Listener
-	conn            *qotp.Conn
-	streamID        atomic.Uint32
-	remoteAddr      *net.UDPAddr
-	maxResponseSize int
-	maxRedirects    int
-	keylogWriter    io.Writer
+	maxResponseSize  int
+	maxRedirects     int
+	checkRedirect    func(req *Request, via []*Request) error // nil to follow all redirects
+	maxIdleTime      time.Duration
+	handshakeTimeout time.Duration
+	retryPolicy      *RetryPolicy // nil if requests are not retried
+	keylogWriter     io.Writer
+	jar              CookieJar // nil if cookies are not kept
+	cache            Cache     // nil if responses are not cached
+	requestEncoding  Encoding  // compresses request bodies, "" to send them as they are
+
+	resolver         Resolver                          // looks up server addresses and DNS keys
+	knownHosts       *KnownHosts                       // nil if server keys are not pinned
+	insecureUnpinned bool                              // connect to hosts without a known or DNS key, see WithInsecureUnpinnedHosts
+	serverKeys       map[string]func() (string, error) // host -> configured server key; other hosts look it up in DNS
+
+	poolMu        sync.Mutex              // guards the fields below and the use counts of the connections
+	conns         map[connKey]*clientConn // open connections
+	origins       map[string]*clientConn  // origin ("host:port") -> connection serving it
+	dials         map[string]*dialCall    // origin -> dial in progress
+	defaultOrigin string                  // origin passed to Connect, used for requests without a port
+}
+
+// pendingResponse collects the response for a single in-flight request.
+// Everything except done is only touched by the read loop goroutine.
+type pendingResponse struct {
+	buf    []byte
+	done   chan responseResult
+	stream bool         // deliver the response as soon as its head has arrived
+	body   *bodyPipe    // set once a streamed response has been delivered
+	dec    *bodyDecoder // decodes the body section of a streamed response into body
+	trace  *ClientTrace // from the request context, may be nil
+}
+
+type responseResult struct {
+	resp *Response
+	err  error
+}
+
+// TimeoutError is returned when a connection attempt or a request does not
+// complete before the deadline of its context.
+type TimeoutError struct {
+	Op  string // "connect" or "request"
+	Err error  // the context error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the error is a timeout, which is always true. It
+// lets callers check for timeouts the same way as for a net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
 }
 
 // ClientOption is a functional option for configuring a Client.
 type ClientOption func(*Client)
 
 // WithMaxResponseSize sets the maximum allowed response size in bytes.
-// Responses exceeding this limit will return an error.
+// Responses exceeding this limit will return an error. For a response
+// received with RequestStream it limits the response head and how much of
+// the body is buffered for a caller that has not read it yet.
 // Default is 50MB.
 func WithMaxResponseSize(size int) ClientOption {
 	return func(c *Client) {
@@ -62,11 +118,78 @@ func WithMaxRedirects(limit int) ClientOption {
 	}
 }
 
+// ErrUseLastResponse can be returned by a CheckRedirect function to stop
+// following redirects. The redirect response is then returned as it is,
+// without an error.
+var ErrUseLastResponse = errors.New("use last response")
+
+// WithCheckRedirect sets a function that decides whether a redirect is
+// followed, like http.Client.CheckRedirect. It is called with the upcoming
+// request and the requests made so far, oldest first, after the limit of
+// WithMaxRedirects has been checked. If it returns an error, the request
+// fails with it, except for ErrUseLastResponse. The function may modify req,
+// such as its headers.
+func WithCheckRedirect(fn func(req *Request, via []*Request) error) ClientOption {
+	return func(c *Client) {
+		c.checkRedirect = fn
+	}
+}
+
+// WithRequestCompression makes the client compress request bodies of at
+// least 1KB with encoding and set the content-encoding header, if that makes
+// them smaller. Requests that already have a content-encoding and streamed
+// bodies are sent as they are. The server must support encoding, or it
+// replies with 415 Unsupported Media Type.
+func WithRequestCompression(encoding Encoding) ClientOption {
+	return func(c *Client) {
+		c.requestEncoding = encoding
+	}
+}
+
+// WithServerPublicKey sets the base64 X25519 public key of the server for
+// host, as returned by Server.PublicKey, so connections to host are made with
+// 0-RTT without looking up the key in DNS. Other hosts are not affected; the
+// option can be given once per host.
+func WithServerPublicKey(host, key string) ClientOption {
+	return func(c *Client) {
+		c.setServerKey(host, func() (string, error) { return key, nil })
+	}
+}
+
+// WithServerKeyFile is like WithServerPublicKey, but reads the key from a
+// file holding the base64 key. The file is read for each new connection, so
+// a changed key takes effect without a new client.
+func WithServerKeyFile(host, path string) ClientOption {
+	return func(c *Client) {
+		c.setServerKey(host, func() (string, error) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("reading server key file: %w", err)
+			}
+			return strings.TrimSpace(string(data)), nil
+		})
+	}
+}
+
+// setServerKey configures the server key of host. Host names are compared
+// case-insensitively.
+func (c *Client) setServerKey(host string, key func() (string, error)) {
+	if c.serverKeys == nil {
+		c.serverKeys = make(map[string]func() (string, error))
+	}
+	c.serverKeys[strings.ToLower(host)] = key
+}
+
 // NewClient creates a new QH client with the specified options.
 func NewClient(opts ...ClientOption) *Client {
 	c := &Client{
-		maxResponseSize: defaultMaxResponseSize,
-		maxRedirects:    defaultMaxRedirects,
+		maxResponseSize:  defaultMaxResponseSize,
+		maxRedirects:     defaultMaxRedirects,
+		maxIdleTime:      defaultMaxIdleTime,
+		handshakeTimeout: defaultHandshakeTimeout,
+		conns:            make(map[connKey]*clientConn),
+		origins:          make(map[string]*clientConn),
+		resolver:         NewCachingResolver(net.DefaultResolver, defaultResolverTTL),
 	}
 
 	for _, opt := range opts {
@@ -83,135 +206,107 @@ func WithClientKeyLogWriter(w io.Writer) ClientOption {
 }
 
 // Connect establishes a connection to a QH server at the specified address.
-// The address should be in "host:port" format.
+// The address is either in "host:port" format or a qh URL such as
+// "qh://example.com", whose port defaults to DefaultPort. Requests without a
+// port, such as those sent by the method helpers, go to this server.
 //
 // Connect performs concurrent DNS lookups to resolve the hostname and
 // optionally retrieve the server's public key from a DNS TXT record
 // (at _qotp.<host>) for 0-RTT connection establishment. If no valid DNS key
 // is found, Connect falls back to a standard in-band key exchange handshake.
 func (c *Client) Connect(addr string, _ io.Writer) error {
-	host, portStr, err := net.SplitHostPort(addr)
-	if err != nil {
-		return fmt.Errorf("invalid address format: %w", err)
-	}
+	return c.ConnectContext(context.Background(), addr)
+}
 
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return fmt.Errorf("invalid port: %w", err)
+// ConnectContext is like Connect but stops the DNS lookups when ctx is done.
+// If the deadline of ctx passes before the connection is established, a
+// *TimeoutError is returned.
+func (c *Client) ConnectContext(ctx context.Context, addr string) error {
+	if strings.HasPrefix(addr, "qh://") {
+		u, err := ParseURL(addr)
+		if err != nil {
+			return err
+		}
+		addr = u.Addr()
 	}
-
-	// Concurrently resolve hostname to IP and look for a server public key in DNS.
-	var ip net.IP
-	var serverPubKey string
-	var ipLookupErr error
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	go func() {
-		defer wg.Done()
-		ip, ipLookupErr = resolveAddr(host)
-	}()
-
-	go func() {
-		defer wg.Done()
-		// This function handles errors internally and just logs them,
-		// as failing to find a key is not a critical connection error.
-		serverPubKey = lookupPubKey(host)
-	}()
-
-	wg.Wait()
-
-	// Check for errors from the IP lookup.
-	if ipLookupErr != nil {
-		return ipLookupErr
+	if _, _, err := splitHostPort(addr); err != nil {
+		return err
 	}
-
-	// create local listener (auto generates keys)
-	opts := []qotp.ListenFunc{}
-	c.addKeyLogWriter(&opts)
-	listener, err := qotp.Listen(opts...)
+	cc, err := c.getConn(ctx, addr)
 	if err != nil {
-		return fmt.Errorf("failed to create listener: %w", err)
+		return err
 	}
-	c.listener = listener
-
-	ipAddr := fmt.Sprintf("%s:%d", ip.String(), port)
+	c.releaseConn(cc)
 
-	// Construct the UDP address to store it for potential reconnects.
-	udpAddr := &net.UDPAddr{
-		IP:   ip,
-		Port: port,
-	}
+	c.poolMu.Lock()
+	c.defaultOrigin = addr
+	c.poolMu.Unlock()
+	return nil
+}
 
-	var conn *qotp.Conn
-	if serverPubKey != "" {
-		// Out-of-band key exchange (0-RTT)
-		slog.Info("Attempting connection with out-of-band key (0-RTT)")
-		pubKeyBytes, decodeErr := base64.StdEncoding.DecodeString(serverPubKey)
-		switch {
-		case decodeErr != nil:
-			slog.Warn(
-				"Failed to decode base64 public key from DNS, falling back to in-band handshake",
-				"error",
-				decodeErr,
-			)
-		case len(pubKeyBytes) != x25519KeySize:
-			slog.Warn(
-				"Invalid public key length from DNS, expected X25519 key size, falling back to in-band handshake",
-				"expected",
-				x25519KeySize,
-				"got",
-				len(pubKeyBytes),
-			)
-		default:
-			pubKeyHex := hex.EncodeToString(pubKeyBytes)
-			conn, err = listener.DialWithCryptoString(ipAddr, pubKeyHex)
-		}
-	} else {
-		// In-band key exchange
-		slog.Info("No DNS key found, attempting connection with in-band key exchange")
-		conn, err = listener.DialString(ipAddr)
+// splitHostPort splits a "host:port" address and parses the port.
+func splitHostPort(addr string) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid address format: %w", err)
 	}
-
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return fmt.Errorf("failed to connect to %s: %w", ipAddr, err)
+		return "", 0, fmt.Errorf("invalid port: %w", err)
 	}
-	c.conn = conn
-	c.remoteAddr = udpAddr
-	slog.Info("Connected to QH server", "addr", addr, "resolved", ipAddr)
-	return nil
+	return host, port, nil
 }
 
-// resolveAddr resolves a host to an IP address. It first tries to parse the host
-// as a literal IP address to avoid a DNS lookup if possible.
-func resolveAddr(host string) (net.IP, error) {
+// resolveAddrs resolves a host to its IP addresses, ordered for connection
+// attempts, see interleaveAddrs. It first tries to parse the host as a
+// literal IP address to avoid a DNS lookup if possible.
+func resolveAddrs(ctx context.Context, r Resolver, host string) ([]net.IP, error) {
 	// First, try parsing as an IP to avoid a DNS lookup if not needed.
 	if parsedIP := net.ParseIP(host); parsedIP != nil {
-		return parsedIP, nil
+		return []net.IP{parsedIP}, nil
 	}
 	// If not an IP, resolve the hostname.
-	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	addrs, err := r.LookupIPAddr(ctx, host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve hostname %s: %w", host, err)
 	}
-	if len(ips) == 0 {
+	if len(addrs) == 0 {
 		return nil, fmt.Errorf("no IP addresses found for hostname: %s", host)
 	}
-	return ips[0].IP, nil // Use the first resolved IP
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return interleaveAddrs(ips), nil
 }
 
-// lookupPubKey looks for a server's public key in a DNS TXT record.
-// It returns the key as a string if a valid record is found, or an empty string otherwise.
-func lookupPubKey(host string) string {
-	txtRecords, err := net.DefaultResolver.LookupTXT(context.Background(), "_qotp."+host)
+// lookupPubKeys looks for a server's public keys in the DNS TXT records at
+// _qotp.<host>. It returns the valid keys in the order of the records, or
+// nil if there are none. A record may carry several keys, and records that
+// are too long, have another version or hold invalid keys are skipped.
+func lookupPubKeys(ctx context.Context, r Resolver, host string) []string {
+	txtRecords, err := r.LookupTXT(ctx, "_qotp."+host)
 	if err != nil || len(txtRecords) == 0 {
 		// No record found or an error occurred, just continue without 0-RTT.
-		return ""
+		return nil
 	}
 
-	// Parse the first TXT record, expecting "v=0;k=..."
-	record := txtRecords[0]
+	var keys []string
+	for _, record := range txtRecords {
+		for _, key := range parseKeyRecord(host, record) {
+			if !slices.Contains(keys, key) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	if len(keys) > 0 {
+		slog.Info("Found valid QOTP public keys in DNS TXT records", "host", host, "keys", keys)
+	}
+	return keys
+}
 
+// parseKeyRecord returns the valid keys of a "v=0;k=...[;k=...]" record.
+func parseKeyRecord(host, record string) []string {
 	if len(record) > maxDNSTXTRecordLength {
 		slog.Warn(
 			"DNS TXT record too long, ignoring",
@@ -222,11 +317,11 @@ func lookupPubKey(host string) string {
 			"host",
 			host,
 		)
-		return ""
+		return nil
 	}
 	parts := strings.Split(record, ";")
 	version := -1
-	var key string
+	var keys []string
 
 	for _, part := range parts {
 		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
@@ -240,26 +335,50 @@ func lookupPubKey(host string) string {
 				version = v
 			}
 		case "k":
-			key = kv[1]
+			keys = append(keys, kv[1])
+		}
+	}
+
+	if version != qotp.ProtoVersion || len(keys) == 0 {
+		if len(keys) > 0 || version != -1 {
+			slog.Warn(
+				"DNS TXT record found but is invalid or has mismatched version",
+				"record",
+				record,
+				"expected_version",
+				qotp.ProtoVersion,
+			)
 		}
+		return nil
 	}
 
-	// Validate the found values
-	if version == qotp.ProtoVersion && key != "" {
-		slog.Info("Found valid QOTP public key in DNS TXT record", "host", host, "key", key)
-		return key
+	valid := keys[:0]
+	for _, key := range keys {
+		if _, err := decodeServerKey(key); err != nil {
+			slog.Warn("Invalid public key in DNS TXT record, ignoring", "host", host, "error", err)
+			continue
+		}
+		valid = append(valid, key)
 	}
+	return valid
+}
 
-	if key != "" || version != -1 {
-		slog.Warn(
-			"DNS TXT record found but is invalid or has mismatched version",
-			"record",
-			record,
-			"expected_version",
-			qotp.ProtoVersion,
-		)
+// NewRequest returns a request for a qh URL of the form
+// "qh://host[:port][/path][?query]", see ParseURL.
+func NewRequest(method Method, rawURL string, body []byte) (*Request, error) {
+	u, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
 	}
-	return ""
+	return &Request{
+		Method:  method,
+		Host:    u.Host,
+		Port:    u.Port,
+		Path:    u.RequestURI(),
+		Version: Version,
+		Headers: Header{},
+		Body:    body,
+	}, nil
 }
 
 // Request sends a QH request and returns the response.
@@ -269,85 +388,97 @@ func lookupPubKey(host string) string {
 // This method handles automatic decompression of responses if the server
 // uses compression and the client advertised support via Accept-Encoding.
 func (c *Client) Request(req *Request, redirectCount int) (*Response, error) {
-	if c.conn == nil {
-		return nil, errors.New("client not connected")
-	}
-
-	if _, ok := req.Headers["accept-encoding"]; !ok {
-		req.Headers["accept-encoding"] = DefaultAcceptEncoding
-	}
-
-	// Get next available stream ID
-	currentStreamID := c.streamID.Add(1) - 1
-
-	stream := c.conn.Stream(currentStreamID)
+	return c.request(context.Background(), req, redirectCount, nil)
+}
 
-	requestData := req.Format()
-	slog.Debug("Sending request", "stream_id", currentStreamID, "bytes", len(requestData))
+// DoContext sends req and returns the response, following redirects and
+// decompressing the body like Request. The request goes to the origin given
+// by req.Host and req.Port, see NewRequest.
+//
+// If ctx is done before the response has arrived, the stream carrying the
+// request is closed so the server can stop working on it, and DoContext
+// returns a *TimeoutError if the deadline passed, or ctx.Err() otherwise. A
+// streamed request body is only abandoned once its next Read returns.
+//
+// With the current QOTP version, closing a stream whose data has already
+// been sent may also end the connection a few seconds later. Requests then
+// fail with a connection error until the client reconnects.
+func (c *Client) DoContext(ctx context.Context, req *Request) (*Response, error) {
+	return c.request(ctx, req, 0, nil)
+}
 
-	_, err := stream.Write(requestData)
+// request sends req and follows redirects. via holds the requests that led
+// to req, oldest first.
+func (c *Client) request(
+	ctx context.Context,
+	req *Request,
+	redirectCount int,
+	via []*Request,
+) (*Response, error) {
+	origin, err := c.origin(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return nil, err
 	}
 
-	var responseBuffer []byte
-
-	c.listener.Loop(func(s *qotp.Stream) (bool, error) {
-		if s == nil {
-			return true, nil
-		}
-
-		chunk, err := s.Read()
-		if err != nil {
-			slog.Debug("Read error in response loop", "error", err)
-			return true, nil
-		}
-		if len(chunk) == 0 {
-			return true, nil
-		}
-
-		slog.Debug("Received chunk from server", "bytes", len(chunk))
-
-		if len(responseBuffer)+len(chunk) > c.maxResponseSize {
-			return false, fmt.Errorf("response size exceeds limit of %d bytes", c.maxResponseSize)
-		}
-
-		responseBuffer = append(responseBuffer, chunk...)
-
-		complete, checkErr := IsResponseComplete(responseBuffer)
-		if checkErr != nil {
-			slog.Error("Error checking response completeness", "error", checkErr)
-			return false, nil
-		}
-
-		if complete {
-			return false, nil
-		}
-
-		return true, nil
-	})
+	if !req.Headers.Has("accept-encoding") {
+		req.Headers.Set("accept-encoding", DefaultAcceptEncoding)
+	}
 
-	resp, parseErr := ParseResponse(responseBuffer)
-	if parseErr != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", parseErr)
+	u, err := requestURL(req, origin)
+	if err != nil {
+		return nil, err
 	}
-	if resp == nil {
-		return nil, errors.New("no response received")
+	sent, err := c.compressRequest(c.addCookies(req, u))
+	if err != nil {
+		return nil, err
 	}
+	resp, err := c.cachedRoundTrip(ctx, origin, u, sent)
+	if err != nil {
+		return nil, err
+	}
+	c.saveCookies(u, resp)
 
 	// Handle redirects
 	switch resp.StatusCode {
 	case StatusMultipleChoices,
 		StatusMovedPermanently,
 		StatusFound,
+		StatusSeeOther,
 		StatusTemporaryRedirect,
 		StatusPermanentRedirect:
-		return c.handleRedirect(req, resp, redirectCount)
+		return c.handleRedirect(ctx, u, req, resp, redirectCount, via)
 	}
+	return c.decodeResponse(ctx, resp)
+}
 
-	if err := c.decompressResponse(resp); err != nil {
-		return nil, fmt.Errorf("decompression failed: %w", err)
+// RequestStream sends a QH request and returns as soon as the response head
+// has arrived. The response body is delivered through resp.BodyReader as it
+// is received, and the caller must close it. Closing it early discards the
+// rest of the body.
+//
+// Unlike Request, RequestStream does not follow redirects, does not add an
+// accept-encoding header or decompress the body, and does not limit the size
+// of the body. The maximum response size limits the response head and how
+// much of the body is buffered before the caller reads it; beyond that, the
+// client stops reading the stream until the caller catches up.
+func (c *Client) RequestStream(req *Request) (*Response, error) {
+	origin, err := c.origin(req)
+	if err != nil {
+		return nil, err
+	}
+	u, err := requestURL(req, origin)
+	if err != nil {
+		return nil, err
+	}
+	sent, err := c.compressRequest(c.addCookies(req, u))
+	if err != nil {
+		return nil, err
 	}
+	resp, err := c.roundTrip(context.Background(), origin, sent, true)
+	if err != nil {
+		return nil, err
+	}
+	c.saveCookies(u, resp)
 	return resp, nil
 }
 
@@ -395,16 +526,129 @@ func (c *Client) HEAD(host, path string, headers map[string]string) (*Response,
 	return c.do(HEAD, host, path, headers, nil)
 }
 
-// Close closes the client connection and releases associated resources.
-// After calling Close, the client should not be used for further requests.
+// Get sends a GET request to a qh URL such as "qh://example.com/api?x=1",
+// connecting to the server on demand. Redirects are followed and the body is
+// decompressed as by DoContext.
+func (c *Client) Get(ctx context.Context, rawURL string) (*Response, error) {
+	return c.doURL(ctx, GET, rawURL, "", nil)
+}
+
+// Head is like Get but sends a HEAD request.
+func (c *Client) Head(ctx context.Context, rawURL string) (*Response, error) {
+	return c.doURL(ctx, HEAD, rawURL, "", nil)
+}
+
+// Delete is like Get but sends a DELETE request.
+func (c *Client) Delete(ctx context.Context, rawURL string) (*Response, error) {
+	return c.doURL(ctx, DELETE, rawURL, "", nil)
+}
+
+// Post sends a POST request with the given content type and body to a qh
+// URL, connecting to the server on demand.
+func (c *Client) Post(ctx context.Context, rawURL, contentType string, body []byte) (*Response, error) {
+	return c.doURL(ctx, POST, rawURL, contentType, body)
+}
+
+// Put is like Post but sends a PUT request.
+func (c *Client) Put(ctx context.Context, rawURL, contentType string, body []byte) (*Response, error) {
+	return c.doURL(ctx, PUT, rawURL, contentType, body)
+}
+
+// Patch is like Post but sends a PATCH request.
+func (c *Client) Patch(ctx context.Context, rawURL, contentType string, body []byte) (*Response, error) {
+	return c.doURL(ctx, PATCH, rawURL, contentType, body)
+}
+
+func (c *Client) doURL(
+	ctx context.Context,
+	method Method,
+	rawURL, contentType string,
+	body []byte,
+) (*Response, error) {
+	req, err := NewRequest(method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Headers.Set("content-type", contentType)
+	}
+	return c.DoContext(ctx, req)
+}
+
+// Close closes all connections of the client and releases associated
+// resources. After calling Close, the client should not be used for further
+// requests.
 func (c *Client) Close() error {
-	if c.conn != nil {
-		c.conn.Close()
+	c.poolMu.Lock()
+	conns := c.conns
+	c.conns = make(map[connKey]*clientConn)
+	c.origins = make(map[string]*clientConn)
+	c.poolMu.Unlock()
+
+	var errs []error
+	for _, cc := range conns {
+		errs = append(errs, cc.close())
 	}
-	if c.listener != nil {
-		return c.listener.Close()
+	return errors.Join(errs...)
+}
+
+// origin returns the "host:port" origin req is sent to. Requests without a
+// port go to the server given to Connect.
+func (c *Client) origin(req *Request) (string, error) {
+	if req.Port != 0 {
+		return net.JoinHostPort(req.Host, strconv.Itoa(req.Port)), nil
 	}
-	return nil
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	if c.defaultOrigin == "" {
+		return "", errors.New("client not connected")
+	}
+	return c.defaultOrigin, nil
+}
+
+// requestURL returns the URL of req, with the port of the origin it is sent
+// to.
+func requestURL(req *Request, origin string) (*URL, error) {
+	_, port, err := splitHostPort(origin)
+	if err != nil {
+		return nil, err
+	}
+	u := req.URL()
+	u.Port = port
+	return u, nil
+}
+
+// roundTrip sends req to origin on a pooled connection, see
+// clientConn.roundTrip.
+func (c *Client) roundTrip(ctx context.Context, origin string, req *Request, stream bool) (*Response, error) {
+	cc, err := c.getConn(ctx, origin)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// A server that cannot be reached now may be back for a retry.
+		return nil, &transportError{err}
+	}
+	defer c.releaseConn(cc)
+	return cc.roundTrip(ctx, req, stream)
+}
+
+// contextError returns the error for an operation stopped because ctx is
+// done: a *TimeoutError if its deadline passed, or ctx.Err() otherwise.
+func contextError(ctx context.Context, op string) error {
+	err := ctx.Err()
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	return err
+}
+
+func (p *pendingResponse) finish(resp *Response, err error) {
+	if p.body != nil {
+		p.body.finish(err)
+		return
+	}
+	p.done <- responseResult{resp: resp, err: err}
 }
 
 func (c *Client) do(
@@ -413,9 +657,6 @@ func (c *Client) do(
 	headers map[string]string,
 	body []byte,
 ) (*Response, error) {
-	if headers == nil {
-		headers = map[string]string{}
-	}
 
 	// Normalize body based on method - body is only allowed for POST, PUT, PATCH
 	// NOTE: content-length header is not needed in QH - body length is determined by varint prefix
@@ -428,15 +669,61 @@ func (c *Client) do(
 		Host:    host,
 		Path:    path,
 		Version: Version,
-		Headers: headers,
+		Headers: headerFromMap(headers),
 		Body:    body,
 	}
 	return c.Request(req, 0)
 }
 
+// compressRequest returns req with its body compressed with the encoding of
+// WithRequestCompression. req itself is left unchanged, so a redirect resends
+// the original body.
+func (c *Client) compressRequest(req *Request) (*Request, error) {
+	if c.requestEncoding == "" || req.BodyReader != nil || len(req.Body) < defaultMinCompressionSize ||
+		req.Headers.Has("content-encoding") {
+		return req, nil
+	}
+	compressed, err := Compress(req.Body, c.requestEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("compressing request body: %w", err)
+	}
+	if len(compressed) >= len(req.Body) {
+		return req, nil
+	}
+	slog.Debug("Request body compressed", "encoding", c.requestEncoding,
+		"original_bytes", len(req.Body), "compressed_bytes", len(compressed))
+
+	withBody := *req
+	withBody.Body = compressed
+	withBody.Headers = req.Headers.Clone()
+	withBody.Headers.Set("content-encoding", string(c.requestEncoding))
+	return &withBody, nil
+}
+
+// decodeResponse decompresses the body of resp.
+func (c *Client) decodeResponse(ctx context.Context, resp *Response) (*Response, error) {
+	encoding, compressedSize := resp.Headers.Get("content-encoding"), len(resp.Body)
+	if err := c.decompressResponse(resp); err != nil {
+		ContextClientTrace(ctx).decompressDone(DecompressDoneInfo{
+			Encoding:       Encoding(encoding),
+			CompressedSize: compressedSize,
+			Err:            err,
+		})
+		return nil, fmt.Errorf("decompression failed: %w", err)
+	}
+	if encoding != "" {
+		ContextClientTrace(ctx).decompressDone(DecompressDoneInfo{
+			Encoding:       Encoding(encoding),
+			CompressedSize: compressedSize,
+			Size:           len(resp.Body),
+		})
+	}
+	return resp, nil
+}
+
 func (c *Client) decompressResponse(resp *Response) error {
-	contentEncoding, ok := resp.Headers["content-encoding"]
-	if !ok || contentEncoding == "" {
+	contentEncoding := resp.Headers.Get("content-encoding")
+	if contentEncoding == "" {
 		return nil // No compression
 	}
 
@@ -455,7 +742,7 @@ func (c *Client) decompressResponse(resp *Response) error {
 	}
 
 	resp.Body = decompressed
-	delete(resp.Headers, "content-encoding") // Remove encoding header after decompression
+	resp.Headers.Del("content-encoding") // Remove encoding header after decompression
 
 	slog.Info("Response decompressed", "encoding", contentEncoding,
 		"compressed_bytes", originalSize, "decompressed_bytes", len(decompressed))
@@ -463,88 +750,107 @@ func (c *Client) decompressResponse(resp *Response) error {
 	return nil
 }
 
-func (c *Client) reconnect(host string, port int) error {
-	slog.Info("Reconnecting to new host", "host", host, "port", port)
-	c.Close()
-
-	// Create a new listener for the new connection
-	opts := []qotp.ListenFunc{}
-	c.addKeyLogWriter(&opts)
-	listener, err := qotp.Listen(opts...)
-	if err != nil {
-		return fmt.Errorf("failed to create new listener for reconnect: %w", err)
-	}
-	c.listener = listener
-	return c.Connect(fmt.Sprintf("%s:%d", host, port), nil)
-}
-
 func (c *Client) handleRedirect(
+	ctx context.Context,
+	cur *URL,
 	req *Request,
 	resp *Response,
 	redirectCount int,
+	via []*Request,
 ) (*Response, error) {
 	if redirectCount >= c.maxRedirects {
 		return nil, errors.New("too many redirects")
 	}
 
-	var newHostname, newPath string
+	target, err := redirectTarget(cur, resp)
+	if err != nil {
+		return nil, err
+	}
 
-	// Prioritize custom host/path headers as requested.
-	if host, ok := resp.Headers["host"]; ok {
-		if path, ok := resp.Headers["path"]; ok {
-			slog.Info(
-				"Redirecting (custom headers)",
-				"status",
-				resp.StatusCode,
-				"host",
-				host,
-				"path",
-				path,
-			)
-			newHostname = host
-			newPath = path
-		}
-	} else if location, ok := resp.Headers["location"]; ok {
-		// Fallback to standard location header.
-		slog.Info("Redirecting (location header)", "status", resp.StatusCode, "location", location)
-		newURL, err := url.Parse(location)
-		if err != nil {
-			return nil, fmt.Errorf("invalid location header: %w", err)
+	// 307 and 308 repeat the request as it was. The other redirects, 303 in
+	// particular, are followed with a GET without a body, except for HEAD.
+	method, body := req.Method, req.Body
+	headers := req.Headers.Clone()
+	if resp.StatusCode == StatusTemporaryRedirect || resp.StatusCode == StatusPermanentRedirect {
+		if req.BodyReader != nil {
+			// The streamed body has already been consumed and cannot be resent.
+			return nil, fmt.Errorf("cannot follow %d redirect for a request with a streamed body", resp.StatusCode)
 		}
-		newHostname = newURL.Hostname()
-		newPath = newURL.Path
 	} else {
-		return nil, errors.New("redirect response missing location or host/path headers")
-	}
-
-	if newPath == "" {
-		newPath = "/"
+		if method != HEAD {
+			method = GET
+		}
+		body = nil
+		headers.Del("content-type")
 	}
 
-	// Preserve method and body for 307/308; switch to GET for 300/301/302.
-	preserve := resp.StatusCode == StatusTemporaryRedirect ||
-		resp.StatusCode == StatusPermanentRedirect
-	newMethod := GET
-	var newBody []byte
-	headers := req.Headers
-	if preserve {
-		newMethod = req.Method
-		newBody = req.Body
-	}
 	newReq := &Request{
-		Method:  newMethod,
-		Host:    newHostname,
-		Path:    newPath,
+		Method:  method,
+		Host:    target.Host,
+		Port:    target.Port,
+		Path:    target.RequestURI(),
 		Version: Version,
 		Headers: headers,
-		Body:    newBody,
+		Body:    body,
+	}
+	if strings.EqualFold(target.Host, cur.Host) && target.Port == cur.Port {
+		// Stay on the current origin, which is the server given to Connect
+		// if the request has no port.
+		newReq.Port = req.Port
+	} else {
+		// Credentials are meant for the origin they were sent to.
+		headers.Del("authorization")
+		headers.Del("cookie")
 	}
 
-	// Reconnect if the host has changed.
-	if newHostname != "" && newHostname != req.Host {
-		if err := c.reconnect(newHostname, c.remoteAddr.Port); err != nil {
-			return nil, err
+	via = append(via, req)
+	if c.checkRedirect != nil {
+		if err := c.checkRedirect(newReq, via); err != nil {
+			if errors.Is(err, ErrUseLastResponse) {
+				return c.decodeResponse(ctx, resp)
+			}
+			return nil, fmt.Errorf("redirect to %s: %w", target, err)
 		}
 	}
-	return c.Request(newReq, redirectCount+1)
+
+	ContextClientTrace(ctx).redirectFollowed(RedirectInfo{
+		StatusCode: resp.StatusCode,
+		Method:     newReq.Method,
+		URL:        newReq.URL(),
+	})
+	return c.request(ctx, newReq, redirectCount+1, via)
+}
+
+// redirectTarget returns where the redirect resp to the request for cur
+// points. The custom host and path headers take precedence over location,
+// which may be relative to cur. A new host given by the custom headers is
+// reached on the port of cur.
+func redirectTarget(cur *URL, resp *Response) (*URL, error) {
+	if host, path := resp.Headers.Get("host"), resp.Headers.Get("path"); host != "" && path != "" {
+		slog.Info("Redirecting (custom headers)", "status", resp.StatusCode, "host", host, "path", path)
+		path, rawQuery := splitQuery(path)
+		if path == "" {
+			path = "/"
+		}
+		return &URL{Host: host, Port: cur.Port, Path: path, RawQuery: rawQuery}, nil
+	}
+
+	location := resp.Headers.Get("location")
+	if location == "" {
+		return nil, errors.New("redirect response missing location or host/path headers")
+	}
+	slog.Info("Redirecting (location header)", "status", resp.StatusCode, "location", location)
+	ref, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid location header: %w", err)
+	}
+	base, err := url.Parse(cur.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid request URL: %w", err)
+	}
+	target, err := ParseURL(base.ResolveReference(ref).String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid location header: %w", err)
+	}
+	return target, nil
 }
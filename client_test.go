@@ -1,8 +1,16 @@
 package qh
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -13,7 +21,7 @@ func TestClientDecompression(t *testing.T) {
 
 	t.Run("NoCompression", func(t *testing.T) {
 		resp := &Response{
-			Headers: map[string]string{},
+			Headers: Header{},
 			Body:    []byte("plain text data"),
 		}
 		originalBody := string(resp.Body)
@@ -30,7 +38,7 @@ func TestClientDecompression(t *testing.T) {
 		require.NoError(t, err)
 
 		resp := &Response{
-			Headers: map[string]string{"content-encoding": "zstd"},
+			Headers: Header{"content-encoding": {"zstd"}},
 			Body:    compressed,
 		}
 
@@ -42,7 +50,7 @@ func TestClientDecompression(t *testing.T) {
 
 	t.Run("InvalidCompressedData", func(t *testing.T) {
 		resp := &Response{
-			Headers: map[string]string{"content-encoding": "zstd"},
+			Headers: Header{"content-encoding": {"zstd"}},
 			Body:    []byte("this is not actually compressed data"),
 		}
 
@@ -53,7 +61,7 @@ func TestClientDecompression(t *testing.T) {
 
 	t.Run("UnknownEncoding", func(t *testing.T) {
 		resp := &Response{
-			Headers: map[string]string{"content-encoding": "unknown-codec"},
+			Headers: Header{"content-encoding": {"unknown-codec"}},
 			Body:    []byte("some data"),
 		}
 
@@ -62,6 +70,41 @@ func TestClientDecompression(t *testing.T) {
 	})
 }
 
+func TestClientCompressRequest(t *testing.T) {
+	large := []byte(strings.Repeat("compressible ", 100))
+	random := make([]byte, 2048)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	client := NewClient(WithRequestCompression(Gzip))
+
+	req := &Request{Method: POST, Headers: Header{}, Body: large}
+	sent, err := client.compressRequest(req)
+	require.NoError(t, err)
+	assert.Equal(t, "gzip", sent.Headers.Get("content-encoding"))
+	assert.False(t, req.Headers.Has("content-encoding"), "request must not be modified")
+	decompressed, err := Decompress(sent.Body, Gzip, len(large))
+	require.NoError(t, err)
+	assert.Equal(t, large, decompressed)
+
+	tests := []struct {
+		name   string
+		client *Client
+		req    *Request
+	}{
+		{"Small", client, &Request{Method: POST, Headers: Header{}, Body: []byte("small")}},
+		{"AlreadyEncoded", client, &Request{Method: POST, Headers: Header{"content-encoding": {"br"}}, Body: large}},
+		{"Incompressible", client, &Request{Method: POST, Headers: Header{}, Body: random}},
+		{"Disabled", NewClient(), &Request{Method: POST, Headers: Header{}, Body: large}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, err := tt.client.compressRequest(tt.req)
+			require.NoError(t, err)
+			assert.Same(t, tt.req, sent)
+		})
+	}
+}
+
 func TestClientRedirectHandling(t *testing.T) {
 	t.Run("MaxRedirectsReached", func(t *testing.T) {
 		client := NewClient(WithMaxRedirects(3))
@@ -71,18 +114,18 @@ func TestClientRedirectHandling(t *testing.T) {
 			Host:    "example.com",
 			Path:    "/",
 			Version: Version,
-			Headers: map[string]string{},
+			Headers: Header{},
 		}
 
 		resp := &Response{
 			StatusCode: StatusMovedPermanently,
-			Headers: map[string]string{
-				"location": "http://example.com/redirect",
+			Headers: Header{
+				"location": {"http://example.com/redirect"},
 			},
 		}
 
 		// Simulate already having done 3 redirects
-		_, err := client.handleRedirect(req, resp, 3)
+		_, err := client.handleRedirect(context.Background(), req.URL(), req, resp, 3, nil)
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "too many redirects")
 	})
@@ -95,15 +138,15 @@ func TestClientRedirectHandling(t *testing.T) {
 			Host:    "example.com",
 			Path:    "/",
 			Version: Version,
-			Headers: map[string]string{},
+			Headers: Header{},
 		}
 
 		resp := &Response{
 			StatusCode: StatusMovedPermanently,
-			Headers:    map[string]string{}, // No location header
+			Headers:    Header{}, // No location header
 		}
 
-		_, err := client.handleRedirect(req, resp, 0)
+		_, err := client.handleRedirect(context.Background(), req.URL(), req, resp, 0, nil)
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "missing location")
 	})
@@ -116,22 +159,147 @@ func TestClientRedirectHandling(t *testing.T) {
 			Host:    "example.com",
 			Path:    "/",
 			Version: Version,
-			Headers: map[string]string{},
+			Headers: Header{},
 		}
 
 		resp := &Response{
 			StatusCode: StatusMovedPermanently,
-			Headers: map[string]string{
-				"location": "://invalid-url",
+			Headers: Header{
+				"location": {"://invalid-url"},
 			},
 		}
 
-		_, err := client.handleRedirect(req, resp, 0)
+		_, err := client.handleRedirect(context.Background(), req.URL(), req, resp, 0, nil)
 		require.Error(t, err)
 		assert.Contains(t, err.Error(), "invalid location")
 	})
 }
 
+func TestRedirectTarget(t *testing.T) {
+	cur := &URL{Host: "example.com", Port: 9000, Path: "/a/b", RawQuery: "x=1"}
+	tests := []struct {
+		name    string
+		headers Header
+		want    string
+		wantErr string
+	}{
+		{"Absolute", Header{"location": {"qh://other.com:9001/c?y=2"}}, "qh://other.com:9001/c?y=2", ""},
+		{"AbsoluteDefaultPort", Header{"location": {"qh://example.com/c"}}, "qh://example.com/c", ""},
+		{"AbsolutePath", Header{"location": {"/c?y=2"}}, "qh://example.com:9000/c?y=2", ""},
+		{"RelativePath", Header{"location": {"c"}}, "qh://example.com:9000/a/c", ""},
+		{"QueryOnly", Header{"location": {"?y=2"}}, "qh://example.com:9000/a/b?y=2", ""},
+		{"SchemeRelative", Header{"location": {"//other.com/c"}}, "qh://other.com/c", ""},
+		{"CustomHeaders", Header{"host": {"other.com"}, "path": {"/c?y=2"}}, "qh://other.com:9000/c?y=2", ""},
+		{"OtherScheme", Header{"location": {"http://example.com/c"}}, "", "scheme must be qh"},
+		{"Missing", Header{}, "", "missing location"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redirectTarget(cur, &Response{StatusCode: StatusFound, Headers: tt.headers})
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestClientFollowsRedirects(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	other, otherAddr := newTestServer(t)
+	defer other.Close()
+	_, otherPort, err := net.SplitHostPort(otherAddr)
+	require.NoError(t, err)
+
+	echo := func(req *Request) *Response {
+		return TextResponse(StatusOK, fmt.Sprintf("%s %s %q %q %q",
+			req.Method, req.Path, req.Body, req.Headers.Get("authorization"), req.Headers.Get("cookie")))
+	}
+	redirect := func(status int, location string) ResponseFunc {
+		return func(_ *Request) *Response {
+			return NewResponse(status, nil, map[string]string{"location": location})
+		}
+	}
+	srv.HandleFunc("/see-other", POST, redirect(StatusSeeOther, "/echo?from=303"))
+	srv.HandleFunc("/temporary", POST, redirect(StatusTemporaryRedirect, "echo"))
+	srv.HandleFunc("/found", HEAD, redirect(StatusFound, "/echo"))
+	srv.HandleFunc("/away", GET, redirect(StatusFound, "qh://127.0.0.1:"+otherPort+"/echo"))
+	srv.HandleFunc("/echo", GET, echo)
+	srv.HandleFunc("/echo", POST, echo)
+	srv.HandleFunc("/echo", HEAD, echo)
+	other.HandleFunc("/echo", GET, echo)
+
+	send := func(t *testing.T, client *Client, method Method, path string, body []byte) (*Response, error) {
+		t.Helper()
+		req, err := NewRequest(method, "qh://"+addr+path, body)
+		require.NoError(t, err)
+		req.Headers.Set("authorization", "Bearer secret")
+		req.Headers.Set("cookie", "session=1")
+		req.Headers.Set("content-type", "text/plain")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return client.DoContext(ctx, req)
+	}
+
+	client := NewClient()
+	defer client.Close()
+
+	t.Run("SeeOtherSwitchesToGet", func(t *testing.T) {
+		resp, err := send(t, client, POST, "/see-other", []byte("data"))
+		require.NoError(t, err)
+		assert.Equal(t, `GET /echo?from=303 "" "Bearer secret" "session=1"`, string(resp.Body))
+	})
+
+	t.Run("TemporaryRedirectKeepsBody", func(t *testing.T) {
+		resp, err := send(t, client, POST, "/temporary", []byte("data"))
+		require.NoError(t, err)
+		assert.Equal(t, `POST /echo "data" "Bearer secret" "session=1"`, string(resp.Body))
+	})
+
+	t.Run("FoundKeepsHead", func(t *testing.T) {
+		resp, err := send(t, client, HEAD, "/found", nil)
+		require.NoError(t, err)
+		assert.Equal(t, StatusOK, resp.StatusCode)
+	})
+
+	t.Run("CrossOriginDropsCredentials", func(t *testing.T) {
+		resp, err := send(t, client, GET, "/away", nil)
+		require.NoError(t, err)
+		assert.Equal(t, `GET /echo "" "" ""`, string(resp.Body))
+	})
+
+	t.Run("CheckRedirect", func(t *testing.T) {
+		var vias [][]*Request
+		client := NewClient(WithCheckRedirect(func(req *Request, via []*Request) error {
+			vias = append(vias, via)
+			if req.Port != 0 {
+				return ErrUseLastResponse
+			}
+			return nil
+		}))
+		defer client.Close()
+
+		resp, err := send(t, client, GET, "/away", nil)
+		require.NoError(t, err)
+		assert.Equal(t, StatusFound, resp.StatusCode)
+		require.Len(t, vias, 1)
+		require.Len(t, vias[0], 1)
+		assert.Equal(t, "/away", vias[0][0].Path)
+	})
+
+	t.Run("CheckRedirectError", func(t *testing.T) {
+		errStop := errors.New("stop")
+		client := NewClient(WithCheckRedirect(func(*Request, []*Request) error { return errStop }))
+		defer client.Close()
+
+		_, err := send(t, client, GET, "/away", nil)
+		require.ErrorIs(t, err, errStop)
+	})
+}
+
 func TestClientRequestNotConnected(t *testing.T) {
 	client := NewClient()
 
@@ -140,7 +308,7 @@ func TestClientRequestNotConnected(t *testing.T) {
 		Host:    "example.com",
 		Path:    "/",
 		Version: Version,
-		Headers: map[string]string{},
+		Headers: Header{},
 	}
 
 	_, err := client.Request(req, 0)
@@ -190,3 +358,107 @@ func TestClientKeyLogWriter(t *testing.T) {
 		// Should work fine without keylog writer
 	})
 }
+
+func TestClientConnectContextCancelled(t *testing.T) {
+	client := NewClient()
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.ConnectContext(ctx, "127.0.0.1:8090")
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, client.conns)
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err = client.ConnectContext(ctx, "127.0.0.1:8090")
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+	assert.Equal(t, "connect", timeoutErr.Op)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNewRequest(t *testing.T) {
+	tests := []struct {
+		target string
+		host   string
+		port   int
+		path   string
+	}{
+		{"qh://example.com", "example.com", DefaultPort, "/"},
+		{"qh://example.com:9000/api/users", "example.com", 9000, "/api/users"},
+		{"qh://127.0.0.1:8080/search?q=go&page=2", "127.0.0.1", 8080, "/search?q=go&page=2"},
+		{"qh://[::1]:8090/", "::1", 8090, "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req, err := NewRequest(POST, tt.target, []byte("body"))
+			require.NoError(t, err)
+			assert.Equal(t, POST, req.Method)
+			assert.Equal(t, tt.host, req.Host)
+			assert.Equal(t, tt.port, req.Port)
+			assert.Equal(t, tt.path, req.Path)
+			assert.Equal(t, []byte("body"), req.Body)
+			assert.NotNil(t, req.Headers)
+		})
+	}
+
+	for _, target := range []string{"http://example.com/", "qh:///path", "qh://example.com:0/", "qh://example.com:http/", "://x"} {
+		t.Run("invalid "+target, func(t *testing.T) {
+			_, err := NewRequest(GET, target, nil)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestClientServerPublicKey(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	key := srv.PublicKey()
+	keyFile := filepath.Join(t.TempDir(), "server.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(key+"\n"), 0o600))
+
+	// The resolver announces another key, which the configured key overrides.
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	target := net.JoinHostPort("qh.test", port)
+	dnsKey := newServerKey(t)
+	resolver := &StaticResolver{
+		Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+		TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(dnsKey)}},
+	}
+
+	tests := []struct {
+		name    string
+		opt     ClientOption
+		wantErr string
+	}{
+		{"Key", WithServerPublicKey("qh.test", key), ""},
+		{"KeyFile", WithServerKeyFile("QH.test", keyFile), ""},
+		{"InvalidKey", WithServerPublicKey("qh.test", "bm90IGEga2V5"), "invalid server key"},
+		{"MissingKeyFile", WithServerKeyFile("qh.test", filepath.Join(t.TempDir(), "missing")), "reading server key file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(WithResolver(resolver), tt.opt)
+			defer client.Close()
+
+			err := client.ConnectContext(context.Background(), target)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, key, defaultConn(t, client).key.pubKey, "connection must be dialed with the configured key (0-RTT)")
+		})
+	}
+
+	t.Run("OtherHost", func(t *testing.T) {
+		client := NewClient(WithResolver(resolver), WithServerPublicKey("other.test", key))
+		defer client.Close()
+
+		_, keys, _, err := client.resolveDNS(context.Background(), "qh.test")
+		require.NoError(t, err)
+		assert.Equal(t, []string{dnsKey}, keys, "the key of another host must not be used")
+	})
+}
@@ -3,18 +3,28 @@ package qh
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"slices"
 	"strings"
+	"sync"
 
 	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/zstd"
 )
 
-const (
-	defaultBrotliQuality = 4
-)
+// defaultCompressionLevels are the levels used by Compress and by servers
+// without WithCompressionLevel for the encoding.
+var defaultCompressionLevels = map[Encoding]int{
+	Gzip:   gzip.DefaultCompression,
+	Brotli: 4,
+	Zstd:   3, // zstd.SpeedDefault
+}
+
+// errDecompressedTooLarge is returned by Decompress if the data
+// decompresses to more than the size limit.
+var errDecompressedTooLarge = errors.New("decompressed size exceeds limit")
 
 // Encoding represents a compression encoding type used in Content-Encoding
 // and Accept-Encoding headers.
@@ -48,6 +58,16 @@ func parseAcceptEncoding(acceptEncoding string) []Encoding {
 	return encodings
 }
 
+// formatEncodings returns encodings as a comma-separated list, as in an
+// accept-encoding header.
+func formatEncodings(encodings []Encoding) string {
+	names := make([]string, len(encodings))
+	for i, enc := range encodings {
+		names[i] = string(enc)
+	}
+	return strings.Join(names, ", ")
+}
+
 func selectEncoding(acceptedEncodings []Encoding, serverSupported []Encoding) Encoding {
 	for _, clientEnc := range acceptedEncodings {
 		if slices.Contains(serverSupported, clientEnc) {
@@ -57,72 +77,167 @@ func selectEncoding(acceptedEncodings []Encoding, serverSupported []Encoding) En
 	return "" // No common encoding, don't compress
 }
 
+// Compress compresses data with encoding at its default level, see
+// WithCompressionLevel. Encoders are pooled and reused between calls.
 func Compress(data []byte, encoding Encoding) ([]byte, error) {
+	return compressLevel(data, encoding, defaultCompressionLevels[encoding])
+}
+
+// compressLevel compresses data with encoding at the given level.
+func compressLevel(data []byte, encoding Encoding, level int) ([]byte, error) {
 	if len(data) == 0 || encoding == "" {
 		return data, nil
 	}
 
 	switch encoding {
 	case Gzip:
-		var buf bytes.Buffer
-		w := gzip.NewWriter(&buf)
-		if _, err := w.Write(data); err != nil {
-			return nil, fmt.Errorf("gzip write error: %w", err)
-		}
-		if err := w.Close(); err != nil {
-			return nil, fmt.Errorf("gzip close error: %w", err)
-		}
-		return buf.Bytes(), nil
-
+		return compressGzip(data, level)
 	case Brotli:
-		var buf bytes.Buffer
-		w := brotli.NewWriterLevel(&buf, defaultBrotliQuality)
-		if _, err := w.Write(data); err != nil {
-			return nil, fmt.Errorf("brotli write error: %w", err)
-		}
-		if err := w.Close(); err != nil {
-			return nil, fmt.Errorf("brotli close error: %w", err)
+		return compressBrotli(data, level)
+	case Zstd:
+		return compressZstd(data, level)
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+	}
+}
+
+func compressGzip(data []byte, level int) ([]byte, error) {
+	pool := encoderPool(Gzip, level)
+	var buf bytes.Buffer
+	w, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		if w, err = gzip.NewWriterLevel(&buf, level); err != nil {
+			return nil, fmt.Errorf("gzip writer error: %w", err)
 		}
-		return buf.Bytes(), nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("gzip write error: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("gzip close error: %w", err)
+	}
+	w.Reset(io.Discard) // don't keep buf alive in the pool
+	pool.Put(w)
+	return buf.Bytes(), nil
+}
 
-	case Zstd:
-		encoder, err := zstd.NewWriter(nil)
+func compressBrotli(data []byte, level int) ([]byte, error) {
+	pool := encoderPool(Brotli, level)
+	var buf bytes.Buffer
+	w, ok := pool.Get().(*brotli.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = brotli.NewWriterLevel(&buf, level)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("brotli write error: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("brotli close error: %w", err)
+	}
+	w.Reset(io.Discard)
+	pool.Put(w)
+	return buf.Bytes(), nil
+}
+
+func compressZstd(data []byte, level int) ([]byte, error) {
+	speed := zstd.EncoderLevelFromZstd(level)
+	pool := encoderPool(Zstd, int(speed))
+	encoder, ok := pool.Get().(*zstd.Encoder)
+	if !ok {
+		var err error
+		encoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(speed), zstd.WithEncoderConcurrency(1))
 		if err != nil {
 			return nil, fmt.Errorf("zstd encoder error: %w", err)
 		}
-		defer encoder.Close()
-		compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)))
-		return compressed, nil
+	}
+	compressed := encoder.EncodeAll(data, make([]byte, 0, len(data)))
+	pool.Put(encoder)
+	return compressed, nil
+}
 
-	default:
-		return nil, fmt.Errorf("unsupported encoding: %s", encoding)
+// encoderKey identifies a pool of encoders. For Zstd, level is the speed of
+// the encoder.
+type encoderKey struct {
+	encoding Encoding
+	level    int
+}
+
+// encoderPools holds a *sync.Pool of encoders for each encoding and level.
+var encoderPools sync.Map
+
+func encoderPool(encoding Encoding, level int) *sync.Pool {
+	key := encoderKey{encoding, level}
+	if pool, ok := encoderPools.Load(key); ok {
+		return pool.(*sync.Pool)
 	}
+	pool, _ := encoderPools.LoadOrStore(key, &sync.Pool{})
+	return pool.(*sync.Pool)
 }
 
+// Pools of decoders. Decoders are reset to the next input before use.
+var (
+	gzipReaders   sync.Pool // *gzip.Reader
+	brotliReaders sync.Pool // *brotli.Reader
+	zstdDecoders  sync.Pool // *zstd.Decoder, decoding synchronously
+)
+
+// Decompress decompresses data compressed with encoding. It fails if the
+// result would be larger than maxSize, without decompressing more than that.
+// Decoders are pooled and reused between calls.
 func Decompress(data []byte, encoding Encoding, maxSize int) ([]byte, error) {
 	if len(data) == 0 || encoding == "" {
 		return data, nil
 	}
 
+	src := bytes.NewReader(data)
 	var r io.Reader
 	switch encoding {
 	case Gzip:
-		gz, err := gzip.NewReader(bytes.NewReader(data))
+		gz, ok := gzipReaders.Get().(*gzip.Reader)
+		var err error
+		if ok {
+			err = gz.Reset(src)
+		} else {
+			gz, err = gzip.NewReader(src)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("gzip reader error: %w", err)
 		}
-		defer gz.Close()
+		defer gzipReaders.Put(gz)
 		r = gz
 
 	case Brotli:
-		r = brotli.NewReader(bytes.NewReader(data))
+		br, ok := brotliReaders.Get().(*brotli.Reader)
+		if ok {
+			if err := br.Reset(src); err != nil {
+				return nil, fmt.Errorf("brotli reader error: %w", err)
+			}
+		} else {
+			br = brotli.NewReader(src)
+		}
+		defer brotliReaders.Put(br)
+		r = br
 
 	case Zstd:
-		zs, err := zstd.NewReader(bytes.NewReader(data))
+		zs, ok := zstdDecoders.Get().(*zstd.Decoder)
+		var err error
+		if ok {
+			err = zs.Reset(src)
+		} else {
+			zs, err = zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+		}
 		if err != nil {
 			return nil, fmt.Errorf("zstd decoder error: %w", err)
 		}
-		defer zs.Close()
+		defer func() {
+			_ = zs.Reset(nil) // release src
+			zstdDecoders.Put(zs)
+		}()
 		r = zs
 
 	default:
@@ -136,8 +251,79 @@ func Decompress(data []byte, encoding Encoding, maxSize int) ([]byte, error) {
 	}
 
 	if len(decompressed) > maxSize {
-		return nil, fmt.Errorf("decompressed size exceeds limit of %d bytes", maxSize)
+		return nil, fmt.Errorf("%w of %d bytes", errDecompressedTooLarge, maxSize)
 	}
 
 	return decompressed, nil
 }
+
+// decompressReader decompresses a streamed body as it is read. The decoder
+// is created on the first Read, since creating it already reads from the
+// body. Reading fails with ErrRequestBodyTooLarge once the decompressed body
+// exceeds limit bytes.
+type decompressReader struct {
+	body     io.ReadCloser
+	encoding Encoding
+	limit    int64
+	n        int64
+	r        io.Reader
+	zstd     *zstd.Decoder // closed with the reader
+	err      error
+}
+
+func newDecompressReader(body io.ReadCloser, encoding Encoding, limit int64) *decompressReader {
+	return &decompressReader{body: body, encoding: encoding, limit: limit}
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if d.r == nil {
+		if d.err = d.open(); d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	if d.n > d.limit {
+		n -= int(d.n - d.limit)
+		err = ErrRequestBodyTooLarge
+	}
+	if err != nil {
+		d.err = err
+	}
+	return n, err
+}
+
+func (d *decompressReader) open() error {
+	switch d.encoding {
+	case Gzip:
+		gz, err := gzip.NewReader(d.body)
+		if err != nil {
+			return fmt.Errorf("gzip reader error: %w", err)
+		}
+		d.r = gz
+	case Brotli:
+		d.r = brotli.NewReader(d.body)
+	case Zstd:
+		zs, err := zstd.NewReader(d.body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return fmt.Errorf("zstd decoder error: %w", err)
+		}
+		d.zstd = zs
+		d.r = zs
+	default:
+		return fmt.Errorf("unsupported encoding: %s", d.encoding)
+	}
+	return nil
+}
+
+// Close releases the decoder and closes the body.
+func (d *decompressReader) Close() error {
+	if d.zstd != nil {
+		d.zstd.Close()
+	}
+	return d.body.Close()
+}
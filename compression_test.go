@@ -1,7 +1,9 @@
 package qh
 
 import (
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -199,7 +201,7 @@ func BenchmarkCompressions(b *testing.B) {
 
 	for _, encoding := range encodings {
 		b.Run(string(encoding), func(b *testing.B) {
-			b.ResetTimer()
+			b.ReportAllocs()
 			for b.Loop() {
 				_, _ = Compress(testData, encoding)
 			}
@@ -207,6 +209,22 @@ func BenchmarkCompressions(b *testing.B) {
 	}
 }
 
+func BenchmarkDecompressions(b *testing.B) {
+	testData := []byte(strings.Repeat("Hello, QH Protocol! This is benchmark data. ", 1000))
+	encodings := []Encoding{Gzip, Brotli, Zstd}
+
+	for _, encoding := range encodings {
+		compressed, err := Compress(testData, encoding)
+		require.NoError(b, err)
+		b.Run(string(encoding), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				_, _ = Decompress(compressed, encoding, len(testData))
+			}
+		})
+	}
+}
+
 func TestCompressionBomb(t *testing.T) {
 	t.Run("ZstdBomb", func(t *testing.T) {
 		uncompressed := make([]byte, 1024*1024)
@@ -265,3 +283,70 @@ func TestCorruptedCompressedData(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressLevels(t *testing.T) {
+	testData := []byte(strings.Repeat("Hello, QH Protocol! Levels trade speed for size. ", 200))
+	levels := map[Encoding][]int{
+		Gzip:   {1, 6, 9},
+		Brotli: {0, 4, 11},
+		Zstd:   {1, 3, 7, 22},
+	}
+
+	for encoding, levels := range levels {
+		for _, level := range levels {
+			t.Run(fmt.Sprintf("%s-%d", encoding, level), func(t *testing.T) {
+				compressed, err := compressLevel(testData, encoding, level)
+				require.NoError(t, err)
+				decompressed, err := Decompress(compressed, encoding, len(testData))
+				require.NoError(t, err)
+				assert.Equal(t, testData, decompressed)
+			})
+		}
+	}
+
+	_, err := compressLevel(testData, Gzip, 42)
+	require.Error(t, err, "invalid gzip level")
+}
+
+func TestCompressionPoolsConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Go(func() {
+			for _, encoding := range []Encoding{Gzip, Brotli, Zstd} {
+				data := []byte(strings.Repeat(fmt.Sprintf("worker %d ", i), 500))
+				compressed, err := Compress(data, encoding)
+				if !assert.NoError(t, err) {
+					return
+				}
+				decompressed, err := Decompress(compressed, encoding, len(data))
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, data, decompressed)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestDecoderReusedAfterError(t *testing.T) {
+	testData := []byte(strings.Repeat("reuse ", 1000))
+	for _, encoding := range []Encoding{Gzip, Brotli, Zstd} {
+		t.Run(string(encoding), func(t *testing.T) {
+			compressed, err := Compress(testData, encoding)
+			require.NoError(t, err)
+
+			// A failed or truncated decode must not break the pooled decoder.
+			_, err = Decompress(compressed, encoding, 10)
+			require.Error(t, err)
+			_, err = Decompress(compressed[:len(compressed)/2], encoding, len(testData))
+			require.Error(t, err)
+
+			for range 3 {
+				decompressed, err := Decompress(compressed, encoding, len(testData))
+				require.NoError(t, err)
+				assert.Equal(t, testData, decompressed)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package qh
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CookieJar stores cookies between requests of a Client, see WithCookieJar.
+// It has the methods of http.CookieJar, so a jar from net/http/cookiejar can
+// be used.
+//
+// The jar is passed the URL of each request with the scheme "https" instead
+// of "qh". QH connections are always encrypted, so cookies marked secure are
+// stored and sent, and jars written for HTTP apply their usual host, path and
+// expiry rules.
+type CookieJar interface {
+	SetCookies(u *url.URL, cookies []*http.Cookie)
+	Cookies(u *url.URL) []*http.Cookie
+}
+
+// WithCookieJar makes the client store the cookies set by responses in jar
+// and send the matching ones with each request, including the requests made
+// to follow redirects.
+func WithCookieJar(jar CookieJar) ClientOption {
+	return func(c *Client) {
+		c.jar = jar
+	}
+}
+
+// jarURL returns u as the URL passed to a CookieJar.
+func jarURL(u *URL) *url.URL {
+	jarURL, err := url.Parse("https://" + u.Addr() + u.RequestURI())
+	if err != nil {
+		return &url.URL{Scheme: "https", Host: u.Addr(), Path: "/"}
+	}
+	return jarURL
+}
+
+// addCookies returns req with the cookies of the jar for u added to its
+// cookie header. req itself is left unchanged, so the cookies are looked up
+// again when a redirect is followed.
+func (c *Client) addCookies(req *Request, u *URL) *Request {
+	if c.jar == nil {
+		return req
+	}
+	cookies := c.jar.Cookies(jarURL(u))
+	if len(cookies) == 0 {
+		return req
+	}
+
+	pairs := make([]string, 0, len(cookies)+1)
+	if existing := req.Headers.Get("cookie"); existing != "" {
+		pairs = append(pairs, existing)
+	}
+	for _, cookie := range cookies {
+		pairs = append(pairs, cookie.String())
+	}
+	withCookies := *req
+	withCookies.Headers = req.Headers.Clone()
+	withCookies.Headers.Set("cookie", strings.Join(pairs, "; "))
+	return &withCookies
+}
+
+// saveCookies stores the cookies set by resp to the request for u in the
+// jar. Malformed set-cookie headers are skipped.
+func (c *Client) saveCookies(u *URL, resp *Response) {
+	if c.jar == nil {
+		return
+	}
+	var cookies []*http.Cookie
+	for _, line := range resp.Headers.Values("set-cookie") {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil {
+			slog.Debug("Ignoring invalid set-cookie header", "value", line, "error", err)
+			continue
+		}
+		cookies = append(cookies, cookie)
+	}
+	if len(cookies) > 0 {
+		c.jar.SetCookies(jarURL(u), cookies)
+	}
+}
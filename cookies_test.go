@@ -0,0 +1,82 @@
+package qh
+
+import (
+	"context"
+	"net/http/cookiejar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJarURL(t *testing.T) {
+	u := &URL{Host: "::1", Port: 9000, Path: "/a%20b", RawQuery: "x=1"}
+	assert.Equal(t, "https://[::1]:9000/a%20b?x=1", jarURL(u).String())
+	assert.Equal(t, "/a b", jarURL(u).Path)
+}
+
+func TestCookieJar(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	srv.HandleFunc("/login", GET, func(_ *Request) *Response {
+		resp := TextResponse(StatusOK, "welcome")
+		resp.Headers.Add("set-cookie", "session=abc; Path=/; HttpOnly; Secure")
+		resp.Headers.Add("set-cookie", "pref=dark; Path=/app")
+		resp.Headers.Add("set-cookie", "not a cookie")
+		return resp
+	})
+	srv.HandleFunc("/logout", GET, func(_ *Request) *Response {
+		resp := TextResponse(StatusFound, "")
+		resp.Headers.Set("location", "/whoami")
+		resp.Headers.Add("set-cookie", "session=; Path=/; Max-Age=0")
+		return resp
+	})
+	srv.HandleFunc("/redirect-login", GET, func(_ *Request) *Response {
+		resp := TextResponse(StatusFound, "")
+		resp.Headers.Set("location", "/whoami")
+		resp.Headers.Add("set-cookie", "session=xyz; Path=/")
+		return resp
+	})
+	whoami := func(req *Request) *Response {
+		return TextResponse(StatusOK, req.Headers.Get("cookie"))
+	}
+	srv.HandleFunc("/whoami", GET, whoami)
+	srv.HandleFunc("/app/whoami", GET, whoami)
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := NewClient(WithCookieJar(jar))
+	defer client.Close()
+
+	get := func(t *testing.T, path string, headers map[string]string) string {
+		t.Helper()
+		req, err := NewRequest(GET, "qh://"+addr+path, nil)
+		require.NoError(t, err)
+		for name, value := range headers {
+			req.Headers.Set(name, value)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, err := client.DoContext(ctx, req)
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, resp.StatusCode)
+		return string(resp.Body)
+	}
+
+	get(t, "/login", nil)
+
+	t.Run("MatchesPath", func(t *testing.T) {
+		assert.Equal(t, "session=abc", get(t, "/whoami", nil))
+		assert.Equal(t, "pref=dark; session=abc", get(t, "/app/whoami", nil))
+	})
+
+	t.Run("KeepsRequestCookies", func(t *testing.T) {
+		assert.Equal(t, "lang=en; session=abc", get(t, "/whoami", map[string]string{"cookie": "lang=en"}))
+	})
+
+	t.Run("AcrossRedirects", func(t *testing.T) {
+		assert.Equal(t, "session=xyz", get(t, "/redirect-login", nil))
+		assert.Empty(t, get(t, "/logout", nil))
+	})
+}
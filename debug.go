@@ -35,8 +35,11 @@ func DebugRequest(data []byte) string {
 		firstByte := data[offset]
 		version := firstByte >> versionBitShift
 		method := Method((firstByte >> methodBitShift) & methodMask)
-		writeTableRow(&sb, offset, data[offset:offset+1],
-			fmt.Sprintf("First byte (Version=%d, Method=%s)", version, method.String()))
+		description := fmt.Sprintf("First byte (Version=%d, Method=%s)", version, method.String())
+		if isChunkedRequest(firstByte) {
+			description = fmt.Sprintf("First byte (Version=%d, Method=%s, Chunked)", version, method.String())
+		}
+		writeTableRow(&sb, offset, data[offset:offset+1], description)
 		offset++
 	}
 
@@ -55,7 +58,7 @@ func DebugRequest(data []byte) string {
 	offset = headersEndOffset
 
 	sb.WriteString("\n") // Blank line before body
-	annotateVarint(&sb, data, &offset, "Body length")
+	annotateBody(&sb, data, &offset, isChunkedRequest(data[0]))
 
 	sb.WriteString("\n")
 	fmt.Fprintf(&sb, "Summary: parsed %d / %d bytes\n", offset, len(data))
@@ -81,20 +84,31 @@ func DebugResponse(data []byte) string {
 		firstByte := data[offset]
 		version := firstByte >> versionBitShift
 		statusCompact := firstByte & statusCodeMask
-		statusDecoded := DecodeStatusCode(statusCompact)
-		writeTableRow(&sb, offset, data[offset:offset+1],
-			fmt.Sprintf("First byte (Version=%d, Status=%d)", version, statusDecoded))
-		offset++
+		if statusCompact == CompactStatusEscape {
+			writeTableRow(&sb, offset, data[offset:offset+1],
+				fmt.Sprintf("First byte (Version=%d, Status=escaped)", version))
+			offset++
+			annotateVarint(&sb, data, &offset, "Status code")
+		} else {
+			statusDecoded := DecodeStatusCode(statusCompact)
+			writeTableRow(&sb, offset, data[offset:offset+1],
+				fmt.Sprintf("First byte (Version=%d, Status=%d)", version, statusDecoded))
+			offset++
+		}
 	}
 
 	headersLen := annotateVarint(&sb, data, &offset, "Headers length")
 	sb.WriteString("\n") // Blank line before headers section
 	headersEndOffset := min(offset+int(headersLen), len(data))
+	headersStart := offset
 	annotateHeaders(&sb, data, &offset, headersEndOffset, false)
 	offset = headersEndOffset
 
+	headers, _, err := parseHeaders(data, headersStart, uint64(headersEndOffset-headersStart), ResponseHeaderStaticTable, false)
+	chunked := err == nil && isChunkedResponse(headers)
+
 	sb.WriteString("\n") // Blank line before body
-	annotateVarint(&sb, data, &offset, "Body length")
+	annotateBody(&sb, data, &offset, chunked)
 
 	sb.WriteString("\n")
 	fmt.Fprintf(&sb, "Summary: parsed %d / %d bytes\n", offset, len(data))
@@ -180,6 +194,24 @@ func annotateVarint(sb *strings.Builder, data []byte, offset *int, label string)
 	return value
 }
 
+// annotateBody annotates the body length, or each chunk length of a chunked
+// body up to and including the terminating empty chunk.
+func annotateBody(sb *strings.Builder, data []byte, offset *int, chunked bool) {
+	if !chunked {
+		annotateVarint(sb, data, offset, "Body length")
+		return
+	}
+
+	for *offset < len(data) {
+		chunkLen := annotateVarint(sb, data, offset, "Chunk length")
+		if chunkLen == 0 {
+			return
+		}
+		chunkLen = min(chunkLen, uint64(len(data)-*offset))
+		*offset += int(chunkLen)
+	}
+}
+
 func annotateString(sb *strings.Builder, data []byte, offset *int, length int, label string) {
 	if *offset+length > len(data) {
 		return
@@ -158,11 +158,11 @@ func logResponse(method, path string, response *qh.Response) {
 	sb.WriteString(fmt.Sprintf("Version:    %d\n", response.Version))
 	sb.WriteString(fmt.Sprintf("StatusCode: %d\n", response.StatusCode))
 
-	if contentTypeStr, ok := response.Headers["content-type"]; ok && contentTypeStr != "" {
+	if contentTypeStr := response.Headers.Get("content-type"); contentTypeStr != "" {
 		sb.WriteString(fmt.Sprintf("Content:    %s\n", contentTypeStr))
 	}
 
-	if dateStr, ok := response.Headers["Date"]; ok && dateStr != "" {
+	if dateStr := response.Headers.Get("date"); dateStr != "" {
 		unixTime, err := strconv.ParseInt(dateStr, 10, 64)
 		if err == nil {
 			formattedDate := time.Unix(unixTime, 0).Format("02.01.2006 15:04")
@@ -172,7 +172,7 @@ func logResponse(method, path string, response *qh.Response) {
 
 	// Special handling for redirect response logging
 	if response.StatusCode >= 300 && response.StatusCode < 400 {
-		if location, ok := response.Headers["Location"]; ok {
+		if location := response.Headers.Get("location"); location != "" {
 			sb.WriteString(fmt.Sprintf("Location:   %s\n", location))
 		}
 	}
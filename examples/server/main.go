@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -22,6 +23,7 @@ func main() {
 	var serverOpts []qh.ServerOption
 
 	srv := qh.NewServer(serverOpts...)
+	srv.Use(qh.Recovery(), qh.RequestID(), qh.AccessLog(nil))
 
 	srv.HandleFunc("/hello", qh.GET, func(_ *qh.Request) *qh.Response {
 		slog.Info("Handling request", "method", "GET", "path", "/hello")
@@ -159,6 +161,24 @@ func main() {
 		return qh.NewResponse(204, nil, nil)
 	})
 
+	srv.Handle("/countdown", qh.GET, qh.HandlerFunc(func(ctx context.Context, w qh.ResponseWriter, _ *qh.Request) {
+		slog.Info("Handling request", "method", "GET", "path", "/countdown")
+		w.Header().Set("Content-Type", "text/plain")
+		for i := 3; i > 0; i-- {
+			fmt.Fprintf(w, "%d...\n", i)
+			// Flush sends each line right away instead of buffering the whole body.
+			if err := w.Flush(); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done(): // client went away or server is shutting down
+				return
+			case <-time.After(time.Second):
+			}
+		}
+		fmt.Fprint(w, "Liftoff!\n")
+	}))
+
 	// listening with auto-generated keys
 	addr := "127.0.0.1:8090"
 
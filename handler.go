@@ -0,0 +1,276 @@
+package qh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/qo-proto/qotp"
+)
+
+// Handler responds to a QH request.
+//
+// ServeQH sets the status and headers and writes the body through w. The
+// context is cancelled when the peer closes the stream, when writing the
+// response fails, or when the server is closed. Handlers run on the server's
+// worker pool, and w must not be used after ServeQH returns.
+type Handler interface {
+	ServeQH(ctx context.Context, w ResponseWriter, r *Request)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, w ResponseWriter, r *Request)
+
+// ServeQH calls f(ctx, w, r).
+func (f HandlerFunc) ServeQH(ctx context.Context, w ResponseWriter, r *Request) {
+	f(ctx, w, r)
+}
+
+// ResponseFunc is a function that handles a request by returning a complete
+// response. It is the handler form accepted by Server.HandleFunc.
+type ResponseFunc func(*Request) *Response
+
+// ServeQH writes the response returned by f(r) to w. A streamed request
+// body is read into r.Body first, so f sees every request complete; if it
+// is larger than the server's WithMaxRequestSize, f is not called and the
+// response is 413 Payload Too Large. A response with a BodyReader is
+// streamed and the reader is closed afterwards.
+func (f ResponseFunc) ServeQH(_ context.Context, w ResponseWriter, r *Request) {
+	resp := readStreamedBody(r)
+	if resp == nil {
+		resp = f(r)
+	}
+	if resp == nil {
+		slog.Error("Handler returned nil response", "path", r.Path, "method", r.Method.String())
+		resp = TextResponse(StatusInternalServerError, "Internal Server Error")
+	}
+
+	header := w.Header()
+	for name, values := range resp.Headers {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if resp.BodyReader == nil {
+		if _, err := w.Write(resp.Body); err != nil {
+			slog.Error("Failed to write response body", "error", err)
+		}
+		return
+	}
+
+	defer resp.BodyReader.Close()
+	if err := w.Flush(); err != nil {
+		slog.Error("Failed to write response head", "error", err)
+		return
+	}
+	if _, err := io.Copy(w, resp.BodyReader); err != nil {
+		slog.Error("Failed to stream response body", "error", err)
+	}
+}
+
+// readStreamedBody reads the body of a streamed request into r.Body, up to
+// r.maxBodySize bytes. It returns an error response if the body cannot be
+// read in full, or nil otherwise.
+func readStreamedBody(r *Request) *Response {
+	if r.maxBodySize == 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.BodyReader, int64(r.maxBodySize)+1))
+	switch {
+	case errors.Is(err, ErrRequestBodyTooLarge) || len(body) > r.maxBodySize:
+		slog.Error("Streamed request body exceeds limit", "path", r.Path, "limit", r.maxBodySize)
+		return TextResponse(StatusPayloadTooLarge, "Payload Too Large")
+	case err != nil:
+		slog.Error("Failed to read request body", "path", r.Path, "error", err)
+		return TextResponse(StatusBadRequest, "Bad Request")
+	}
+	r.Body = body
+	r.BodyReader = bytes.NewReader(body)
+	r.maxBodySize = 0
+	return nil
+}
+
+// ResponseWriter is used by a Handler to build the response.
+//
+// Written body data is buffered and sent together with the head when the
+// handler returns, so that the response can be compressed. Calling Flush
+// sends the head and the buffered data right away and switches to a chunked
+// body; every later Write is then sent as its own chunk and the response is
+// not compressed.
+type ResponseWriter interface {
+	// Header returns the response headers. Changes made after the first
+	// Flush have no effect.
+	Header() Header
+
+	// WriteHeader sets the status code. Only the first call has an effect.
+	// If it is not called, the status defaults to 200.
+	WriteHeader(statusCode int)
+
+	// Write adds data to the response body.
+	Write(data []byte) (int, error)
+
+	// Flush sends the head and any buffered body data to the client.
+	Flush() error
+}
+
+var (
+	errResponseFinished = errors.New("response already finished")
+	errResponseAborted  = errors.New("response aborted")
+)
+
+// responseWriter is the ResponseWriter handed to handlers by the server.
+type responseWriter struct {
+	server    *Server
+	stream    *qotp.Stream
+	req       *Request
+	cancel    context.CancelFunc // cancels the handler context when writing fails
+	status    int
+	headers   Header
+	buf       []byte
+	streaming bool // the head has been sent and the body is being sent in chunks
+	finished  bool
+	err       error // first write error; the stream is unusable afterwards
+}
+
+func newResponseWriter(s *Server, stream *qotp.Stream, req *Request, cancel context.CancelFunc) *responseWriter {
+	return &responseWriter{
+		server:  s,
+		stream:  stream,
+		req:     req,
+		cancel:  cancel,
+		headers: make(Header),
+	}
+}
+
+func (w *responseWriter) Header() Header {
+	return w.headers
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	if w.status != 0 {
+		slog.Debug("Ignoring superfluous WriteHeader", "status", statusCode, "current", w.status)
+		return
+	}
+	w.status = statusCode
+}
+
+func (w *responseWriter) Write(data []byte) (int, error) {
+	if w.finished {
+		return 0, errResponseFinished
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+
+	if !w.streaming {
+		w.buf = append(w.buf, data...)
+		return len(data), nil
+	}
+
+	if len(data) == 0 {
+		return 0, nil // an empty chunk would end the body
+	}
+	if err := w.write(appendChunk(nil, data)); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *responseWriter) Flush() error {
+	if w.finished {
+		return errResponseFinished
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+
+	if w.streaming {
+		return nil // chunks are written as they come
+	}
+	w.streaming = true
+
+	w.headers.Set("transfer-encoding", transferEncodingChunked)
+	head := w.response(nil).appendHead(nil)
+	if len(w.buf) > 0 {
+		head = appendChunk(head, w.buf)
+		w.buf = nil
+	}
+	return w.write(head)
+}
+
+// finish completes the response after the handler has returned.
+func (w *responseWriter) finish() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	if w.err != nil {
+		return
+	}
+
+	if w.streaming {
+		if err := w.write(appendChunk(nil, nil)); err == nil {
+			slog.Debug("Streamed response sent")
+		}
+		return
+	}
+
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	resp := w.response(w.buf)
+	w.server.applyCompression(w.req, resp)
+
+	respData := resp.Format()
+	slog.Debug("Sending response", "bytes", len(respData))
+	if err := w.write(respData); err == nil {
+		slog.Debug("Response sent, stream kept open for reuse")
+	}
+}
+
+// discard drops the response built so far, see discarder. A response whose
+// head has already been sent is ended by closing the stream without the
+// terminating chunk.
+func (w *responseWriter) discard() bool {
+	if !w.streaming {
+		w.status = 0
+		clear(w.headers)
+		w.buf = nil
+		return true
+	}
+	if w.err == nil {
+		w.err = errResponseAborted
+		w.stream.Close()
+	}
+	return false
+}
+
+func (w *responseWriter) response(body []byte) *Response {
+	return &Response{
+		Version:    Version,
+		StatusCode: w.status,
+		Headers:    w.headers,
+		Body:       body,
+	}
+}
+
+func (w *responseWriter) write(data []byte) error {
+	if err := writeAll(w.stream, data); err != nil {
+		slog.Error("Failed to write response", "error", err)
+		w.err = fmt.Errorf("writing response: %w", err)
+		w.cancel()
+		return w.err
+	}
+	return nil
+}
@@ -23,8 +23,8 @@ func TestHeaderEncodingFormat1(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			headers := map[string]string{
-				tt.key: tt.value,
+			headers := Header{
+				tt.key: {tt.value},
 			}
 
 			encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
@@ -55,8 +55,8 @@ func TestHeaderEncodingFormat2(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			headers := map[string]string{
-				tt.key: tt.value,
+			headers := Header{
+				tt.key: {tt.value},
 			}
 
 			encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
@@ -91,8 +91,8 @@ func TestHeaderEncodingFormat3(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			headers := map[string]string{
-				tt.key: tt.value,
+			headers := Header{
+				tt.key: {tt.value},
 			}
 
 			encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
@@ -123,20 +123,20 @@ func TestHeaderEncodingFormat3(t *testing.T) {
 func TestHeaderCaseInsensitivity(t *testing.T) {
 	tests := []struct {
 		name  string
-		input map[string]string
+		input Header
 	}{
 		{
 			"MixedCase",
-			map[string]string{
-				"Content-Type": "application/json",
-				"Accept":       "text/html",
+			Header{
+				"Content-Type": {"application/json"},
+				"Accept":       {"text/html"},
 			},
 		},
 		{
 			"UpperCase",
-			map[string]string{
-				"CONTENT-TYPE": "text/plain",
-				"USER-AGENT":   "Test/1.0",
+			Header{
+				"CONTENT-TYPE": {"text/plain"},
+				"USER-AGENT":   {"Test/1.0"},
 			},
 		},
 	}
@@ -162,12 +162,12 @@ func TestHeaderCaseInsensitivity(t *testing.T) {
 }
 
 func TestHeaderEncodingIntegration(t *testing.T) {
-	headers := map[string]string{
-		"content-type":  "application/json; charset=UTF-8", // Format 1
-		"accept":        "text/html",                       // Format 2
-		"x-custom":      "value",                           // Format 3
-		"user-agent":    "QH/1.0",                          // Format 2
-		"cache-control": "no-cache",                        // Format 1
+	headers := Header{
+		"content-type":  {"application/json; charset=UTF-8"}, // Format 1
+		"accept":        {"text/html"},                       // Format 2
+		"x-custom":      {"value"},                           // Format 3
+		"user-agent":    {"QH/1.0"},                          // Format 2
+		"cache-control": {"no-cache"},                        // Format 1
 	}
 
 	req := &Request{
@@ -182,16 +182,16 @@ func TestHeaderEncodingIntegration(t *testing.T) {
 	parsed, err := ParseRequest(data)
 	require.NoError(t, err)
 
-	assert.Equal(t, "application/json; charset=UTF-8", parsed.Headers["content-type"])
-	assert.Equal(t, "text/html", parsed.Headers["accept"])
-	assert.Equal(t, "value", parsed.Headers["x-custom"])
-	assert.Equal(t, "QH/1.0", parsed.Headers["user-agent"])
-	assert.Equal(t, "no-cache", parsed.Headers["cache-control"])
+	assert.Equal(t, "application/json; charset=UTF-8", parsed.Headers.Get("content-type"))
+	assert.Equal(t, "text/html", parsed.Headers.Get("accept"))
+	assert.Equal(t, "value", parsed.Headers.Get("x-custom"))
+	assert.Equal(t, "QH/1.0", parsed.Headers.Get("user-agent"))
+	assert.Equal(t, "no-cache", parsed.Headers.Get("cache-control"))
 }
 
 func TestEmptyHeaderValue(t *testing.T) {
-	headers := map[string]string{
-		"x-empty": "",
+	headers := Header{
+		"x-empty": {""},
 	}
 
 	req := &Request{
@@ -206,14 +206,14 @@ func TestEmptyHeaderValue(t *testing.T) {
 	parsed, err := ParseRequest(data)
 	require.NoError(t, err)
 
-	assert.Empty(t, parsed.Headers["x-empty"])
+	assert.Empty(t, parsed.Headers.Get("x-empty"))
 }
 
 func TestHeaderValuesAreBinarySafe(t *testing.T) {
-	headers := map[string]string{
-		"x-test": "value with spaces",
-		"x-json": `{"key":"value"}`,
-		"x-url":  "https://example.com/path?query=1",
+	headers := Header{
+		"x-test": {"value with spaces"},
+		"x-json": {`{"key":"value"}`},
+		"x-url":  {"https://example.com/path?query=1"},
 	}
 
 	req := &Request{
@@ -228,16 +228,16 @@ func TestHeaderValuesAreBinarySafe(t *testing.T) {
 	parsed, err := ParseRequest(data)
 	require.NoError(t, err)
 
-	assert.Equal(t, headers["x-test"], parsed.Headers["x-test"])
-	assert.Equal(t, headers["x-json"], parsed.Headers["x-json"])
-	assert.Equal(t, headers["x-url"], parsed.Headers["x-url"])
+	assert.Equal(t, headers.Get("x-test"), parsed.Headers.Get("x-test"))
+	assert.Equal(t, headers.Get("x-json"), parsed.Headers.Get("x-json"))
+	assert.Equal(t, headers.Get("x-url"), parsed.Headers.Get("x-url"))
 }
 
 func TestResponseHeaderIntegration(t *testing.T) {
-	headers := map[string]string{
-		"content-type":  "application/json",
-		"cache-control": "max-age=3600",
-		"etag":          `"abc123"`,
+	headers := Header{
+		"content-type":  {"application/json"},
+		"cache-control": {"max-age=3600"},
+		"etag":          {`"abc123"`},
 	}
 
 	resp := &Response{
@@ -251,15 +251,15 @@ func TestResponseHeaderIntegration(t *testing.T) {
 	parsed, err := ParseResponse(data)
 	require.NoError(t, err)
 
-	assert.Equal(t, "application/json", parsed.Headers["content-type"])
-	assert.Equal(t, "max-age=3600", parsed.Headers["cache-control"])
-	assert.Equal(t, `"abc123"`, parsed.Headers["etag"])
+	assert.Equal(t, "application/json", parsed.Headers.Get("content-type"))
+	assert.Equal(t, "max-age=3600", parsed.Headers.Get("cache-control"))
+	assert.Equal(t, `"abc123"`, parsed.Headers.Get("etag"))
 }
 
 func TestResponseHeaderEncoding(t *testing.T) {
 	t.Run("Format1_CompletePair", func(t *testing.T) {
-		headers := map[string]string{
-			"content-encoding": "gzip",
+		headers := Header{
+			"content-encoding": {"gzip"},
 		}
 
 		encoded := encodeHeaders(headers, responseHeaderCompletePairs, responseHeaderNameOnly)
@@ -272,8 +272,8 @@ func TestResponseHeaderEncoding(t *testing.T) {
 	})
 
 	t.Run("Format2_NameOnly", func(t *testing.T) {
-		headers := map[string]string{
-			"content-type": "2",
+		headers := Header{
+			"content-type": {"2"},
 		}
 
 		encoded := encodeHeaders(headers, responseHeaderCompletePairs, responseHeaderNameOnly)
@@ -294,8 +294,8 @@ func TestResponseHeaderEncoding(t *testing.T) {
 	})
 
 	t.Run("Format3_Custom", func(t *testing.T) {
-		headers := map[string]string{
-			"x-custom-response": "value",
+		headers := Header{
+			"x-custom-response": {"value"},
 		}
 
 		encoded := encodeHeaders(headers, responseHeaderCompletePairs, responseHeaderNameOnly)
@@ -316,8 +316,8 @@ func TestResponseHeaderEncoding(t *testing.T) {
 
 func TestLargeHeaderValue(t *testing.T) {
 	largeValue := strings.Repeat("a", 10000)
-	headers := map[string]string{
-		"x-large": largeValue,
+	headers := Header{
+		"x-large": {largeValue},
 	}
 
 	req := &Request{
@@ -332,14 +332,14 @@ func TestLargeHeaderValue(t *testing.T) {
 	parsed, err := ParseRequest(data)
 	require.NoError(t, err)
 
-	assert.Equal(t, largeValue, parsed.Headers["x-large"])
+	assert.Equal(t, largeValue, parsed.Headers.Get("x-large"))
 }
 
 func TestHeaderEncodingPriority(t *testing.T) {
 	// When a header exists in both complete pairs and name-only,
 	// Format 1 (complete pair) should take priority
-	headers := map[string]string{
-		"content-type": "application/json", // Exists in both tables
+	headers := Header{
+		"content-type": {"application/json"}, // Exists in both tables
 	}
 
 	encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
@@ -350,3 +350,223 @@ func TestHeaderEncodingPriority(t *testing.T) {
 	expectedID := requestHeaderCompletePairs["content-type:application/json"]
 	assert.Equal(t, expectedID, encoded[0])
 }
+
+func TestHeaderMethods(t *testing.T) {
+	h := Header{}
+	h.Add("Set-Cookie", "a=1")
+	h.Add("set-cookie", "b=2")
+	h.Set("Content-Type", "text/plain")
+
+	assert.Equal(t, []string{"a=1", "b=2"}, h["set-cookie"], "keys are stored lowercase")
+	assert.Equal(t, "a=1", h.Get("SET-COOKIE"))
+	assert.Equal(t, []string{"a=1", "b=2"}, h.Values("Set-Cookie"))
+	assert.True(t, h.Has("content-type"))
+
+	h.Set("set-cookie", "c=3")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"))
+
+	clone := h.Clone()
+	clone.Add("set-cookie", "d=4")
+	assert.Equal(t, []string{"c=3"}, h.Values("set-cookie"), "clone must not share values")
+
+	h.Del("Set-Cookie")
+	assert.False(t, h.Has("set-cookie"))
+	assert.Empty(t, h.Get("set-cookie"))
+	assert.Nil(t, h.Values("missing"))
+	assert.Nil(t, Header(nil).Clone())
+}
+
+func TestMultiValueHeadersRoundTrip(t *testing.T) {
+	resp := &Response{
+		Version:    Version,
+		StatusCode: 200,
+		Headers: Header{
+			"set-cookie":       {"session=abc; HttpOnly", "theme=dark"},
+			"vary":             {"accept-encoding", "accept-language"},
+			"link":             {"</a.css>; rel=preload", "</b.js>; rel=preload"},
+			"www-authenticate": {"Basic", "Bearer"},
+			"content-type":     {"text/plain"},
+		},
+	}
+
+	parsed, err := ParseResponse(resp.Format())
+	require.NoError(t, err)
+	assert.Equal(t, resp.Headers, parsed.Headers)
+
+	req := &Request{
+		Method:  GET,
+		Host:    "example.com",
+		Path:    "/",
+		Version: Version,
+		Headers: Header{"accept": {"text/html", "application/json"}, "x-tag": {"one", "two", "three"}},
+	}
+	parsedReq, err := ParseRequest(req.Format())
+	require.NoError(t, err)
+	assert.Equal(t, req.Headers, parsedReq.Headers)
+}
+
+func TestMultiValueHeadersKeepStaticEncoding(t *testing.T) {
+	// Each occurrence uses the most compact format on its own: a complete
+	// pair (Format 1) and a name-only entry with a value (Format 2).
+	headers := Header{"accept": {"*/*", "3,2,1"}}
+	encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
+
+	pairID := requestHeaderCompletePairs["accept:*/*"]
+	nameID := requestHeaderNameOnly["accept"]
+	expected := AppendUvarint([]byte{pairID, nameID}, uint64(len("3,2,1")))
+	expected = append(expected, "3,2,1"...)
+	assert.Equal(t, expected, encoded)
+}
+
+func TestHeaderEncodingDeterministic(t *testing.T) {
+	req := &Request{
+		Method:  GET,
+		Host:    "example.com",
+		Path:    "/",
+		Version: Version,
+		Headers: Header{
+			"accept":          {"*/*"},
+			"user-agent":      {"QH/1.0"},
+			"authorization":   {"Bearer token"},
+			"x-trace-id":      {"abc"},
+			"x-b":             {"2"},
+			"x-a":             {"1"},
+			"accept-encoding": {"zstd, br, gzip"},
+		},
+	}
+
+	first := req.Format()
+	for range 50 {
+		require.Equal(t, first, req.Format())
+	}
+}
+
+func TestHeaderEncodingCanonicalOrder(t *testing.T) {
+	headers := Header{
+		"x-zeta":     {"z"},
+		"user-agent": {"QH/1.0"},      // Format 2
+		"x-alpha":    {"a"},           // Format 3
+		"accept":     {"*/*"},         // Format 1
+		"connection": {"keep-alive"},  // Format 1
+		"host":       {"example.com"}, // Format 2
+		"x-alpha-2":  {"b"},           // Format 3
+	}
+	encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
+
+	parsed, _, err := parseHeaders(encoded, 0, uint64(len(encoded)), RequestHeaderStaticTable, true)
+	require.NoError(t, err)
+	assert.Equal(t, headers, parsed)
+
+	// Walk the fields and collect their IDs and custom names
+	var ids []byte
+	var names []string
+	for offset := 0; offset < len(encoded); {
+		id := encoded[offset]
+		name, _, next, err := parseHeaderEntry(encoded, offset+1, id, RequestHeaderStaticTable)
+		require.NoError(t, err)
+		ids = append(ids, id)
+		if id == CustomHeader {
+			names = append(names, name)
+		}
+		offset = next
+	}
+
+	pairAccept := requestHeaderCompletePairs["accept:*/*"]
+	pairConnection := requestHeaderCompletePairs["connection:keep-alive"]
+	nameUserAgent := requestHeaderNameOnly["user-agent"]
+	nameHost := requestHeaderNameOnly["host"]
+	expected := []byte{
+		min(pairAccept, pairConnection), max(pairAccept, pairConnection),
+		min(nameUserAgent, nameHost), max(nameUserAgent, nameHost),
+		CustomHeader, CustomHeader, CustomHeader,
+	}
+	assert.Equal(t, expected, ids)
+	assert.Equal(t, []string{"x-alpha", "x-alpha-2", "x-zeta"}, names)
+}
+
+func TestHeaderEncodingKeepsValueOrder(t *testing.T) {
+	// Both values are complete pairs; if the second one has the lower ID the
+	// canonical order would swap them, so the encoder falls back to Format 2.
+	first, second := "text/html", "application/json"
+	if requestHeaderCompletePairs["accept:"+first] > requestHeaderCompletePairs["accept:"+second] {
+		first, second = second, first
+	}
+	for _, values := range [][]string{{first, second}, {second, first}} {
+		headers := Header{"accept": values}
+		encoded := encodeHeaders(headers, requestHeaderCompletePairs, requestHeaderNameOnly)
+
+		parsed, _, err := parseHeaders(encoded, 0, uint64(len(encoded)), RequestHeaderStaticTable, true)
+		require.NoError(t, err)
+		assert.Equal(t, values, parsed.Values("accept"))
+	}
+}
+
+func TestParseStrictRejectsNonCanonicalHeaders(t *testing.T) {
+	custom := func(name, value string) []byte {
+		b := AppendUvarint([]byte{CustomHeader}, uint64(len(name)))
+		b = append(b, name...)
+		b = AppendUvarint(b, uint64(len(value)))
+		return append(b, value...)
+	}
+	pair := []byte{requestHeaderCompletePairs["accept:*/*"]}
+	named := AppendUvarint([]byte{requestHeaderNameOnly["user-agent"]}, 2)
+	named = append(named, "qh"...)
+
+	request := func(headers ...[]byte) []byte {
+		var encoded []byte
+		for _, h := range headers {
+			encoded = append(encoded, h...)
+		}
+		data := []byte{0x00}
+		data = AppendUvarint(data, uint64(len("example.com")))
+		data = append(data, "example.com"...)
+		data = AppendUvarint(data, 1)
+		data = append(data, '/')
+		data = AppendUvarint(data, uint64(len(encoded)))
+		data = append(data, encoded...)
+		return AppendUvarint(data, 0)
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"Canonical", request(pair, named, custom("x-a", "1"), custom("x-b", "2")), false},
+		{"RepeatedCustomName", request(custom("x-a", "1"), custom("x-a", "2")), false},
+		{"NameBeforePair", request(named, pair), true},
+		{"CustomBeforeStatic", request(custom("x-a", "1"), pair), true},
+		{"CustomNamesUnsorted", request(custom("x-b", "2"), custom("x-a", "1")), true},
+		{"UppercaseCustomName", request(custom("X-A", "1")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRequest(tt.data)
+			require.NoError(t, err, "the lenient parser accepts any order")
+
+			_, err = ParseRequestStrict(tt.data)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrNonCanonicalHeaders)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseResponseStrict(t *testing.T) {
+	resp := &Response{
+		Version:    Version,
+		StatusCode: 200,
+		Headers: Header{
+			"content-type":  {"application/json"},
+			"cache-control": {"max-age=3600"},
+			"set-cookie":    {"a=1", "b=2"},
+			"x-custom":      {"v"},
+		},
+		Body: []byte("{}"),
+	}
+	parsed, err := ParseResponseStrict(resp.Format())
+	require.NoError(t, err)
+	assert.Equal(t, resp.Headers, parsed.Headers)
+}
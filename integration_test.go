@@ -1,9 +1,16 @@
 package qh
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -146,6 +153,112 @@ func TestIntegrationCompressionNegotiation(t *testing.T) {
 	assert.Equal(t, responseBody, string(resp.Body))
 }
 
+func TestIntegrationRequestCompression(t *testing.T) {
+	srv, addr := newTestServer(t, WithMaxRequestSize(64*1024), WithMaxRequestBodySize(256*1024),
+		WithSupportedEncodings([]Encoding{Zstd, Gzip}))
+	defer srv.Close()
+	srv.HandleFunc("/upload", POST, func(req *Request) *Response {
+		return TextResponse(200, fmt.Sprintf("%d %q", len(req.Body), req.Headers.Get("content-encoding")))
+	})
+	srv.Handle("/stream", POST, HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		data, err := io.ReadAll(req.BodyReader)
+		if errors.Is(err, ErrRequestBodyTooLarge) {
+			w.WriteHeader(StatusPayloadTooLarge)
+			return
+		}
+		_, _ = fmt.Fprintf(w, "%d %q", len(data), req.Headers.Get("content-encoding"))
+	}))
+	body := []byte(strings.Repeat(`{"level":"info","msg":"log line"}`+"\n", 1000))
+
+	post := func(t *testing.T, client *Client, body []byte, headers map[string]string) *Response {
+		t.Helper()
+		require.NoError(t, client.Connect(addr, nil))
+		resp, err := client.POST("127.0.0.1", "/upload", body, headers)
+		require.NoError(t, err)
+		return resp
+	}
+	// postStream sends body compressed with encoding as a streamed request.
+	postStream := func(t *testing.T, path string, body []byte, encoding Encoding) *Response {
+		t.Helper()
+		compressed, err := Compress(body, encoding)
+		require.NoError(t, err)
+		client := NewClient()
+		defer client.Close()
+		require.NoError(t, client.Connect(addr, nil))
+		resp, err := client.Request(&Request{
+			Method:     POST,
+			Host:       "127.0.0.1",
+			Path:       path,
+			Version:    Version,
+			Headers:    Header{"content-encoding": {string(encoding)}},
+			BodyReader: bytes.NewReader(compressed),
+		}, 0)
+		require.NoError(t, err)
+		return resp
+	}
+
+	for _, encoding := range []Encoding{Zstd, Gzip} {
+		t.Run(string(encoding), func(t *testing.T) {
+			client := NewClient(WithRequestCompression(encoding))
+			defer client.Close()
+			resp := post(t, client, body, nil)
+			assert.Equal(t, 200, resp.StatusCode)
+			assert.Equal(t, fmt.Sprintf(`%d ""`, len(body)), string(resp.Body))
+		})
+	}
+
+	t.Run("UnsupportedEncoding", func(t *testing.T) {
+		client := NewClient(WithRequestCompression(Brotli))
+		defer client.Close()
+		resp := post(t, client, body, nil)
+		assert.Equal(t, StatusUnsupportedMediaType, resp.StatusCode)
+		assert.Equal(t, "zstd, gzip", resp.Headers.Get("accept-encoding"))
+	})
+
+	t.Run("DecompressedTooLarge", func(t *testing.T) {
+		bomb, err := Compress(make([]byte, 1024*1024), Zstd)
+		require.NoError(t, err)
+		client := NewClient()
+		defer client.Close()
+		resp := post(t, client, bomb, map[string]string{"content-encoding": "zstd"})
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+	})
+
+	t.Run("CorruptBody", func(t *testing.T) {
+		client := NewClient()
+		defer client.Close()
+		resp := post(t, client, []byte("not gzip"), map[string]string{"content-encoding": "gzip"})
+		assert.Equal(t, StatusBadRequest, resp.StatusCode)
+	})
+
+	for _, encoding := range []Encoding{Zstd, Gzip} {
+		t.Run("Streamed/"+string(encoding), func(t *testing.T) {
+			for _, path := range []string{"/upload", "/stream"} {
+				resp := postStream(t, path, body, encoding)
+				assert.Equal(t, 200, resp.StatusCode, path)
+				assert.Equal(t, fmt.Sprintf(`%d ""`, len(body)), string(resp.Body), path)
+			}
+		})
+	}
+
+	t.Run("StreamedUnsupportedEncoding", func(t *testing.T) {
+		resp := postStream(t, "/stream", body, Brotli)
+		assert.Equal(t, StatusUnsupportedMediaType, resp.StatusCode)
+		assert.Equal(t, "zstd, gzip", resp.Headers.Get("accept-encoding"))
+	})
+
+	t.Run("StreamedDecompressedTooLarge", func(t *testing.T) {
+		// HandleFunc handlers get at most WithMaxRequestSize, Handle
+		// handlers at most WithMaxRequestBodySize of decompressed body.
+		resp := postStream(t, "/upload", make([]byte, 128*1024), Zstd)
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+		resp = postStream(t, "/stream", make([]byte, 128*1024), Zstd)
+		assert.Equal(t, `131072 ""`, string(resp.Body))
+		resp = postStream(t, "/stream", make([]byte, 1024*1024), Zstd)
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+	})
+}
+
 func TestIntegrationHeaderHandling(t *testing.T) {
 	srv, addr := newTestServer(t)
 	defer srv.Close()
@@ -153,14 +266,20 @@ func TestIntegrationHeaderHandling(t *testing.T) {
 	srv.HandleFunc("/headers", GET, func(req *Request) *Response {
 		respHeaders := map[string]string{
 			"content-type":    "application/json",
-			"x-custom-header": req.Headers["x-custom-header"],
-			"user-agent":      req.Headers["user-agent"],
+			"x-custom-header": req.Headers.Get("x-custom-header"),
+			"user-agent":      req.Headers.Get("user-agent"),
 			"cache-control":   "max-age=3600",
 			"x-request-id":    "test-123",
 			"x-server":        "qh-test",
 		}
 		return NewResponse(200, []byte(`{"status":"ok"}`), respHeaders)
 	})
+	srv.HandleFunc("/cookies", GET, func(_ *Request) *Response {
+		resp := TextResponse(200, "ok")
+		resp.Headers.Add("set-cookie", "session=abc; HttpOnly")
+		resp.Headers.Add("set-cookie", "theme=dark")
+		return resp
+	})
 
 	client := NewClient()
 	defer client.Close()
@@ -174,18 +293,24 @@ func TestIntegrationHeaderHandling(t *testing.T) {
 		resp, err := client.GET("127.0.0.1", "/headers", headers)
 		require.NoError(t, err)
 		assert.Equal(t, 200, resp.StatusCode)
-		assert.Equal(t, "custom-value-123", resp.Headers["x-custom-header"])
-		assert.Equal(t, "QH-Test-Client/1.0", resp.Headers["user-agent"])
+		assert.Equal(t, "custom-value-123", resp.Headers.Get("x-custom-header"))
+		assert.Equal(t, "QH-Test-Client/1.0", resp.Headers.Get("user-agent"))
 	})
 
 	t.Run("Multiple response headers", func(t *testing.T) {
 		resp, err := client.GET("127.0.0.1", "/headers", nil)
 		require.NoError(t, err)
 		assert.Equal(t, 200, resp.StatusCode)
-		assert.Equal(t, "application/json", resp.Headers["content-type"])
-		assert.Equal(t, "max-age=3600", resp.Headers["cache-control"])
-		assert.Equal(t, "test-123", resp.Headers["x-request-id"])
-		assert.Equal(t, "qh-test", resp.Headers["x-server"])
+		assert.Equal(t, "application/json", resp.Headers.Get("content-type"))
+		assert.Equal(t, "max-age=3600", resp.Headers.Get("cache-control"))
+		assert.Equal(t, "test-123", resp.Headers.Get("x-request-id"))
+		assert.Equal(t, "qh-test", resp.Headers.Get("x-server"))
+	})
+
+	t.Run("Repeated response header", func(t *testing.T) {
+		resp, err := client.GET("127.0.0.1", "/cookies", nil)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"session=abc; HttpOnly", "theme=dark"}, resp.Headers.Values("set-cookie"))
 	})
 }
 
@@ -202,6 +327,12 @@ func TestIntegrationErrorResponses(t *testing.T) {
 	srv.HandleFunc("/error", GET, func(_ *Request) *Response {
 		return TextResponse(500, "Internal server error")
 	})
+	srv.HandleFunc("/rate-limited", GET, func(_ *Request) *Response {
+		return TextResponse(429, "Slow down")
+	})
+	srv.HandleFunc("/legal", GET, func(_ *Request) *Response {
+		return TextResponse(451, "Unavailable for legal reasons")
+	})
 
 	client := NewClient()
 	defer client.Close()
@@ -218,6 +349,8 @@ func TestIntegrationErrorResponses(t *testing.T) {
 		{"400 Bad Request", "POST", "/bad-request", 400, "Invalid request format"},
 		{"403 Forbidden", "GET", "/forbidden", 403, "Access denied"},
 		{"500 Internal Error", "GET", "/error", 500, "Internal server error"},
+		{"429 Too Many Requests", "GET", "/rate-limited", 429, "Slow down"},
+		{"451 Escaped Status", "GET", "/legal", 451, "Unavailable for legal reasons"},
 	}
 
 	for _, tt := range tests {
@@ -237,6 +370,43 @@ func TestIntegrationErrorResponses(t *testing.T) {
 	}
 }
 
+func TestIntegrationRouting(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	srv.HandleFunc("/users/{id}", GET, func(req *Request) *Response {
+		return TextResponse(200, "user "+req.PathValue("id"))
+	})
+	srv.HandleFunc("/users/{id}", DELETE, func(_ *Request) *Response {
+		return NewResponse(204, nil, nil)
+	})
+	srv.HandleFunc("/files/*", GET, func(req *Request) *Response {
+		return TextResponse(200, "file "+req.PathValue("*"))
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	resp, err := client.GET("127.0.0.1", "/users/42?verbose=1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "user 42", string(resp.Body))
+
+	resp, err = client.GET("127.0.0.1", "/files/docs/readme.txt", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "file docs/readme.txt", string(resp.Body))
+
+	resp, err = client.POST("127.0.0.1", "/users/42", []byte("x"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, "GET, DELETE", resp.Headers.Get("allow"))
+
+	resp, err = client.GET("127.0.0.1", "/groups/1", nil)
+	require.NoError(t, err)
+	assert.Equal(t, StatusNotFound, resp.StatusCode)
+}
+
 func TestIntegrationEmptyBody(t *testing.T) {
 	srv, addr := newTestServer(t)
 	defer srv.Close()
@@ -310,8 +480,8 @@ func TestIntegrationConnectionReuse(t *testing.T) {
 	defer client.Close()
 	require.NoError(t, client.Connect(addr, nil))
 
-	connBefore := client.conn
-	initialStreamID := client.streamID.Load()
+	connBefore := defaultConn(t, client)
+	initialStreamID := connBefore.streamID.Load()
 
 	numRequests := 20
 	for i := range numRequests {
@@ -321,9 +491,848 @@ func TestIntegrationConnectionReuse(t *testing.T) {
 	}
 
 	assert.Equal(t, numRequests, callCount, "All requests should reach the server")
-	assert.Same(t, connBefore, client.conn, "Should reuse same connection")
+	assert.Same(t, connBefore, defaultConn(t, client), "Should reuse same connection")
 
-	finalStreamID := client.streamID.Load()
+	finalStreamID := connBefore.streamID.Load()
 	assert.Equal(t, uint32(numRequests), finalStreamID-initialStreamID,
 		"Stream IDs should increment sequentially on reused connection")
 }
+
+func TestIntegrationConcurrentRequests(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	numPaths := 8
+	for i := range numPaths {
+		path := fmt.Sprintf("/item/%d", i)
+		srv.HandleFunc(path, GET, func(_ *Request) *Response {
+			return TextResponse(200, "response for "+path+strings.Repeat(".", i*1000))
+		})
+	}
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, numPaths*4)
+	for range 4 {
+		for i := range numPaths {
+			wg.Go(func() {
+				path := fmt.Sprintf("/item/%d", i)
+				resp, err := client.GET("127.0.0.1", path, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				expected := "response for " + path + strings.Repeat(".", i*1000)
+				if string(resp.Body) != expected {
+					errs <- fmt.Errorf("%s: got response of %d bytes, want %d", path, len(resp.Body), len(expected))
+				}
+			})
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestIntegrationHandlerPoolFull(t *testing.T) {
+	srv, addr := newTestServer(t, WithMaxConcurrentHandlers(1))
+	defer srv.Close()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	srv.HandleFunc("/block", GET, func(_ *Request) *Response {
+		started <- struct{}{}
+		<-release
+		return TextResponse(200, "done")
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 2)
+	request := func() {
+		resp, err := client.GET("127.0.0.1", "/block", nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		statuses <- resp.StatusCode
+	}
+
+	// The first request occupies the only worker, the second waits in the queue.
+	wg.Go(request)
+	<-started
+	wg.Go(request)
+	require.Eventually(t, func() bool { return len(srv.jobs) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	resp, err := client.GET("127.0.0.1", "/block", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 503, resp.StatusCode)
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		assert.Equal(t, 200, status)
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	newBlockingServer := func(t *testing.T) (*Server, *Client, chan struct{}, chan struct{}) {
+		t.Helper()
+		srv, addr := newTestServer(t)
+		t.Cleanup(func() { srv.Close() })
+
+		started := make(chan struct{}, 1)
+		release := make(chan struct{})
+		srv.HandleFunc("/block", GET, func(_ *Request) *Response {
+			started <- struct{}{}
+			<-release
+			return TextResponse(200, "done")
+		})
+
+		client := NewClient()
+		t.Cleanup(func() { client.Close() })
+		require.NoError(t, client.Connect(addr, nil))
+		return srv, client, started, release
+	}
+
+	t.Run("DrainsInFlight", func(t *testing.T) {
+		srv, client, started, release := newBlockingServer(t)
+
+		inflight := make(chan *Response, 1)
+		go func() {
+			resp, err := client.GET("127.0.0.1", "/block", nil)
+			if err != nil {
+				t.Error(err)
+			}
+			inflight <- resp
+		}()
+		<-started
+
+		shutdownErr := make(chan error, 1)
+		go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+		require.Eventually(t, func() bool {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			return srv.draining
+		}, 5*time.Second, 10*time.Millisecond)
+
+		resp, err := client.GET("127.0.0.1", "/block", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+
+		close(release)
+		resp = <-inflight
+		require.NotNil(t, resp)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "done", string(resp.Body))
+		require.NoError(t, <-shutdownErr)
+	})
+
+	t.Run("DeadlineAbandonsRequests", func(t *testing.T) {
+		srv, client, started, release := newBlockingServer(t)
+		defer close(release)
+
+		go func() { _, _ = client.GET("127.0.0.1", "/block", nil) }()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err := srv.Shutdown(ctx)
+
+		var shutdownErr *ShutdownError
+		require.ErrorAs(t, err, &shutdownErr)
+		assert.Equal(t, 1, shutdownErr.Abandoned)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestIntegrationMiddleware(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	srv.Use(Recovery(), RequestID())
+	tag := func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			w.Header().Set("x-route", "tagged")
+			next.ServeQH(ctx, w, r)
+		})
+	}
+	srv.HandleFunc("/tagged", GET, func(_ *Request) *Response {
+		return TextResponse(200, "ok")
+	}, tag)
+	srv.HandleFunc("/panic", GET, func(_ *Request) *Response {
+		panic("handler failure")
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	resp, err := client.GET("127.0.0.1", "/tagged", map[string]string{"x-request-id": "req-42"})
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "tagged", resp.Headers.Get("x-route"))
+	assert.Equal(t, "req-42", resp.Headers.Get("x-request-id"))
+
+	resp, err = client.GET("127.0.0.1", "/panic", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 500, resp.StatusCode)
+	assert.Equal(t, "Internal Server Error", string(resp.Body))
+
+	// Server middleware also wraps requests without a route.
+	resp, err = client.GET("127.0.0.1", "/missing", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.NotEmpty(t, resp.Headers.Get("x-request-id"))
+	assert.Empty(t, resp.Headers.Get("x-route"))
+}
+
+func TestIntegrationStreamedRequestBody(t *testing.T) {
+	// For a streamed body the limit only bounds what is buffered for the handler.
+	srv, addr := newTestServer(t, WithMaxRequestSize(64*1024))
+	defer srv.Close()
+
+	srv.Handle("/upload", POST, HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		data, err := io.ReadAll(req.BodyReader)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprint(w, err)
+			return
+		}
+		fmt.Fprintf(w, "%d %s", len(data), data[len(data)-3:])
+	}))
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	size := 256 * 1024
+	body := strings.Repeat("S", size-3) + "END"
+	resp, err := client.Request(&Request{
+		Method:     POST,
+		Host:       "127.0.0.1",
+		Path:       "/upload",
+		Version:    Version,
+		Headers:    Header{},
+		BodyReader: strings.NewReader(body),
+	}, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, fmt.Sprintf("%d END", size), string(resp.Body))
+}
+
+func TestIntegrationRequestSizeLimits(t *testing.T) {
+	srv, addr := newTestServer(t, WithMaxRequestSize(64*1024), WithMaxRequestBodySize(100*1024))
+	defer srv.Close()
+
+	// readBody answers with the length of the body read from BodyReader.
+	readBody := func(w ResponseWriter, req *Request) {
+		data, err := io.ReadAll(req.BodyReader)
+		switch {
+		case errors.Is(err, ErrRequestBodyTooLarge):
+			w.WriteHeader(StatusPayloadTooLarge)
+		case err != nil:
+			w.WriteHeader(500)
+		}
+		fmt.Fprint(w, len(data))
+	}
+	srv.Handle("/upload", POST, HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		readBody(w, req)
+	}))
+
+	// The server stops reading the stream while the handler has a full
+	// buffer of body data left to read.
+	srv.Handle("/slow", POST, HandlerFunc(func(_ context.Context, w ResponseWriter, req *Request) {
+		pipe := req.BodyReader.(*bodyPipe)
+		assert.Eventually(t, func() bool { return pipe.buffered() >= 64*1024 }, 5*time.Second, time.Millisecond)
+		assert.Less(t, pipe.buffered(), 64*1024+2*1500)
+		readBody(w, req)
+	}))
+
+	// HandleFunc handlers get a streamed body in Body.
+	srv.HandleFunc("/buffered", POST, func(req *Request) *Response {
+		return TextResponse(200, strconv.Itoa(len(req.Body)))
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	t.Run("SlowHandler", func(t *testing.T) {
+		resp, err := client.Request(&Request{
+			Method:     POST,
+			Host:       "127.0.0.1",
+			Path:       "/slow",
+			Version:    Version,
+			Headers:    Header{},
+			BodyReader: bytes.NewReader(make([]byte, 96*1024)),
+		}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "98304", string(resp.Body))
+	})
+
+	for _, size := range []int{32 * 1024, 80 * 1024} {
+		t.Run(fmt.Sprintf("HandleFunc%dKB", size/1024), func(t *testing.T) {
+			resp, err := client.Request(&Request{
+				Method:     POST,
+				Host:       "127.0.0.1",
+				Path:       "/buffered",
+				Version:    Version,
+				Headers:    Header{},
+				BodyReader: bytes.NewReader(make([]byte, size)),
+			}, 0)
+			require.NoError(t, err)
+			if size > 64*1024 {
+				assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+			} else {
+				assert.Equal(t, strconv.Itoa(size), string(resp.Body))
+			}
+		})
+	}
+
+	t.Run("Buffered", func(t *testing.T) {
+		resp, err := client.POST("127.0.0.1", "/upload", make([]byte, 128*1024), nil)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+	})
+
+	t.Run("StreamedBody", func(t *testing.T) {
+		resp, err := client.Request(&Request{
+			Method:     POST,
+			Host:       "127.0.0.1",
+			Path:       "/upload",
+			Version:    Version,
+			Headers:    Header{},
+			BodyReader: bytes.NewReader(make([]byte, 256*1024)),
+		}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+	})
+
+	t.Run("StreamedHead", func(t *testing.T) {
+		resp, err := client.Request(&Request{
+			Method:     POST,
+			Host:       "127.0.0.1",
+			Path:       "/upload",
+			Version:    Version,
+			Headers:    Header{"x-large": {strings.Repeat("h", 70*1024)}},
+			BodyReader: strings.NewReader("body"),
+		}, 0)
+		require.NoError(t, err)
+		assert.Equal(t, StatusPayloadTooLarge, resp.StatusCode)
+	})
+
+	// Rejected requests no longer count as in flight, and the server still
+	// accepts requests that fit.
+	resp, err := client.POST("127.0.0.1", "/upload", []byte("small"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, "5", string(resp.Body))
+	require.Eventually(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.inflight == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestIntegrationStreamedResponseBody(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	size := 256 * 1024
+	body := strings.Repeat("D", size)
+	srv.HandleFunc("/download", GET, func(_ *Request) *Response {
+		resp := NewResponse(200, nil, map[string]string{"content-type": "text/plain"})
+		resp.BodyReader = io.NopCloser(strings.NewReader(body))
+		return resp
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+	limited := NewClient(WithMaxResponseSize(64 * 1024))
+	defer limited.Close()
+	require.NoError(t, limited.Connect(addr, nil))
+
+	t.Run("RequestStream", func(t *testing.T) {
+		resp, err := client.RequestStream(&Request{
+			Method:  GET,
+			Host:    "127.0.0.1",
+			Path:    "/download",
+			Version: Version,
+			Headers: Header{},
+		})
+		require.NoError(t, err)
+		defer resp.BodyReader.Close()
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, "chunked", resp.Headers.Get("transfer-encoding"))
+
+		data, err := io.ReadAll(resp.BodyReader)
+		require.NoError(t, err)
+		assert.Len(t, data, size)
+	})
+
+	t.Run("Buffered", func(t *testing.T) {
+		resp, err := client.GET("127.0.0.1", "/download", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, body, string(resp.Body))
+	})
+
+	t.Run("CloseEarly", func(t *testing.T) {
+		resp, err := client.RequestStream(&Request{
+			Method:  GET,
+			Host:    "127.0.0.1",
+			Path:    "/download",
+			Version: Version,
+			Headers: Header{},
+		})
+		require.NoError(t, err)
+		require.NoError(t, resp.BodyReader.Close())
+
+		// The connection stays usable after abandoning a body.
+		resp, err = client.GET("127.0.0.1", "/download", nil)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(resp.Body))
+	})
+
+	t.Run("SlowReader", func(t *testing.T) {
+		// The client stops reading the stream while the caller has a full
+		// buffer of body data left to read.
+		resp, err := limited.RequestStream(&Request{
+			Method:  GET,
+			Host:    "127.0.0.1",
+			Path:    "/download",
+			Version: Version,
+			Headers: Header{},
+		})
+		require.NoError(t, err)
+		defer resp.BodyReader.Close()
+
+		pipe := resp.BodyReader.(*bodyPipe)
+		assert.Eventually(t, func() bool { return pipe.buffered() >= 64*1024 }, 5*time.Second, time.Millisecond)
+		assert.Less(t, pipe.buffered(), 64*1024+2*1500)
+
+		data, err := io.ReadAll(resp.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, body, string(data))
+	})
+}
+
+func TestIntegrationResponseWriter(t *testing.T) {
+	srv, addr := newTestServer(t, WithMinCompressionSize(100))
+	defer srv.Close()
+
+	body := strings.Repeat("buffered response ", 100)
+	srv.Handle("/buffered", GET, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		w.Header().Set("content-type", "text/plain")
+		w.WriteHeader(StatusAccepted)
+		fmt.Fprint(w, body[:len(body)/2])
+		fmt.Fprint(w, body[len(body)/2:])
+	}))
+
+	release := make(chan struct{})
+	srv.Handle("/incremental", GET, HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		fmt.Fprint(w, "first;")
+		if err := w.Flush(); err != nil {
+			return
+		}
+		<-release
+		fmt.Fprint(w, "second")
+	}))
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	t.Run("Buffered", func(t *testing.T) {
+		resp, err := client.GET("127.0.0.1", "/buffered", nil)
+		require.NoError(t, err)
+		assert.Equal(t, StatusAccepted, resp.StatusCode)
+		assert.Equal(t, "text/plain", resp.Headers.Get("content-type"))
+		assert.Equal(t, body, string(resp.Body), "buffered writes are decompressed transparently")
+	})
+
+	t.Run("Incremental", func(t *testing.T) {
+		resp, err := client.RequestStream(&Request{
+			Method:  GET,
+			Host:    "127.0.0.1",
+			Path:    "/incremental",
+			Version: Version,
+			Headers: Header{},
+		})
+		require.NoError(t, err)
+		defer resp.BodyReader.Close()
+		assert.Equal(t, StatusOK, resp.StatusCode)
+
+		// The flushed part arrives while the handler is still running.
+		first := make([]byte, len("first;"))
+		_, err = io.ReadFull(resp.BodyReader, first)
+		require.NoError(t, err)
+		assert.Equal(t, "first;", string(first))
+
+		close(release)
+		rest, err := io.ReadAll(resp.BodyReader)
+		require.NoError(t, err)
+		assert.Equal(t, "second", string(rest))
+	})
+}
+
+func TestIntegrationHandlerContextCancel(t *testing.T) {
+	newWaitingServer := func(t *testing.T) (*Server, *Client, chan struct{}, chan struct{}) {
+		t.Helper()
+		srv, addr := newTestServer(t)
+		t.Cleanup(func() { srv.Close() })
+
+		started := make(chan struct{}, 1)
+		cancelled := make(chan struct{}, 1)
+		srv.Handle("/wait", GET, HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *Request) {
+			started <- struct{}{}
+			_ = w.Flush()
+			select {
+			case <-ctx.Done():
+				cancelled <- struct{}{}
+			case <-time.After(10 * time.Second):
+			}
+		}))
+
+		client := NewClient()
+		t.Cleanup(func() { client.Close() })
+		require.NoError(t, client.Connect(addr, nil))
+		return srv, client, started, cancelled
+	}
+	req := &Request{Method: GET, Host: "127.0.0.1", Path: "/wait", Version: Version, Headers: Header{}}
+
+	t.Run("PeerClosesStream", func(t *testing.T) {
+		_, client, started, cancelled := newWaitingServer(t)
+
+		// The stream is closed once the response head has arrived. QOTP
+		// drops the close of a stream whose data has not been acknowledged
+		// yet, and the server acknowledges the request before it responds.
+		cc := defaultConn(t, client)
+		stream := cc.conn.Stream(1000)
+		gotHead := make(chan struct{})
+		_, err := cc.addPending(stream, false, &ClientTrace{GotFirstResponseChunk: func() { close(gotHead) }})
+		require.NoError(t, err)
+		require.NoError(t, writeAll(stream, req.Format()))
+		<-started
+		<-gotHead
+
+		stream.Close()
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler context was not cancelled after the stream was closed")
+		}
+	})
+
+	t.Run("ServerClose", func(t *testing.T) {
+		srv, client, started, cancelled := newWaitingServer(t)
+
+		go func() { _, _ = client.Request(req, 0) }()
+		<-started
+
+		require.NoError(t, srv.Close())
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler context was not cancelled by Close")
+		}
+	})
+}
+
+func TestIntegrationClientContext(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	srv.Handle("/slow", GET, HandlerFunc(func(ctx context.Context, w ResponseWriter, _ *Request) {
+		started <- struct{}{}
+		_ = w.Flush()
+		select {
+		case <-ctx.Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+			_, _ = w.Write([]byte("too late"))
+		}
+	}))
+	srv.HandleFunc("/fast", GET, func(_ *Request) *Response {
+		return TextResponse(200, "fast")
+	})
+
+	// Each subtest uses its own connection, since abandoning a request closes
+	// its stream.
+	newClient := func(t *testing.T) *Client {
+		t.Helper()
+		client := NewClient()
+		t.Cleanup(func() { client.Close() })
+		require.NoError(t, client.ConnectContext(context.Background(), addr))
+		return client
+	}
+	newReq := func(path string) *Request {
+		return &Request{Method: GET, Host: "127.0.0.1", Path: path, Version: Version, Headers: Header{}}
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		resp, err := newClient(t).DoContext(ctx, newReq("/fast"))
+		require.NoError(t, err)
+		assert.Equal(t, "fast", string(resp.Body))
+	})
+
+	t.Run("Deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, err := newClient(t).DoContext(ctx, newReq("/slow"))
+		var timeoutErr *TimeoutError
+		require.ErrorAs(t, err, &timeoutErr)
+		assert.Equal(t, "request", timeoutErr.Op)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		<-started
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler context was not cancelled after the request timed out")
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		// The request is cancelled once the response head has arrived. QOTP
+		// drops the close of a stream whose data has not been acknowledged
+		// yet, and the server acknowledges the request before it responds.
+		ctx, cancel := context.WithCancel(context.Background())
+		ctx = WithClientTrace(ctx, &ClientTrace{GotFirstResponseChunk: cancel})
+
+		_, err := newClient(t).DoContext(ctx, newReq("/slow"))
+		require.ErrorIs(t, err, context.Canceled)
+		var timeoutErr *TimeoutError
+		assert.NotErrorAs(t, err, &timeoutErr)
+		<-started
+
+		select {
+		case <-cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler context was not cancelled after the request was cancelled")
+		}
+	})
+}
+
+func TestIntegrationRetry(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	countAttempt := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[path]++
+		return attempts[path]
+	}
+	attemptsOf := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[path]
+	}
+	srv.HandleFunc("/flaky", GET, func(req *Request) *Response {
+		if countAttempt(req.Path) <= 2 {
+			return NewResponse(503, []byte("Service Unavailable"), map[string]string{"retry-after": "0"})
+		}
+		return TextResponse(200, "ok")
+	})
+	srv.HandleFunc("/busy", GET, func(req *Request) *Response {
+		countAttempt(req.Path)
+		return TextResponse(429, "Too Many Requests")
+	})
+	srv.HandleFunc("/submit", POST, func(req *Request) *Response {
+		countAttempt(req.Path + " " + req.Headers.Get("idempotency-key"))
+		return TextResponse(503, "Service Unavailable")
+	})
+
+	client := NewClient(WithRetryPolicy(RetryPolicy{MaxRetries: 3, BaseDelay: 10 * time.Millisecond}))
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+
+	t.Run("RetriesUntilSuccess", func(t *testing.T) {
+		resp, err := client.GET("127.0.0.1", "/flaky", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode)
+		assert.Equal(t, 3, attemptsOf("/flaky"))
+	})
+
+	t.Run("GivesUpAfterMaxRetries", func(t *testing.T) {
+		resp, err := client.GET("127.0.0.1", "/busy", nil)
+		require.NoError(t, err)
+		assert.Equal(t, 429, resp.StatusCode)
+		assert.Equal(t, 4, attemptsOf("/busy"))
+	})
+
+	t.Run("POSTOnlyWithIdempotencyKey", func(t *testing.T) {
+		resp, err := client.POST("127.0.0.1", "/submit", []byte("data"), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+		assert.Equal(t, 1, attemptsOf("/submit "))
+
+		resp, err = client.POST("127.0.0.1", "/submit", []byte("data"), map[string]string{
+			"idempotency-key": "order-42",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 503, resp.StatusCode)
+		assert.Equal(t, 4, attemptsOf("/submit order-42"))
+	})
+}
+
+func TestIntegrationRetryReconnects(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	srv.HandleFunc("/hello", GET, func(_ *Request) *Response {
+		return TextResponse(200, "hello")
+	})
+
+	client := NewClient(WithRetryPolicy(RetryPolicy{BaseDelay: 10 * time.Millisecond}))
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+	_, err := client.GET("127.0.0.1", "/hello", nil)
+	require.NoError(t, err)
+
+	// Lose the connection: the read loop stops and fails further requests.
+	oldConn := defaultConn(t, client)
+	require.NoError(t, oldConn.listener.Close())
+	<-oldConn.loopDone
+
+	resp, err := client.GET("127.0.0.1", "/hello", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+	assert.NotSame(t, oldConn, defaultConn(t, client), "client should have reconnected")
+
+	t.Run("WithoutPolicy", func(t *testing.T) {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		srv.HandleFunc("/wait", GET, func(_ *Request) *Response {
+			close(started)
+			<-release
+			return TextResponse(200, "done")
+		})
+
+		client := NewClient()
+		defer client.Close()
+		require.NoError(t, client.Connect(addr, nil))
+		cc := defaultConn(t, client)
+		go func() {
+			<-started
+			_ = cc.listener.Close()
+		}()
+
+		// The request in flight fails and is not retried ...
+		_, err := client.GET("127.0.0.1", "/wait", nil)
+		close(release)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "connection closed")
+
+		// ... but the next one reconnects.
+		resp, err := client.GET("127.0.0.1", "/hello", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(resp.Body))
+	})
+
+	t.Run("ServerRestarted", func(t *testing.T) {
+		// Stop the server and lose the connection, so that the next
+		// request has to dial a server that does not answer.
+		srv.Close()
+		oldConn := defaultConn(t, client)
+		require.NoError(t, oldConn.listener.Close())
+		<-oldConn.loopDone
+		client.handshakeTimeout = 200 * time.Millisecond
+
+		// Restart the server on the same address once the first dial has
+		// failed, before the retry.
+		var restarted *Server
+		trace := &ClientTrace{ConnectDone: func(_ string, err error) {
+			if err == nil || restarted != nil {
+				return
+			}
+			restarted = NewServer()
+			restarted.HandleFunc("/hello", GET, func(_ *Request) *Response {
+				return TextResponse(200, "hello again")
+			})
+			if err := restarted.Listen(addr, nil, "test"); err != nil {
+				t.Errorf("restarting server: %v", err)
+				return
+			}
+			go func() { _ = restarted.Serve() }()
+		}}
+		defer func() {
+			if restarted != nil {
+				restarted.Close()
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(WithClientTrace(context.Background(), trace), 10*time.Second)
+		defer cancel()
+		req, err := NewRequest(GET, "qh://"+addr+"/hello", nil)
+		require.NoError(t, err)
+		resp, err := client.DoContext(ctx, req)
+		require.NoError(t, err)
+		assert.Equal(t, "hello again", string(resp.Body))
+	})
+}
+
+func TestIntegrationURLHelpers(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+
+	srv.HandleFunc("/search", GET, func(req *Request) *Response {
+		return TextResponse(200, req.URL().Path+" q="+req.Query().Get("q"))
+	})
+	srv.HandleFunc("/items", POST, func(req *Request) *Response {
+		return TextResponse(201, req.Headers.Get("content-type")+" "+string(req.Body))
+	})
+
+	_, port, err := splitHostPort(addr)
+	require.NoError(t, err)
+	base := fmt.Sprintf("qh://127.0.0.1:%d", port)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// No Connect: the client dials the server given in the URL.
+	client := NewClient()
+	defer client.Close()
+
+	resp, err := client.Get(ctx, base+"/search?q=qh%20proto")
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "/search q=qh proto", string(resp.Body))
+
+	resp, err = client.Post(ctx, base+"/items", "application/json", []byte(`{"id":1}`))
+	require.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, `application/json {"id":1}`, string(resp.Body))
+
+	_, err = client.Get(ctx, "qh:///search")
+	require.ErrorIs(t, err, ErrInvalidURL)
+
+	// Connect also accepts a qh URL; the method helpers then use that server.
+	other := NewClient()
+	defer other.Close()
+	require.NoError(t, other.ConnectContext(ctx, base))
+	resp, err = other.GET("127.0.0.1", "/search?q=connect", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "/search q=connect", string(resp.Body))
+}
@@ -0,0 +1,300 @@
+package qh
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qo-proto/qotp"
+)
+
+const (
+	maxDatagramSize = 65535
+
+	// The message type is in the upper 3 bits of the first byte of a QOTP
+	// packet. All packets a server receives carry the connection ID after
+	// that byte: the initial ones as the start of the client's ephemeral
+	// key. qotp exports the message types and sizes but not the shift, and
+	// does not document where initial packets carry the ID; the layout is
+	// that of the qotp version in go.mod and TestQOTPPacketLayout checks it.
+	qotpTypeShift     = 5
+	qotpInitCryptoSnd = byte(qotp.InitCryptoSnd)
+	qotpConnIDOffset  = qotp.HeaderSize
+	qotpConnIDSize    = qotp.ConnIdSize
+)
+
+// keyRing serves one QOTP listener per server key on a single UDP socket, so
+// a server can accept 0-RTT connections made with a retiring key while its
+// DNS records are rotated. A QOTP listener decrypts with a single key, so
+// each new 0-RTT connection is offered to the listeners in turn until one
+// accepts it; its later packets go to that listener. In-band key exchanges
+// always use the primary key.
+//
+// All listeners are driven by a single loop, see loop, so stream callbacks
+// never run concurrently, as with qotp.Listener.Loop.
+type keyRing struct {
+	socket    qotp.NetworkConn
+	listeners []*qotp.Listener // primary first
+	conns     []*ringConn      // network connection of each listener
+
+	// owners maps the connection IDs accepted by a retiring listener to its
+	// index. Connections of the primary listener are not recorded. Entries
+	// are kept until the server is closed, which is fine for the length of
+	// a rotation window.
+	owners map[[qotpConnIDSize]byte]int
+
+	// The loop flushes the listeners without holding their locks, so close
+	// stops it before closing them.
+	mu       sync.Mutex
+	closing  atomic.Bool
+	loopDone chan struct{} // closed when loop returns; nil if it never ran
+}
+
+// newKeyRing listens on addr with one listener per seed. The first seed is
+// the primary key.
+func newKeyRing(addr string, seeds []string) (*keyRing, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &keyRing{
+		socket: qotp.NewUDPNetworkConn(udpConn),
+		owners: make(map[[qotpConnIDSize]byte]int),
+	}
+	closeOnce := &sync.Once{}
+	for _, seed := range seeds {
+		conn := &ringConn{socket: r.socket, closeOnce: closeOnce}
+		listener, err := qotp.Listen(qotp.WithNetworkConn(conn), qotp.WithSeedStr(seed))
+		if err != nil {
+			_ = r.close()
+			return nil, err
+		}
+		r.listeners = append(r.listeners, listener)
+		r.conns = append(r.conns, conn)
+	}
+	return r, nil
+}
+
+// loop reads packets from the socket and passes each to the listener it
+// belongs to, like qotp.Listener.Loop does for a single listener. It
+// returns when the socket is closed or callback asks to stop.
+func (r *keyRing) loop(callback func(s *qotp.Stream) (bool, error)) {
+	r.mu.Lock()
+	if r.closing.Load() {
+		r.mu.Unlock()
+		return
+	}
+	r.loopDone = make(chan struct{})
+	r.mu.Unlock()
+	defer close(r.loopDone)
+
+	buf := make([]byte, maxDatagramSize)
+	wait := qotp.MinDeadLine
+	for {
+		n, addr, err := r.socket.ReadFromUDPAddrPort(buf, wait, uint64(time.Now().UnixNano()))
+		if r.closing.Load() {
+			return
+		}
+		var netErr net.Error
+		if err != nil && (!errors.As(err, &netErr) || !netErr.Timeout()) {
+			slog.Error("Error in loop listen", "error", err)
+			return
+		}
+
+		var stream *qotp.Stream
+		if err == nil && n > qotpConnIDOffset+qotpConnIDSize {
+			stream = r.receive(buf[:n], addr)
+		}
+		cont, err := callback(stream)
+		if err != nil {
+			slog.Error("Error in loop callback", "error", err)
+			return
+		}
+
+		now := uint64(time.Now().UnixNano())
+		wait = qotp.MinDeadLine
+		for _, l := range r.listeners {
+			wait = min(wait, l.Flush(now))
+		}
+		if !cont {
+			return
+		}
+	}
+}
+
+// receive hands a packet to the listener it belongs to and returns the
+// stream it carried data for, if any. Packets that no listener accepts are
+// dropped.
+func (r *keyRing) receive(packet []byte, addr netip.AddrPort) *qotp.Stream {
+	id := [qotpConnIDSize]byte(packet[qotpConnIDOffset:])
+	candidates := []int{0}
+	if i, ok := r.owners[id]; ok {
+		candidates = []int{i}
+	} else if packet[0]>>qotpTypeShift == qotpInitCryptoSnd {
+		candidates = make([]int, len(r.listeners))
+		for i := range candidates {
+			candidates[i] = i
+		}
+	}
+
+	var errs []error
+	for _, i := range candidates {
+		conn := r.conns[i]
+		conn.packet, conn.addr = packet, addr
+		s, err := r.listeners[i].Listen(0, uint64(time.Now().UnixNano()))
+		conn.packet = nil
+		if err == nil {
+			if i > 0 {
+				r.owners[id] = i
+			}
+			return s
+		}
+		errs = append(errs, err)
+	}
+	slog.Debug("Dropping packet no key accepted", "remote", addr, "error", errors.Join(errs...))
+	return nil
+}
+
+// primary returns the listener of the primary key.
+func (r *keyRing) primary() *qotp.Listener {
+	return r.listeners[0]
+}
+
+// close stops the loop, then closes all listeners and the socket.
+func (r *keyRing) close() error {
+	r.mu.Lock()
+	r.closing.Store(true)
+	done := r.loopDone
+	r.mu.Unlock()
+	if done != nil {
+		_ = r.socket.TimeoutReadNow()
+		<-done
+	}
+
+	errs := make([]error, 0, len(r.listeners)+1)
+	for _, l := range r.listeners {
+		errs = append(errs, l.Close())
+	}
+	if len(r.listeners) == 0 {
+		errs = append(errs, r.socket.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// ringConn is the network connection of one listener of a keyRing. Reads
+// return the packet the key ring is currently handing to the listener;
+// everything else goes to the shared socket.
+type ringConn struct {
+	socket    qotp.NetworkConn
+	closeOnce *sync.Once // closes the shared socket once for all listeners
+
+	packet []byte // set by keyRing.receive for the duration of a Listen call
+	addr   netip.AddrPort
+}
+
+func (c *ringConn) ReadFromUDPAddrPort(p []byte, _, _ uint64) (int, netip.AddrPort, error) {
+	if c.packet == nil {
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	}
+	n := copy(p, c.packet)
+	c.packet = nil
+	return n, c.addr, nil
+}
+
+// TimeoutReadNow wakes up the key ring's loop, so it flushes the data a
+// stream has just written.
+func (c *ringConn) TimeoutReadNow() error {
+	return c.socket.TimeoutReadNow()
+}
+
+func (c *ringConn) WriteToUDPAddrPort(p []byte, remoteAddr netip.AddrPort, nowNano uint64) error {
+	return c.socket.WriteToUDPAddrPort(p, remoteAddr, nowNano)
+}
+
+func (c *ringConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() { err = c.socket.Close() })
+	return err
+}
+
+func (c *ringConn) LocalAddrString() string {
+	return c.socket.LocalAddrString()
+}
+
+// seedPublicKey returns the base64 public key a listener started with
+// qotp.WithSeedStr(seed) has.
+func seedPublicKey(seed string) (string, error) {
+	hash := sha256.Sum256([]byte(seed))
+	key, err := ecdh.X25519().NewPrivateKey(hash[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// formatKeyRecord returns the TXT record announcing a base64 server key.
+func formatKeyRecord(key string) string {
+	return fmt.Sprintf("v=%d;k=%s", qotp.ProtoVersion, key)
+}
+
+// WriteKeyRotationRecords writes the DNS TXT records to publish at
+// _qotp.<host> for each phase of rotating the server key from oldSeed to
+// newSeed, in zone file format:
+//
+//  1. Rotation: the server listens with newSeed as its primary seed and
+//     oldSeed as a retiring seed, see Server.Listen. Both keys are
+//     published, the new one first, so clients prefer it while clients
+//     with cached records can still connect with the old one.
+//  2. Retirement: once the old records have expired from all caches (their
+//     TTL has passed), the server listens with newSeed only and only the new
+//     key is published.
+func WriteKeyRotationRecords(w io.Writer, host, oldSeed, newSeed string) error {
+	oldKey, err := seedPublicKey(oldSeed)
+	if err != nil {
+		return err
+	}
+	newKey, err := seedPublicKey(newSeed)
+	if err != nil {
+		return err
+	}
+
+	name := "_qotp." + host + "."
+	phases := []struct {
+		comment string
+		keys    []string
+	}{
+		{"Phase 1 (rotation): Listen(addr, nil, newSeed, oldSeed)", []string{newKey, oldKey}},
+		{"Phase 2 (retirement, after the TTL of the phase 1 records): Listen(addr, nil, newSeed)", []string{newKey}},
+	}
+	for i, phase := range phases {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "; %s\n", phase.comment); err != nil {
+			return err
+		}
+		for _, key := range phase.keys {
+			if _, err := fmt.Fprintf(w, "%s IN TXT %q\n", name, formatKeyRecord(key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package qh
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qo-proto/qotp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerDNSRecords(t *testing.T) {
+	oldKey, err := seedPublicKey("old")
+	require.NoError(t, err)
+	newKey, err := seedPublicKey("new")
+	require.NoError(t, err)
+
+	srv, _ := newSeededTestServer(t, []string{"old"})
+	defer srv.Close()
+	assert.Equal(t, []string{formatKeyRecord(oldKey)}, srv.DNSRecords())
+
+	ring, _ := newSeededTestServer(t, []string{"new", "old"})
+	defer ring.Close()
+	assert.Equal(t, []string{formatKeyRecord(newKey), formatKeyRecord(oldKey)}, ring.DNSRecords())
+
+	assert.Nil(t, NewServer().DNSRecords())
+	assert.Error(t, NewServer().Listen("127.0.0.1:0", nil, "new", ""))
+}
+
+func TestWriteKeyRotationRecords(t *testing.T) {
+	oldKey, err := seedPublicKey("old")
+	require.NoError(t, err)
+	newKey, err := seedPublicKey("new")
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteKeyRotationRecords(&buf, "example.com", "old", "new"))
+	assert.Equal(t,
+		"; Phase 1 (rotation): Listen(addr, nil, newSeed, oldSeed)\n"+
+			`_qotp.example.com. IN TXT "v=0;k=`+newKey+"\"\n"+
+			`_qotp.example.com. IN TXT "v=0;k=`+oldKey+"\"\n"+
+			"\n"+
+			"; Phase 2 (retirement, after the TTL of the phase 1 records): Listen(addr, nil, newSeed)\n"+
+			`_qotp.example.com. IN TXT "v=0;k=`+newKey+"\"\n",
+		buf.String())
+}
+
+func TestKeyRingServesInBand(t *testing.T) {
+	srv, addr := newSeededTestServer(t, []string{"new", "old"})
+	defer srv.Close()
+	srv.HandleFunc("/", GET, func(_ *Request) *Response {
+		return TextResponse(200, "hello")
+	})
+
+	client := NewClient()
+	defer client.Close()
+	require.NoError(t, client.Connect(addr, nil))
+	resp, err := client.GET("127.0.0.1", "/", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+}
+
+func TestKeyRingAcceptsRetiringKey(t *testing.T) {
+	oldKey, err := seedPublicKey("old")
+	require.NoError(t, err)
+	srv, addr := newSeededTestServer(t, []string{"new", "old"})
+	defer srv.Close()
+	reached := make(chan struct{}, 1)
+	srv.HandleFunc("/", GET, func(_ *Request) *Response {
+		reached <- struct{}{}
+		return TextResponse(200, "hello")
+	})
+
+	// A client with cached records that only announce the old key.
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	resolver := &StaticResolver{
+		Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+		TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(oldKey)}},
+	}
+	client := NewClient(WithResolver(resolver))
+	defer client.Close()
+	require.NoError(t, client.Connect(net.JoinHostPort("qh.test", port), nil))
+	assert.Equal(t, oldKey, defaultConn(t, client).key.pubKey)
+
+	req, err := NewRequest(GET, "qh://qh.test:"+port+"/", nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.DoContext(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(resp.Body))
+}
+
+// capturingConn records the packets a QOTP listener sends.
+type capturingConn struct {
+	qotp.NetworkConn
+
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (c *capturingConn) WriteToUDPAddrPort(p []byte, remoteAddr netip.AddrPort, nowNano uint64) error {
+	c.mu.Lock()
+	c.packets = append(c.packets, bytes.Clone(p))
+	c.mu.Unlock()
+	return c.NetworkConn.WriteToUDPAddrPort(p, remoteAddr, nowNano)
+}
+
+// TestQOTPPacketLayout checks the parts of the QOTP packet layout that
+// keyRing relies on but qotp does not export, so that a qotp upgrade that
+// changes them fails here rather than in the routing of packets.
+func TestQOTPPacketLayout(t *testing.T) {
+	srv, addr := newSeededTestServer(t, []string{"new", "old"})
+	defer srv.Close()
+	srv.HandleFunc("/", GET, func(_ *Request) *Response {
+		return TextResponse(200, "hello")
+	})
+	oldKey, err := seedPublicKey("old")
+	require.NoError(t, err)
+	keyHex, err := decodeServerKey(oldKey)
+	require.NoError(t, err)
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	capture := &capturingConn{NetworkConn: qotp.NewUDPNetworkConn(udpConn)}
+	listener, err := qotp.Listen(qotp.WithNetworkConn(capture))
+	require.NoError(t, err)
+	defer listener.Close()
+	conn, err := listener.DialWithCryptoString(addr, keyHex)
+	require.NoError(t, err)
+
+	// The key exchange as dial starts it, then two requests, so the client
+	// sends data packets after the initial one.
+	conn.Stream(0)
+	listener.Flush(uint64(time.Now().UnixNano()))
+	req := (&Request{Method: GET, Host: "127.0.0.1", Path: "/", Version: Version, Headers: Header{}}).Format()
+	responses := make(map[uint32][]byte)
+	complete := func(id uint32) bool {
+		ok, _ := IsResponseComplete(responses[id])
+		return ok
+	}
+	var next uint32 // stream of the next request
+	deadline := time.Now().Add(5 * time.Second)
+	listener.Loop(func(s *qotp.Stream) (bool, error) {
+		if s != nil {
+			data, _ := s.Read()
+			responses[s.StreamID()] = append(responses[s.StreamID()], data...)
+			// The first request goes out once the server has replied to the
+			// key exchange, the second once the first response is complete.
+			if next == 0 || (next == 1 && complete(0)) {
+				_, err := conn.Stream(next).Write(req)
+				require.NoError(t, err)
+				next++
+			}
+		}
+		return !complete(1) && time.Now().Before(deadline), nil
+	})
+	for id := range uint32(2) {
+		resp, err := ParseResponse(responses[id])
+		require.NoError(t, err, "stream %d", id)
+		assert.Equal(t, "hello", string(resp.Body))
+	}
+
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	require.Greater(t, len(capture.packets), 1)
+	first := capture.packets[0]
+	assert.Equal(t, qotpInitCryptoSnd, first[0]>>qotpTypeShift, "type of the initial 0-RTT packet")
+	id := first[qotpConnIDOffset : qotpConnIDOffset+qotpConnIDSize]
+	for i, packet := range capture.packets[1:] {
+		assert.NotEqual(t, qotpInitCryptoSnd, packet[0]>>qotpTypeShift, "type of packet %d", i+1)
+		assert.Equal(t, id, packet[qotpConnIDOffset:qotpConnIDOffset+qotpConnIDSize], "connection ID of packet %d", i+1)
+	}
+}
@@ -0,0 +1,265 @@
+package qh
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// KnownHosts is a trust-on-first-use store of server keys, kept in a file
+// like SSH's known_hosts. Each line holds a host name and the base64 X25519
+// public key of its server, separated by whitespace. Empty lines and lines
+// starting with '#' are ignored.
+//
+// A client using a KnownHosts store, see WithKnownHosts, records the key of
+// the first connection to a host, made with a key the host announces in
+// DNS, once the handshake with it has completed. Later connections to the
+// host are made with the recorded key only, even if DNS no longer announces
+// one or announces other keys first, and fail with a *KeyMismatchError if
+// DNS announces only other keys. A recorded key is never changed by the
+// client; see Replace. A host that has neither a recorded key nor one in DNS
+// is refused with an *UnknownHostError, unless WithInsecureUnpinnedHosts is
+// set.
+type KnownHosts struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string]string // host -> base64 server public key
+}
+
+// KeyMismatchError is returned when none of the server keys announced for a
+// host matches the key recorded for it in the known hosts file.
+type KeyMismatchError struct {
+	Host     string
+	File     string   // path of the known hosts file
+	KnownKey string   // key recorded in the file
+	Keys     []string // keys announced in DNS
+}
+
+func (e *KeyMismatchError) Error() string {
+	return fmt.Sprintf(
+		"server key for %s does not match %s: known key %s, DNS announces %s; "+
+			"if the server key was changed on purpose, remove %s from the file",
+		e.Host, e.File, e.KnownKey, strings.Join(e.Keys, ", "), e.Host)
+}
+
+// UnknownHostError is returned when a host has no key recorded in the known
+// hosts file and announces none in DNS, so its server cannot be verified.
+type UnknownHostError struct {
+	Host string
+	File string // path of the known hosts file
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf(
+		"no server key for %s in DNS or %s; add the server key for %s to the file, "+
+			"or use WithInsecureUnpinnedHosts to connect without verifying the server",
+		e.Host, e.File, e.Host)
+}
+
+// WithKnownHosts enables key pinning with the given known hosts store.
+func WithKnownHosts(kh *KnownHosts) ClientOption {
+	return func(c *Client) {
+		c.knownHosts = kh
+	}
+}
+
+// WithInsecureUnpinnedHosts lets a client with a known hosts store connect to
+// hosts that have no recorded key and announce none in DNS. Such connections
+// use an in-band key exchange, which does not verify the server, and their
+// key is not recorded.
+func WithInsecureUnpinnedHosts() ClientOption {
+	return func(c *Client) {
+		c.insecureUnpinned = true
+	}
+}
+
+// LoadKnownHosts reads the known hosts file at path. A missing file is not
+// an error; it is created when the first key is recorded.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{path: path, keys: make(map[string]string)}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening known hosts file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected host and key", path, lineNum)
+		}
+		if _, err := decodeServerKey(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+		kh.keys[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading known hosts file: %w", err)
+	}
+	return kh, nil
+}
+
+// Lookup returns the key recorded for host.
+func (kh *KnownHosts) Lookup(host string) (string, bool) {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	key, ok := kh.keys[host]
+	return key, ok
+}
+
+// Add records key for host and appends it to the file. If host already has
+// a different key, Add returns a *KeyMismatchError.
+func (kh *KnownHosts) Add(host, key string) error {
+	if _, err := decodeServerKey(key); err != nil {
+		return err
+	}
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if known, ok := kh.keys[host]; ok {
+		if known != key {
+			return &KeyMismatchError{Host: host, File: kh.path, KnownKey: known, Keys: []string{key}}
+		}
+		return nil
+	}
+	return kh.append(host, key)
+}
+
+// append appends a line for host to the file. kh.mu must be held.
+func (kh *KnownHosts) append(host, key string) error {
+	f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("opening known hosts file: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", host, key); err != nil {
+		f.Close()
+		return fmt.Errorf("writing known hosts file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing known hosts file: %w", err)
+	}
+	kh.keys[host] = key
+	return nil
+}
+
+// Replace records key for host in place of its current key and rewrites the
+// file, keeping its other lines. A host without a recorded key is added. The
+// client never replaces a key on its own: call Replace after checking the
+// new key of a host out of band, for example once its server has rotated
+// its key.
+func (kh *KnownHosts) Replace(host, key string) error {
+	if _, err := decodeServerKey(key); err != nil {
+		return err
+	}
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+	if _, ok := kh.keys[host]; !ok {
+		return kh.append(host, key)
+	}
+
+	data, err := os.ReadFile(kh.path)
+	if err != nil {
+		return fmt.Errorf("reading known hosts file: %w", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == host {
+			lines[i] = host + " " + key + "\n"
+		}
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(kh.path), ".known_hosts-*")
+	if err != nil {
+		return fmt.Errorf("writing known hosts file: %w", err)
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+	_, err = f.WriteString(strings.Join(lines, ""))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), kh.path)
+	}
+	if err != nil {
+		return fmt.Errorf("writing known hosts file: %w", err)
+	}
+	kh.keys[host] = key
+	return nil
+}
+
+// checkKnownHost checks the keys announced in DNS for host against the
+// known hosts store and returns the keys to connect with, in order. No keys
+// means that DNS announced none. A host without a recorded key is dialed
+// with the keys from DNS; recordKnownHost records the one that connects.
+func (c *Client) checkKnownHost(host string, keys []string) ([]string, error) {
+	kh := c.knownHosts
+	if kh == nil {
+		return keys, nil
+	}
+
+	known, ok := kh.Lookup(host)
+	switch {
+	case !ok && len(keys) == 0:
+		if !c.insecureUnpinned {
+			return nil, &UnknownHostError{Host: host, File: kh.path}
+		}
+		slog.Warn("No server key in DNS, connecting to unpinned host without verifying it", "host", host)
+		return nil, nil
+	case !ok:
+		return keys, nil
+	case len(keys) == 0:
+		slog.Info("No server key in DNS, using known key", "host", host)
+		return []string{known}, nil
+	case !slices.Contains(keys, known):
+		return nil, &KeyMismatchError{Host: host, File: kh.path, KnownKey: known, Keys: keys}
+	default:
+		// Other keys DNS announces alongside the known one, such as a new
+		// key during a rotation, are not trusted until replaced by hand.
+		return []string{known}, nil
+	}
+}
+
+// pinPending reports whether host has no key recorded in the known hosts
+// store yet, so that recordKnownHost records the key of the next connection.
+// Hosts with a key configured with WithServerPublicKey or WithServerKeyFile
+// are never recorded.
+func (c *Client) pinPending(host string) bool {
+	if c.knownHosts == nil || c.serverKeys[strings.ToLower(host)] != nil {
+		return false
+	}
+	_, ok := c.knownHosts.Lookup(host)
+	return !ok
+}
+
+// recordKnownHost records key in the known hosts store once a connection to
+// host made with it has completed its handshake, if pinPending reports that
+// host has no key recorded yet. In-band key exchanges are not recorded.
+func (c *Client) recordKnownHost(host, key string) error {
+	if key == "" || !c.pinPending(host) {
+		return nil
+	}
+	kh := c.knownHosts
+	if err := kh.Add(host, key); err != nil {
+		return err
+	}
+	slog.Info("Recorded server key in known hosts", "host", host, "file", kh.path)
+	return nil
+}
@@ -0,0 +1,217 @@
+package qh
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKnownHosts(t *testing.T) {
+	key1, key2 := newServerKey(t), newServerKey(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := "# QH known hosts\n\nexample.com " + key1 + "\n  api.example.com\t" + key2 + "  \n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	kh, err := LoadKnownHosts(path)
+	require.NoError(t, err)
+
+	key, ok := kh.Lookup("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, key1, key)
+	key, ok = kh.Lookup("api.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, key2, key)
+	_, ok = kh.Lookup("other.example.com")
+	assert.False(t, ok)
+}
+
+func TestLoadKnownHostsErrors(t *testing.T) {
+	kh, err := LoadKnownHosts(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err, "a missing file is an empty store")
+	_, ok := kh.Lookup("example.com")
+	assert.False(t, ok)
+
+	for name, content := range map[string]string{
+		"missing key": "example.com\n",
+		"extra field": "example.com " + newServerKey(t) + " extra\n",
+		"invalid key": "example.com bm90IGEga2V5\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			require.NoError(t, os.WriteFile(path, []byte("# comment\n"+content), 0o600))
+			_, err := LoadKnownHosts(path)
+			require.ErrorContains(t, err, path+":2:")
+		})
+	}
+}
+
+func TestKnownHostsAdd(t *testing.T) {
+	key1, key2 := newServerKey(t), newServerKey(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	kh, err := LoadKnownHosts(path)
+	require.NoError(t, err)
+	require.NoError(t, kh.Add("example.com", key1))
+	require.NoError(t, kh.Add("example.com", key1), "adding the same key again is a no-op")
+	require.Error(t, kh.Add("bad.example.com", "bm90IGEga2V5"))
+
+	var mismatch *KeyMismatchError
+	require.ErrorAs(t, kh.Add("example.com", key2), &mismatch)
+	assert.Equal(t, key1, mismatch.KnownKey)
+	assert.Equal(t, []string{key2}, mismatch.Keys)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com "+key1+"\n", string(data))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	reloaded, err := LoadKnownHosts(path)
+	require.NoError(t, err)
+	key, ok := reloaded.Lookup("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, key1, key)
+}
+
+func TestKnownHostsReplace(t *testing.T) {
+	key1, key2 := newServerKey(t), newServerKey(t)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+
+	kh, err := LoadKnownHosts(path)
+	require.NoError(t, err)
+	require.NoError(t, kh.Replace("example.com", key1), "a host without a key is added")
+	require.NoError(t, kh.Add("api.example.com", key1))
+	require.NoError(t, kh.Replace("example.com", key2))
+	require.Error(t, kh.Replace("example.com", "bm90IGEga2V5"))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "example.com "+key2+"\napi.example.com "+key1+"\n", string(data))
+
+	reloaded, err := LoadKnownHosts(path)
+	require.NoError(t, err)
+	key, ok := reloaded.Lookup("example.com")
+	assert.True(t, ok)
+	assert.Equal(t, key2, key)
+}
+
+func TestClientKnownHosts(t *testing.T) {
+	port, keys := newKeyedPoolTestServer(t, "hello", "pinned", "other", "rotated")
+	target := net.JoinHostPort("qh.test", strconv.Itoa(port))
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	pinnedKey, otherKey, rotatedKey := keys[0], keys[1], keys[2]
+
+	// connect connects a new client that sees dnsKeys in DNS and returns the
+	// key its connection was dialed with.
+	connect := func(t *testing.T, opts []ClientOption, dnsKeys ...string) (string, error) {
+		t.Helper()
+		kh, err := LoadKnownHosts(path)
+		require.NoError(t, err)
+		resolver := &StaticResolver{
+			Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+			TXT:   map[string][]string{},
+		}
+		for _, key := range dnsKeys {
+			resolver.TXT["_qotp.qh.test"] = append(resolver.TXT["_qotp.qh.test"], formatKeyRecord(key))
+		}
+		client := NewClient(append([]ClientOption{WithResolver(resolver), WithKnownHosts(kh)}, opts...)...)
+		client.handshakeTimeout = 300 * time.Millisecond
+		t.Cleanup(func() { client.Close() })
+
+		if err := client.ConnectContext(context.Background(), target); err != nil {
+			return "", err
+		}
+		return defaultConn(t, client).key.pubKey, nil
+	}
+
+	t.Run("NoKeyFails", func(t *testing.T) {
+		_, err := connect(t, nil)
+		var unknown *UnknownHostError
+		require.ErrorAs(t, err, &unknown)
+		assert.Equal(t, "qh.test", unknown.Host)
+		assert.Equal(t, path, unknown.File)
+		assert.NoFileExists(t, path)
+	})
+
+	t.Run("NoKeyInsecure", func(t *testing.T) {
+		key, err := connect(t, []ClientOption{WithInsecureUnpinnedHosts()})
+		require.NoError(t, err)
+		assert.Empty(t, key)
+		assert.NoFileExists(t, path)
+	})
+
+	t.Run("FirstContactRecordsConnectedKey", func(t *testing.T) {
+		// A key the server does not hold must not be pinned.
+		key, err := connect(t, nil, newServerKey(t), pinnedKey, otherKey)
+		require.NoError(t, err)
+		assert.Equal(t, pinnedKey, key)
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "qh.test "+pinnedKey+"\n", string(data))
+	})
+
+	t.Run("SameKeyConnects", func(t *testing.T) {
+		key, err := connect(t, nil, pinnedKey)
+		require.NoError(t, err)
+		assert.Equal(t, pinnedKey, key)
+	})
+
+	t.Run("KnownKeyListedSecondConnects", func(t *testing.T) {
+		key, err := connect(t, nil, pinnedKey, otherKey)
+		require.NoError(t, err)
+		assert.Equal(t, pinnedKey, key)
+	})
+
+	t.Run("NewKeyIsNotTrusted", func(t *testing.T) {
+		content := "# pinned\nother.test " + otherKey + "\nqh.test " + pinnedKey + "\n"
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		key, err := connect(t, nil, rotatedKey, pinnedKey)
+		require.NoError(t, err)
+		assert.Equal(t, pinnedKey, key, "a key listed before the known one must not replace it")
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	})
+
+	t.Run("ReplaceUpdatesKnownKey", func(t *testing.T) {
+		kh, err := LoadKnownHosts(path)
+		require.NoError(t, err)
+		require.NoError(t, kh.Replace("qh.test", rotatedKey))
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "# pinned\nother.test "+otherKey+"\nqh.test "+rotatedKey+"\n", string(data))
+
+		key, err := connect(t, nil, rotatedKey, pinnedKey)
+		require.NoError(t, err)
+		assert.Equal(t, rotatedKey, key)
+	})
+
+	t.Run("MissingDNSKeyUsesKnownKey", func(t *testing.T) {
+		key, err := connect(t, nil)
+		require.NoError(t, err)
+		assert.Equal(t, rotatedKey, key, "must not fall back to an in-band key exchange")
+	})
+
+	t.Run("ChangedKeyFails", func(t *testing.T) {
+		_, err := connect(t, nil, otherKey)
+		var mismatch *KeyMismatchError
+		require.ErrorAs(t, err, &mismatch)
+		assert.Equal(t, "qh.test", mismatch.Host)
+		assert.Equal(t, path, mismatch.File)
+		assert.Equal(t, rotatedKey, mismatch.KnownKey)
+		assert.Equal(t, []string{otherKey}, mismatch.Keys)
+		assert.Contains(t, err.Error(), "does not match")
+	})
+}
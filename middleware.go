@@ -0,0 +1,209 @@
+package qh
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a Handler to run code before and after it, or instead of
+// it.
+type Middleware func(Handler) Handler
+
+// requestIDHeader carries the request ID in both directions.
+const requestIDHeader = "x-request-id"
+
+// serverTimingHeader reports the handler duration to the client.
+const serverTimingHeader = "server-timing"
+
+type requestIDKey struct{}
+
+// chain wraps h in the given middleware. The first middleware is the
+// outermost one and runs first.
+func chain(h Handler, mw []Middleware) Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Recovery returns middleware that recovers from panics in the handler. If
+// the response head has not been sent yet, the response is replaced by a
+// 500 Internal Server Error; otherwise the stream is closed so the client
+// sees an incomplete response instead of a truncated one.
+func Recovery() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				slog.Error("Handler panicked", "method", r.Method.String(), "path", r.Path,
+					"panic", v, "stack", string(debug.Stack()))
+				if !discardResponse(w) {
+					return
+				}
+				w.Header().Set("content-type", "text/plain")
+				w.WriteHeader(StatusInternalServerError)
+				_, _ = w.Write([]byte("Internal Server Error"))
+			}()
+			next.ServeQH(ctx, w, r)
+		})
+	}
+}
+
+// RequestID returns middleware that assigns every request an ID. The ID
+// sent by the client in the x-request-id header is kept; otherwise a random
+// one is generated. The ID is echoed in the response and available to the
+// handler through RequestIDFromContext.
+func RequestID() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			id := r.Headers.Get(requestIDHeader)
+			if id == "" {
+				id = newRequestID()
+			}
+			w.Header().Set(requestIDHeader, id)
+			next.ServeQH(context.WithValue(ctx, requestIDKey{}, id), w, r)
+		})
+	}
+}
+
+// RequestIDFromContext returns the ID assigned by the RequestID middleware,
+// or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// AccessLog returns middleware that logs every request with its status,
+// response size and duration once the handler has returned. If logger is
+// nil, slog.Default() is used.
+func AccessLog(logger *slog.Logger) Middleware {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			start := time.Now()
+			rec := &recordingWriter{ResponseWriter: w}
+			next.ServeQH(ctx, rec, r)
+
+			attrs := []any{
+				"method", r.Method.String(),
+				"host", r.Host,
+				"path", r.Path,
+				"status", rec.statusCode(),
+				"bytes", rec.bytes,
+				"duration", time.Since(start),
+			}
+			if id := RequestIDFromContext(ctx); id != "" {
+				attrs = append(attrs, "request_id", id)
+			}
+			logger.Info("Request handled", attrs...)
+		})
+	}
+}
+
+// Timing returns middleware that reports the time spent in the handler in a
+// server-timing response header. For a streamed response the header is set
+// when the head is flushed.
+func Timing() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			tw := &timingWriter{ResponseWriter: w, start: time.Now()}
+			next.ServeQH(ctx, tw, r)
+			tw.setHeader()
+		})
+	}
+}
+
+// discarder is implemented by response writers that can drop a response
+// which is being built.
+type discarder interface {
+	// discard drops the buffered response and reports true if its head has
+	// not been sent yet. Otherwise it ends the response as incomplete and
+	// reports false.
+	discard() bool
+}
+
+// discardResponse drops the response being built through w. Writers that
+// cannot discard are assumed not to have sent anything yet.
+func discardResponse(w ResponseWriter) bool {
+	if d, ok := w.(discarder); ok {
+		return d.discard()
+	}
+	return true
+}
+
+// recordingWriter records the status and the number of body bytes written.
+type recordingWriter struct {
+	ResponseWriter
+	status int
+	bytes  int
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += n
+	return n, err
+}
+
+func (w *recordingWriter) discard() bool {
+	w.status, w.bytes = 0, 0
+	return discardResponse(w.ResponseWriter)
+}
+
+func (w *recordingWriter) statusCode() int {
+	if w.status == 0 {
+		return StatusOK
+	}
+	return w.status
+}
+
+// timingWriter sets the server-timing header before the head is sent.
+type timingWriter struct {
+	ResponseWriter
+	start   time.Time
+	flushed bool
+}
+
+func (w *timingWriter) Flush() error {
+	w.setHeader()
+	return w.ResponseWriter.Flush()
+}
+
+func (w *timingWriter) discard() bool {
+	w.flushed = false
+	return discardResponse(w.ResponseWriter)
+}
+
+func (w *timingWriter) setHeader() {
+	if w.flushed {
+		return
+	}
+	w.flushed = true
+	ms := float64(time.Since(w.start)) / float64(time.Millisecond)
+	w.Header().Set(serverTimingHeader, fmt.Sprintf("app;dur=%.3f", ms))
+}
+
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:]) // crypto/rand.Read never returns an error
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,160 @@
+package qh
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testResponseWriter collects a response in memory.
+type testResponseWriter struct {
+	status  int
+	headers Header
+	body    []byte
+	flushed bool
+}
+
+func newTestResponseWriter() *testResponseWriter {
+	return &testResponseWriter{headers: make(Header)}
+}
+
+func (w *testResponseWriter) Header() Header { return w.headers }
+
+func (w *testResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+func (w *testResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(StatusOK)
+	w.body = append(w.body, data...)
+	return len(data), nil
+}
+
+func (w *testResponseWriter) Flush() error {
+	w.WriteHeader(StatusOK)
+	w.flushed = true
+	return nil
+}
+
+func (w *testResponseWriter) discard() bool {
+	if w.flushed {
+		return false
+	}
+	w.status = 0
+	clear(w.headers)
+	w.body = nil
+	return true
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+				order = append(order, name)
+				next.ServeQH(ctx, w, r)
+			})
+		}
+	}
+	h := chain(HandlerFunc(func(context.Context, ResponseWriter, *Request) {
+		order = append(order, "handler")
+	}), []Middleware{mark("first"), mark("second")})
+
+	h.ServeQH(context.Background(), newTestResponseWriter(), &Request{})
+	assert.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestRecovery(t *testing.T) {
+	panicking := HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+		w.Header().Set("x-partial", "yes")
+		_, _ = w.Write([]byte("partial"))
+		panic("boom")
+	})
+
+	t.Run("Buffered", func(t *testing.T) {
+		w := newTestResponseWriter()
+		Recovery()(panicking).ServeQH(context.Background(), w, &Request{Path: "/"})
+
+		assert.Equal(t, StatusInternalServerError, w.status)
+		assert.Equal(t, "Internal Server Error", string(w.body))
+		assert.Equal(t, Header{"content-type": {"text/plain"}}, w.headers)
+	})
+
+	t.Run("AlreadyFlushed", func(t *testing.T) {
+		w := newTestResponseWriter()
+		h := Recovery()(HandlerFunc(func(ctx context.Context, w ResponseWriter, r *Request) {
+			_ = w.Flush()
+			panicking(ctx, w, r)
+		}))
+		h.ServeQH(context.Background(), w, &Request{Path: "/"})
+
+		assert.Equal(t, StatusOK, w.status)
+		assert.Equal(t, "partial", string(w.body))
+	})
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	h := RequestID()(HandlerFunc(func(ctx context.Context, _ ResponseWriter, _ *Request) {
+		seen = RequestIDFromContext(ctx)
+	}))
+
+	w := newTestResponseWriter()
+	h.ServeQH(context.Background(), w, &Request{Headers: Header{}})
+	assert.Len(t, seen, 32)
+	assert.Equal(t, seen, w.headers.Get(requestIDHeader))
+
+	w = newTestResponseWriter()
+	h.ServeQH(context.Background(), w, &Request{Headers: Header{requestIDHeader: {"abc"}}})
+	assert.Equal(t, "abc", seen)
+	assert.Equal(t, "abc", w.headers.Get(requestIDHeader))
+
+	assert.Empty(t, RequestIDFromContext(context.Background()))
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	h := chain(ResponseFunc(func(*Request) *Response {
+		return TextResponse(StatusNotFound, "missing")
+	}), []Middleware{RequestID(), AccessLog(logger)})
+
+	req := &Request{Method: GET, Host: "example.com", Path: "/x", Headers: Header{requestIDHeader: {"id-1"}}}
+	h.ServeQH(context.Background(), newTestResponseWriter(), req)
+
+	line := buf.String()
+	assert.Contains(t, line, "method=GET")
+	assert.Contains(t, line, "path=/x")
+	assert.Contains(t, line, "status=404")
+	assert.Contains(t, line, "bytes=7")
+	assert.Contains(t, line, "request_id=id-1")
+}
+
+func TestTiming(t *testing.T) {
+	t.Run("Buffered", func(t *testing.T) {
+		w := newTestResponseWriter()
+		Timing()(HandlerFunc(func(_ context.Context, w ResponseWriter, _ *Request) {
+			_, _ = w.Write([]byte("ok"))
+		})).ServeQH(context.Background(), w, &Request{})
+		assert.Regexp(t, `^app;dur=\d+\.\d{3}$`, w.headers.Get(serverTimingHeader))
+	})
+
+	t.Run("Flushed", func(t *testing.T) {
+		w := newTestResponseWriter()
+		var atFlush string
+		Timing()(HandlerFunc(func(_ context.Context, rw ResponseWriter, _ *Request) {
+			require.NoError(t, rw.Flush())
+			atFlush = w.headers.Get(serverTimingHeader)
+			_, _ = rw.Write([]byte("ok"))
+		})).ServeQH(context.Background(), w, &Request{})
+		assert.NotEmpty(t, atFlush)
+		assert.Equal(t, atFlush, w.headers.Get(serverTimingHeader))
+	})
+}
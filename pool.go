@@ -0,0 +1,890 @@
+package qh
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qo-proto/qotp"
+)
+
+const (
+	// DefaultPort is the port of a qh URI without an explicit port.
+	DefaultPort = 8090
+
+	defaultMaxIdleTime = 90 * time.Second
+
+	// connectionAttemptDelay is how long a connection attempt gets before the
+	// next address is tried in parallel, as recommended by RFC 8305.
+	connectionAttemptDelay = 250 * time.Millisecond
+	// defaultHandshakeTimeout bounds the wait for the server's reply to the
+	// key exchange of a connection attempt, or to the first request of a
+	// 0-RTT connection that was sent without waiting for it.
+	defaultHandshakeTimeout = 5 * time.Second
+)
+
+// WithMaxIdleTime sets how long a pooled connection may go without requests
+// before it is closed. Zero keeps idle connections open until Close.
+// Default is 90 seconds.
+func WithMaxIdleTime(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.maxIdleTime = d
+	}
+}
+
+// connKey identifies a pooled connection by the endpoint it was dialed to and
+// the server key it was dialed with. A connection dialed without a key from
+// DNS cannot be verified for other origins, so its key also carries the
+// origin and it is never shared.
+type connKey struct {
+	addr   string // resolved "ip:port"
+	pubKey string // base64 server public key from DNS or configured, "" for an in-band key exchange
+	origin string // "host:port" the connection was dialed for, set only if pubKey is not from DNS
+}
+
+// clientConn is a QOTP connection to a server endpoint, with its own listener
+// and read loop. It serves every origin the pool has assigned to it.
+type clientConn struct {
+	key              connKey
+	listener         *qotp.Listener
+	conn             *qotp.Conn
+	streamID         atomic.Uint32
+	maxResponseSize  int
+	handshakeTimeout time.Duration // bounds the wait for the server's first reply
+
+	// Guarded by Client.poolMu.
+	active    int       // requests currently using the connection
+	idleSince time.Time // when active last dropped to zero
+
+	mu       sync.Mutex
+	pending  map[*qotp.Stream]*pendingResponse // in-flight requests, keyed by the stream they were sent on
+	loopErr  error                             // set once the read loop has stopped
+	loopDone chan struct{}                     // closed when the read loop goroutine exits
+
+	established chan struct{} // closed when the first packet from the server has arrived
+}
+
+// getConn returns a connection for origin ("host:port") and marks it in use
+// until releaseConn is called.
+//
+// A connection is reused for another origin only if the origin resolves to
+// the same address and DNS announces the key the connection was made with
+// for it, so the server is known to be authoritative for both. Connections
+// that were lost are dropped from the pool and dialed again.
+//
+// New connections are attempted for each key in the order DNS announced
+// them, across all resolved addresses, see dialAddrs.
+func (c *Client) getConn(ctx context.Context, origin string) (*clientConn, error) {
+	for {
+		// Dial one connection per origin at a time, so concurrent requests
+		// to a new origin share a single connection, while dials to other
+		// origins go ahead.
+		c.poolMu.Lock()
+		if cc := c.lookupConn(origin); cc != nil {
+			c.poolMu.Unlock()
+			return cc, nil
+		}
+		call, dialing := c.dials[origin]
+		if !dialing {
+			call = &dialCall{done: make(chan struct{})}
+			if c.dials == nil {
+				c.dials = make(map[string]*dialCall)
+			}
+			c.dials[origin] = call
+		}
+		c.poolMu.Unlock()
+
+		if !dialing {
+			cc, err := c.dialOrigin(ctx, origin)
+			c.poolMu.Lock()
+			delete(c.dials, origin)
+			c.poolMu.Unlock()
+			call.err = err
+			call.cancelled = ctx.Err() != nil
+			close(call.done)
+			return cc, err
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, contextError(ctx, "connect")
+		}
+		// A dial given up by its own caller is tried again; otherwise the
+		// new connection is in the pool, or the dial failed for everyone.
+		if call.err != nil && !call.cancelled {
+			return nil, call.err
+		}
+	}
+}
+
+// dialCall is a dial to an origin that concurrent requests wait for.
+type dialCall struct {
+	done      chan struct{} // closed when the dial has finished
+	err       error
+	cancelled bool // the context of the dialing request was done
+}
+
+// dialOrigin resolves origin and connects to it, or reuses a pooled
+// connection to the same server, and adds the connection to the pool marked
+// in use.
+func (c *Client) dialOrigin(ctx context.Context, origin string) (*clientConn, error) {
+	host, port, err := splitHostPort(origin)
+	if err != nil {
+		return nil, err
+	}
+	ips, pubKeys, fromDNS, err := c.resolveDNS(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	}
+
+	// Only a key announced in DNS for origin vouches for a connection made
+	// for another origin (spec §7.2.2), not one from the known hosts store
+	// or configured for the host.
+	if fromDNS {
+		if cc := c.lookupServerConn(origin, addrs, pubKeys); cc != nil {
+			return cc, nil
+		}
+	}
+
+	// Try the keys in the order DNS announced them.
+	if len(pubKeys) == 0 {
+		pubKeys = []string{""}
+	}
+	owner := origin
+	if fromDNS {
+		owner = ""
+	}
+	// With a single key and address there is nothing to fall back to, so a
+	// 0-RTT connection sends its first request with the key exchange rather
+	// than after the server's reply. roundTrip then bounds the wait for the
+	// reply. A key still to be recorded in the known hosts store is only
+	// used once the server has replied.
+	awaitReply := len(pubKeys) > 1 || len(addrs) > 1 || pubKeys[0] == "" || c.pinPending(host)
+	var cc *clientConn
+	var errs []error
+	for _, pubKey := range pubKeys {
+		cc, err = c.dialAddrs(ctx, addrs, pubKey, owner, awaitReply)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "connect")
+		}
+		errs = append(errs, err)
+	}
+	if cc == nil {
+		return nil, errors.Join(errs...)
+	}
+	if err := c.recordKnownHost(host, cc.key.pubKey); err != nil {
+		_ = cc.close()
+		return nil, err
+	}
+	key := cc.key
+	slog.Info("Connected to QH server", "origin", origin, "resolved", key.addr)
+
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[connKey]*clientConn)
+		c.origins = make(map[string]*clientConn)
+	}
+	if old := c.conns[key]; old != nil {
+		c.removeConn(old)
+		go old.close()
+	}
+	c.conns[key] = cc
+	c.origins[origin] = cc
+	c.acquire(cc)
+	return cc, nil
+}
+
+// lookupServerConn returns a pooled connection to one of addrs made with one
+// of pubKeys, marked in use and added to the pool for origin, or nil if
+// there is none.
+func (c *Client) lookupServerConn(origin string, addrs, pubKeys []string) *clientConn {
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	for _, pubKey := range pubKeys {
+		for _, addr := range addrs {
+			if cc := c.conns[connKey{addr: addr, pubKey: pubKey}]; cc != nil && cc.alive() {
+				slog.Info("Reusing connection for origin", "origin", origin, "addr", addr)
+				c.origins[origin] = cc
+				c.acquire(cc)
+				return cc
+			}
+		}
+	}
+	return nil
+}
+
+// lookupConn returns the connection serving origin, marked in use, or nil if
+// there is none. A connection whose read loop has stopped is removed from
+// the pool, so that the caller reconnects. poolMu must be held.
+func (c *Client) lookupConn(origin string) *clientConn {
+	cc := c.origins[origin]
+	if cc == nil {
+		return nil
+	}
+	if !cc.alive() {
+		slog.Info("Connection lost, reconnecting", "origin", origin, "addr", cc.key.addr)
+		c.removeConn(cc)
+		go cc.close()
+		return nil
+	}
+	c.acquire(cc)
+	return cc
+}
+
+// resolveDNS resolves host to its IP addresses and, concurrently, looks up the
+// server keys announced for it in DNS, see lookupPubKeys. Without a valid
+// key, the connection falls back to an in-band key exchange, unless the
+// known hosts store has a key for host. A key configured for host with
+// WithServerPublicKey or WithServerKeyFile replaces the DNS lookup. fromDNS
+// reports whether the returned keys were announced in DNS.
+func (c *Client) resolveDNS(ctx context.Context, host string) (_ []net.IP, _ []string, fromDNS bool, _ error) {
+	if serverKey := c.serverKeys[strings.ToLower(host)]; serverKey != nil {
+		ips, pubKeys, err := c.resolveWithServerKey(ctx, host, serverKey)
+		return ips, pubKeys, false, err
+	}
+
+	trace := ContextClientTrace(ctx)
+	trace.dnsStart(DNSStartInfo{Host: host})
+	var ips []net.IP
+	var pubKeys []string
+	var ipLookupErr error
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		ips, ipLookupErr = resolveAddrs(ctx, c.resolver, host)
+		trace.dnsDone(DNSDoneInfo{Addrs: ips, Err: ipLookupErr})
+	}()
+
+	go func() {
+		defer wg.Done()
+		// This function handles errors internally and just logs them,
+		// as failing to find a key is not a critical connection error.
+		pubKeys = lookupPubKeys(ctx, c.resolver, host)
+	}()
+
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, nil, false, contextError(ctx, "connect")
+	}
+	if ipLookupErr != nil {
+		return nil, nil, false, ipLookupErr
+	}
+	// The known hosts store returns a subset of the DNS keys, or its own
+	// key if DNS announced none.
+	fromDNS = len(pubKeys) > 0
+	pubKeys, err := c.checkKnownHost(host, pubKeys)
+	trace.keyLookupDone(KeyLookupDoneInfo{Host: host, Keys: pubKeys, Err: err})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return ips, pubKeys, fromDNS, nil
+}
+
+// resolveWithServerKey resolves host to its IP addresses and returns them
+// with the configured server key.
+func (c *Client) resolveWithServerKey(ctx context.Context, host string, serverKey func() (string, error)) ([]net.IP, []string, error) {
+	trace := ContextClientTrace(ctx)
+	key, err := serverKey()
+	if err == nil {
+		if _, decodeErr := decodeServerKey(key); decodeErr != nil {
+			err = fmt.Errorf("invalid server key: %w", decodeErr)
+		}
+	}
+	if err != nil {
+		trace.keyLookupDone(KeyLookupDoneInfo{Host: host, Err: err})
+		return nil, nil, err
+	}
+	trace.keyLookupDone(KeyLookupDoneInfo{Host: host, Keys: []string{key}})
+
+	trace.dnsStart(DNSStartInfo{Host: host})
+	ips, err := resolveAddrs(ctx, c.resolver, host)
+	trace.dnsDone(DNSDoneInfo{Addrs: ips, Err: err})
+	if ctx.Err() != nil {
+		return nil, nil, contextError(ctx, "connect")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return ips, []string{key}, nil
+}
+
+// dialAddrs connects to the first of addrs that answers, using pubKey for a
+// 0-RTT connection or an in-band key exchange if it is empty. The attempts
+// are staggered Happy Eyeballs style (RFC 8305): each address gets
+// connectionAttemptDelay before the next one is tried in parallel, and a
+// failed attempt starts the next one at once. If all attempts fail, the
+// error joins the errors of all of them. owner is the origin a connection
+// that must not be shared is dialed for, or empty if pubKey is from DNS.
+// awaitReply is passed on to dialAddr.
+func (c *Client) dialAddrs(ctx context.Context, addrs []string, pubKey, owner string, awaitReply bool) (*clientConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		cc  *clientConn
+		err error
+	}
+	results := make(chan result, len(addrs))
+	next, running := 0, 0
+	startNext := func() {
+		key := connKey{addr: addrs[next], pubKey: pubKey, origin: owner}
+		next++
+		running++
+		go func() {
+			cc, err := c.dialAddr(ctx, key, awaitReply)
+			results <- result{cc: cc, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+	var errs []error
+	for running > 0 {
+		select {
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// Attempts still running give up once ctx is cancelled; close
+				// any that connected in the meantime.
+				go func(n int) {
+					for range n {
+						if r := <-results; r.cc != nil {
+							_ = r.cc.close()
+						}
+					}
+				}(running)
+				return r.cc, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				startNext()
+				timer.Reset(connectionAttemptDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				startNext()
+				timer.Reset(connectionAttemptDelay)
+			}
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// dialAddr makes a single connection attempt. The key exchange is started
+// right away, and if awaitReply is set, the attempt succeeds once the server
+// has replied to it. A server that does not hold the key of a 0-RTT
+// connection cannot decrypt the first packet and never replies, so a stale
+// key fails like an address that does not answer. Otherwise the attempt
+// succeeds at once, and the first request is sent without waiting.
+func (c *Client) dialAddr(ctx context.Context, key connKey, awaitReply bool) (_ *clientConn, err error) {
+	trace := ContextClientTrace(ctx)
+	trace.connectStart(key.addr)
+	defer func() { trace.connectDone(key.addr, err) }()
+
+	if err = checkRoute(key.addr); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", key.addr, err)
+	}
+	cc, err := c.dial(key)
+	if err != nil {
+		return nil, err
+	}
+	if !awaitReply {
+		return cc, nil
+	}
+
+	timer := time.NewTimer(c.handshakeTimeout)
+	defer timer.Stop()
+	select {
+	case <-cc.established:
+		return cc, nil
+	case <-cc.loopDone:
+		return nil, fmt.Errorf("failed to connect to %s: %w", key.addr, cc.loopErr)
+	case <-timer.C:
+		_ = cc.close()
+		return nil, fmt.Errorf("failed to connect to %s: no reply to key exchange within %v", key.addr, c.handshakeTimeout)
+	case <-ctx.Done():
+		_ = cc.close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", key.addr, contextError(ctx, "connect"))
+	}
+}
+
+// checkRoute reports an error if the host has no route to addr, such as an
+// IPv6 address on a host without IPv6 connectivity. No packet is sent.
+func checkRoute(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// interleaveAddrs orders ips for connection attempts as described in RFC 8305
+// section 4: alternating between IPv6 and IPv4, starting with the family of
+// the first address, which the resolver has sorted by preference.
+func interleaveAddrs(ips []net.IP) []net.IP {
+	var first, second []net.IP
+	for _, ip := range ips {
+		if (ip.To4() == nil) == (ips[0].To4() == nil) {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := range max(len(first), len(second)) {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// dial opens a new connection for key and starts its read loop. The key
+// exchange, in-band or 0-RTT, is started right away on stream 0, which the
+// first request then uses.
+func (c *Client) dial(key connKey) (*clientConn, error) {
+	// create local listener (auto generates keys)
+	opts := []qotp.ListenFunc{}
+	c.addKeyLogWriter(&opts)
+	listener, err := qotp.Listen(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create listener: %w", err)
+	}
+
+	var conn *qotp.Conn
+	if key.pubKey != "" {
+		// Out-of-band key exchange (0-RTT)
+		slog.Info("Attempting connection with out-of-band key (0-RTT)")
+		pubKeyHex, _ := decodeServerKey(key.pubKey) // validated by resolveDNS
+		conn, err = listener.DialWithCryptoString(key.addr, pubKeyHex)
+	} else {
+		// In-band key exchange
+		slog.Info("No DNS key found, attempting connection with in-band key exchange")
+		conn, err = listener.DialString(key.addr)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("failed to connect to %s: %w", key.addr, err)
+	}
+	// A stream without data sends the key exchange on the next flush.
+	// Flush now, before the read loop takes over the listener.
+	conn.Stream(0)
+	listener.Flush(uint64(time.Now().UnixNano()))
+
+	cc := &clientConn{
+		key:              key,
+		listener:         listener,
+		conn:             conn,
+		maxResponseSize:  c.maxResponseSize,
+		handshakeTimeout: c.handshakeTimeout,
+		pending:          make(map[*qotp.Stream]*pendingResponse),
+		loopDone:         make(chan struct{}),
+		established:      make(chan struct{}),
+	}
+	go cc.readLoop()
+	return cc, nil
+}
+
+// decodeServerKey decodes a base64 X25519 server public key into the hex
+// form expected by QOTP.
+func decodeServerKey(pubKey string) (string, error) {
+	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubKey)
+	if err != nil {
+		return "", fmt.Errorf("decoding base64 public key: %w", err)
+	}
+	if len(pubKeyBytes) != x25519KeySize {
+		return "", fmt.Errorf("invalid public key length: expected %d bytes, got %d", x25519KeySize, len(pubKeyBytes))
+	}
+	return hex.EncodeToString(pubKeyBytes), nil
+}
+
+// releaseConn marks a connection returned by getConn as no longer used by
+// the caller. Once it is idle, it is closed after maxIdleTime.
+func (c *Client) releaseConn(cc *clientConn) {
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	cc.active--
+	if cc.active == 0 {
+		cc.idleSince = time.Now()
+		if c.maxIdleTime > 0 {
+			time.AfterFunc(c.maxIdleTime, func() { c.evictIdle(cc) })
+		}
+	}
+}
+
+// acquire marks cc as in use. poolMu must be held.
+func (c *Client) acquire(cc *clientConn) {
+	cc.active++
+}
+
+// evictIdle closes cc if it is still in the pool and has been idle for
+// maxIdleTime. A streamed response body that is still being received keeps
+// the connection open.
+func (c *Client) evictIdle(cc *clientConn) {
+	c.poolMu.Lock()
+	if c.conns[cc.key] != cc || cc.active > 0 {
+		c.poolMu.Unlock()
+		return
+	}
+	if idle := time.Since(cc.idleSince); idle < c.maxIdleTime {
+		c.poolMu.Unlock()
+		return // used again since; a later timer takes care of it
+	}
+	if cc.busy() {
+		time.AfterFunc(c.maxIdleTime, func() { c.evictIdle(cc) })
+		c.poolMu.Unlock()
+		return
+	}
+	c.removeConn(cc)
+	c.poolMu.Unlock()
+
+	slog.Info("Closing idle connection", "addr", cc.key.addr)
+	_ = cc.close()
+}
+
+// removeConn removes cc and all origins it serves from the pool. poolMu must
+// be held.
+func (c *Client) removeConn(cc *clientConn) {
+	if c.conns[cc.key] == cc {
+		delete(c.conns, cc.key)
+	}
+	for origin, other := range c.origins {
+		if other == cc {
+			delete(c.origins, origin)
+		}
+	}
+}
+
+// close closes the connection and waits for its read loop to fail any
+// in-flight requests.
+func (cc *clientConn) close() error {
+	cc.conn.Close()
+	err := cc.listener.Close()
+	<-cc.loopDone
+	return err
+}
+
+// alive reports whether the read loop of the connection is still running.
+func (cc *clientConn) alive() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.loopErr == nil
+}
+
+// busy reports whether requests are waiting for data on the connection.
+func (cc *clientConn) busy() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return len(cc.pending) > 0
+}
+
+// roundTrip sends req on a new stream and waits for the response. If stream
+// is set, it returns once the response head has arrived, with the body
+// delivered through resp.BodyReader. If ctx is done first, the stream is
+// closed and the request abandoned.
+func (cc *clientConn) roundTrip(ctx context.Context, req *Request, stream bool) (*Response, error) {
+	if ctx.Err() != nil {
+		return nil, contextError(ctx, "request")
+	}
+
+	// Get next available stream ID
+	currentStreamID := cc.streamID.Add(1) - 1
+
+	s := cc.conn.Stream(currentStreamID)
+	trace := ContextClientTrace(ctx)
+	pending, err := cc.addPending(s, stream, trace)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing the stream makes pending writes fail and lets the server
+	// cancel the handler.
+	stop := context.AfterFunc(ctx, s.Close)
+	defer stop()
+
+	if req.BodyReader != nil {
+		slog.Debug("Sending streamed request", "stream_id", currentStreamID)
+		err = writeChunked(s, req.appendHead(nil, true), req.BodyReader)
+	} else {
+		requestData := req.Format()
+		slog.Debug("Sending request", "stream_id", currentStreamID, "bytes", len(requestData))
+		err = writeAll(s, requestData)
+	}
+	trace.wroteRequest(WroteRequestInfo{Err: err})
+	if err != nil {
+		cc.removePending(s)
+		if ctx.Err() != nil {
+			return nil, contextError(ctx, "request")
+		}
+		return nil, &transportError{fmt.Errorf("failed to send request: %w", err)}
+	}
+
+	// A connection dialed without waiting for the server, see dialAddr, is
+	// given up if the server does not reply in time, as a server that does
+	// not hold the key never replies.
+	var established <-chan struct{}
+	var noReply <-chan time.Time
+	select {
+	case <-cc.established:
+	default:
+		established = cc.established
+		timer := time.NewTimer(cc.handshakeTimeout)
+		defer timer.Stop()
+		noReply = timer.C
+	}
+
+	for {
+		select {
+		case result := <-pending.done:
+			return result.resp, result.err
+		case <-established:
+			established, noReply = nil, nil
+		case <-noReply:
+			cc.failPending(&transportError{fmt.Errorf("failed to connect to %s: no reply to key exchange within %v",
+				cc.key.addr, cc.handshakeTimeout)})
+			go cc.close()
+			result := <-pending.done
+			return result.resp, result.err
+		case <-ctx.Done():
+			cc.removePending(s)
+			slog.Debug("Request abandoned", "stream_id", currentStreamID, "error", ctx.Err())
+			return nil, contextError(ctx, "request")
+		}
+	}
+}
+
+// readLoop drives the QOTP listener of the connection and dispatches
+// incoming stream data to the pending requests.
+func (cc *clientConn) readLoop() {
+	defer close(cc.loopDone)
+
+	established := false
+	paused := make(map[*qotp.Stream]bool) // streams left unread until their body reader catches up
+	cc.listener.Loop(func(s *qotp.Stream) (bool, error) {
+		for p := range paused {
+			cc.readStream(paused, p)
+		}
+		if s == nil {
+			return true, nil
+		}
+		if !established {
+			established = true
+			close(cc.established)
+		}
+		if !paused[s] {
+			cc.readStream(paused, s)
+		}
+		return true, nil
+	})
+
+	cc.failPending(&transportError{errors.New("connection closed")})
+}
+
+// readStream passes the data available on stream s to the request waiting on
+// it. Reading stops while the caller of a streamed response has
+// maxResponseSize or more body bytes left to read: the data then stays in
+// the QOTP receive buffer, whose flow control holds back the server, and the
+// stream is read again on a later loop iteration.
+func (cc *clientConn) readStream(paused map[*qotp.Stream]bool, s *qotp.Stream) {
+	delete(paused, s)
+
+	// Read returns one in-order segment at a time, so drain everything
+	// that is available; segments held back by a gap would otherwise
+	// stay buffered until the next packet arrives on this stream.
+	for {
+		if cc.bodyBuffered(s) >= cc.maxResponseSize {
+			paused[s] = true
+			return
+		}
+
+		chunk, err := s.Read()
+		if len(chunk) > 0 {
+			slog.Debug("Received chunk from server", "stream_id", s.StreamID(), "bytes", len(chunk))
+			cc.dispatch(s, chunk)
+		}
+		if err != nil {
+			slog.Debug("Read error in response loop", "stream_id", s.StreamID(), "error", err)
+			cc.completePending(s, nil, &transportError{
+				fmt.Errorf("stream closed before response was complete: %w", err),
+			})
+			return
+		}
+		if len(chunk) == 0 {
+			return
+		}
+	}
+}
+
+// bodyBuffered returns the number of body bytes of the streamed response on
+// stream s that its caller has not read yet.
+func (cc *clientConn) bodyBuffered(s *qotp.Stream) int {
+	cc.mu.Lock()
+	p := cc.pending[s]
+	cc.mu.Unlock()
+	if p == nil || p.body == nil {
+		return 0
+	}
+	return p.body.buffered()
+}
+
+// dispatch appends a chunk to the response buffer of the request waiting on
+// stream s and delivers the response once it is complete.
+func (cc *clientConn) dispatch(s *qotp.Stream, chunk []byte) {
+	cc.mu.Lock()
+	p, ok := cc.pending[s]
+	cc.mu.Unlock()
+	if !ok {
+		slog.Debug("Dropping data for stream without pending request", "stream_id", s.StreamID())
+		return
+	}
+	if p.body == nil && len(p.buf) == 0 {
+		p.trace.gotFirstResponseChunk()
+	}
+
+	if p.body != nil {
+		cc.feedResponseBody(s, p, chunk)
+		return
+	}
+
+	if len(p.buf)+len(chunk) > cc.maxResponseSize {
+		cc.completePending(s, nil, fmt.Errorf("response size exceeds limit of %d bytes", cc.maxResponseSize))
+		return
+	}
+	p.buf = append(p.buf, chunk...)
+
+	if p.stream {
+		cc.startStreamedResponse(s, p)
+		return
+	}
+
+	complete, err := IsResponseComplete(p.buf)
+	if err != nil {
+		cc.completePending(s, nil, fmt.Errorf("invalid response: %w", err))
+		return
+	}
+	if !complete {
+		return
+	}
+
+	resp, err := ParseResponse(p.buf)
+	if err != nil {
+		cc.completePending(s, nil, fmt.Errorf("failed to parse response: %w", err))
+		return
+	}
+	cc.completePending(s, resp, nil)
+}
+
+// startStreamedResponse delivers the response head to a RequestStream caller
+// once it has arrived and passes the rest of the data on to the body.
+func (cc *clientConn) startStreamedResponse(s *qotp.Stream, p *pendingResponse) {
+	offset, chunked, complete, err := responseHeadEnd(p.buf)
+	if err != nil {
+		cc.completePending(s, nil, fmt.Errorf("invalid response: %w", err))
+		return
+	}
+	if !complete {
+		return
+	}
+
+	resp, _, err := parseResponseHead(p.buf, false)
+	if err != nil {
+		cc.completePending(s, nil, fmt.Errorf("failed to parse response: %w", err))
+		return
+	}
+
+	// Closing the body early only stops delivery; the rest of the response
+	// is still read off the stream and dropped, since QOTP has no way to ask
+	// the sender to stop.
+	p.body = newBodyPipe(func() { cc.removePending(s) })
+	p.dec = newBodyDecoder(chunked)
+	resp.BodyReader = p.body
+	p.done <- responseResult{resp: resp}
+
+	rest := p.buf[offset:]
+	p.buf = nil
+	cc.feedResponseBody(s, p, rest)
+}
+
+func (cc *clientConn) feedResponseBody(s *qotp.Stream, p *pendingResponse, data []byte) {
+	done, err := p.dec.decode(data, p.body.write)
+	if err != nil {
+		cc.completePending(s, nil, fmt.Errorf("invalid response body: %w", err))
+		return
+	}
+	if done {
+		cc.completePending(s, nil, nil)
+	}
+}
+
+// addPending registers a request waiting for a response on stream s.
+func (cc *clientConn) addPending(s *qotp.Stream, stream bool, trace *ClientTrace) (*pendingResponse, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.loopErr != nil {
+		return nil, cc.loopErr
+	}
+	p := &pendingResponse{done: make(chan responseResult, 1), stream: stream, trace: trace}
+	cc.pending[s] = p
+	return p, nil
+}
+
+func (cc *clientConn) removePending(s *qotp.Stream) {
+	cc.mu.Lock()
+	delete(cc.pending, s)
+	cc.mu.Unlock()
+}
+
+// completePending delivers the result to the request waiting on stream s, if
+// any. For a streamed response whose head was already delivered, it ends the
+// body instead; a nil error then marks the body as complete.
+func (cc *clientConn) completePending(s *qotp.Stream, resp *Response, err error) {
+	cc.mu.Lock()
+	p, ok := cc.pending[s]
+	delete(cc.pending, s)
+	cc.mu.Unlock()
+	if ok {
+		p.finish(resp, err)
+	}
+}
+
+// failPending fails all in-flight requests after the read loop has stopped.
+func (cc *clientConn) failPending(err error) {
+	cc.mu.Lock()
+	pending := cc.pending
+	cc.pending = make(map[*qotp.Stream]*pendingResponse)
+	cc.loopErr = err
+	cc.mu.Unlock()
+
+	for _, p := range pending {
+		p.finish(nil, err)
+	}
+}
@@ -0,0 +1,344 @@
+package qh
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// loopbackResolver returns a resolver that maps the hosts a.test and b.test
+// to the loopback address and announces the given DNS keys for them.
+func loopbackResolver(keys map[string]string) *StaticResolver {
+	r := &StaticResolver{Addrs: map[string][]net.IP{}, TXT: map[string][]string{}}
+	for _, host := range []string{"a.test", "b.test"} {
+		r.Addrs[host] = []net.IP{net.IPv4(127, 0, 0, 1)}
+		if key := keys[host]; key != "" {
+			r.TXT["_qotp."+host] = []string{formatKeyRecord(key)}
+		}
+	}
+	return r
+}
+
+// newServerKey returns a fresh base64 X25519 public key as published in DNS.
+func newServerKey(t *testing.T) string {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+func newPoolTestServer(t *testing.T, body string) int {
+	t.Helper()
+	port, _ := newKeyedPoolTestServer(t, body, "test")
+	return port
+}
+
+// newKeyedPoolTestServer starts a test server listening with seeds and
+// returns its port and the keys of the seeds, in order.
+func newKeyedPoolTestServer(t *testing.T, body string, seeds ...string) (int, []string) {
+	t.Helper()
+	srv, addr := newSeededTestServer(t, seeds)
+	t.Cleanup(func() { srv.Close() })
+	srv.HandleFunc("/", GET, func(req *Request) *Response {
+		return TextResponse(200, body+" "+req.Host)
+	})
+	_, port, err := splitHostPort(addr)
+	require.NoError(t, err)
+	keys := make([]string, len(seeds))
+	for i, seed := range seeds {
+		keys[i], err = seedPublicKey(seed)
+		require.NoError(t, err)
+	}
+	return port, keys
+}
+
+func getTarget(t *testing.T, client *Client, target string) string {
+	t.Helper()
+	req, err := NewRequest(GET, target, nil)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := client.DoContext(ctx, req)
+	require.NoError(t, err)
+	return string(resp.Body)
+}
+
+func TestPoolMultipleServers(t *testing.T) {
+	port1 := newPoolTestServer(t, "one")
+	port2 := newPoolTestServer(t, "two")
+
+	client := NewClient()
+	defer client.Close()
+
+	assert.Equal(t, "one 127.0.0.1", getTarget(t, client, fmt.Sprintf("qh://127.0.0.1:%d/", port1)))
+	assert.Equal(t, "two 127.0.0.1", getTarget(t, client, fmt.Sprintf("qh://127.0.0.1:%d/", port2)))
+	assert.Equal(t, "one 127.0.0.1", getTarget(t, client, fmt.Sprintf("qh://127.0.0.1:%d/", port1)))
+	assert.Len(t, client.conns, 2)
+}
+
+func TestPoolCoalescesOriginsWithMatchingKey(t *testing.T) {
+	port, keys := newKeyedPoolTestServer(t, "hello", "test")
+	client := NewClient(WithResolver(loopbackResolver(map[string]string{"a.test": keys[0], "b.test": keys[0]})))
+	defer client.Close()
+
+	a, err := client.getConn(context.Background(), fmt.Sprintf("a.test:%d", port))
+	require.NoError(t, err)
+	client.releaseConn(a)
+	b, err := client.getConn(context.Background(), fmt.Sprintf("b.test:%d", port))
+	require.NoError(t, err)
+	client.releaseConn(b)
+
+	assert.Same(t, a, b)
+	assert.Len(t, client.conns, 1)
+	assert.Len(t, client.origins, 2)
+}
+
+func TestPoolDoesNotCoalesceUnverifiedOrigins(t *testing.T) {
+	port, keys := newKeyedPoolTestServer(t, "hello", "test", "other")
+	knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+	require.NoError(t, os.WriteFile(knownHostsPath, []byte("a.test "+keys[0]+"\nb.test "+keys[0]+"\n"), 0o600))
+	kh, err := LoadKnownHosts(knownHostsPath)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		keys map[string]string
+		opts []ClientOption
+	}{
+		{"no DNS key", map[string]string{}, nil},
+		{"key only for one origin", map[string]string{"a.test": keys[0]}, nil},
+		{"different keys", map[string]string{"a.test": keys[0], "b.test": keys[1]}, nil},
+		{"configured key", map[string]string{}, []ClientOption{
+			WithServerPublicKey("a.test", keys[0]), WithServerPublicKey("b.test", keys[0]),
+		}},
+		{"configured key for one origin", map[string]string{"a.test": keys[0]}, []ClientOption{
+			WithServerPublicKey("b.test", keys[0]),
+		}},
+		{"known hosts key", map[string]string{}, []ClientOption{WithKnownHosts(kh)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(append([]ClientOption{WithResolver(loopbackResolver(tt.keys))}, tt.opts...)...)
+			defer client.Close()
+
+			a, err := client.getConn(context.Background(), fmt.Sprintf("a.test:%d", port))
+			require.NoError(t, err)
+			client.releaseConn(a)
+			b, err := client.getConn(context.Background(), fmt.Sprintf("b.test:%d", port))
+			require.NoError(t, err)
+			client.releaseConn(b)
+
+			assert.NotSame(t, a, b)
+			assert.Len(t, client.conns, 2)
+		})
+	}
+}
+
+func TestPoolEvictsIdleConnections(t *testing.T) {
+	port := newPoolTestServer(t, "hello")
+	target := fmt.Sprintf("qh://127.0.0.1:%d/", port)
+
+	client := NewClient(WithMaxIdleTime(50 * time.Millisecond))
+	defer client.Close()
+
+	getTarget(t, client, target)
+	assert.Eventually(t, func() bool {
+		client.poolMu.Lock()
+		defer client.poolMu.Unlock()
+		return len(client.conns) == 0 && len(client.origins) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// The next request dials a new connection.
+	assert.Equal(t, "hello 127.0.0.1", getTarget(t, client, target))
+}
+
+func TestInterleaveAddrs(t *testing.T) {
+	v4a, v4b := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	v6a, v6b, v6c := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::3")
+	tests := []struct {
+		name string
+		ips  []net.IP
+		want []net.IP
+	}{
+		{"single", []net.IP{v4a}, []net.IP{v4a}},
+		{"IPv6 first", []net.IP{v6a, v6b, v6c, v4a, v4b}, []net.IP{v6a, v4a, v6b, v4b, v6c}},
+		{"IPv4 first", []net.IP{v4a, v4b, v6a}, []net.IP{v4a, v6a, v4b}},
+		{"one family", []net.IP{v6a, v6b}, []net.IP{v6a, v6b}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, interleaveAddrs(tt.ips))
+		})
+	}
+}
+
+func TestPoolTriesAllAddresses(t *testing.T) {
+	port, keys := newKeyedPoolTestServer(t, "hello", "test")
+	key := keys[0]
+	// Nothing listens on 127.0.0.2 and fe80::1 without a zone is not
+	// routable, so only the last address answers.
+	resolver := &StaticResolver{Addrs: map[string][]net.IP{
+		"qh.test": {net.ParseIP("fe80::1"), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)},
+	}}
+	origin := fmt.Sprintf("qh.test:%d", port)
+
+	t.Run("FallsBack", func(t *testing.T) {
+		client := NewClient(WithResolver(resolver))
+		defer client.Close()
+
+		start := time.Now()
+		cc, err := client.getConn(context.Background(), origin)
+		require.NoError(t, err)
+		client.releaseConn(cc)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), cc.key.addr)
+		assert.Less(t, time.Since(start), client.handshakeTimeout, "later addresses must be tried before the first attempt times out")
+		assert.Equal(t, "hello qh.test", getTarget(t, client, "qh://"+origin+"/"))
+	})
+
+	t.Run("ZeroRTTFallsBack", func(t *testing.T) {
+		// A 0-RTT attempt has sent its request data before the server has
+		// answered, so an address only wins once a reply arrives from it.
+		zeroRTT := &StaticResolver{
+			Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)}},
+			TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(key)}},
+		}
+		client := NewClient(WithResolver(zeroRTT))
+		defer client.Close()
+
+		cc, err := client.getConn(context.Background(), origin)
+		require.NoError(t, err)
+		client.releaseConn(cc)
+		assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), cc.key.addr)
+		assert.Equal(t, key, cc.key.pubKey)
+		assert.Equal(t, "hello qh.test", getTarget(t, client, "qh://"+origin+"/"))
+	})
+
+	t.Run("JoinsErrors", func(t *testing.T) {
+		dead := &StaticResolver{Addrs: map[string][]net.IP{
+			"qh.test": {net.ParseIP("fe80::1"), net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 3)},
+		}}
+		client := NewClient(WithResolver(dead))
+		client.handshakeTimeout = 300 * time.Millisecond
+		defer client.Close()
+
+		_, err := client.getConn(context.Background(), origin)
+		require.Error(t, err)
+		for _, addr := range []string{"[fe80::1]", "127.0.0.2", "127.0.0.3"} {
+			assert.Contains(t, err.Error(), fmt.Sprintf("%s:%d", addr, port))
+		}
+		assert.Empty(t, client.conns)
+	})
+}
+
+func TestPoolDialsOriginsIndependently(t *testing.T) {
+	port := newPoolTestServer(t, "hello")
+	// Nothing listens on 127.0.0.2, so dials to dead.test wait for the
+	// handshake timeout.
+	resolver := &StaticResolver{Addrs: map[string][]net.IP{
+		"dead.test": {net.IPv4(127, 0, 0, 2)},
+		"live.test": {net.IPv4(127, 0, 0, 1)},
+	}}
+	client := NewClient(WithResolver(resolver))
+	client.handshakeTimeout = 2 * time.Second
+	defer client.Close()
+
+	dead := fmt.Sprintf("dead.test:%d", port)
+	deadErr := make(chan error, 1)
+	go func() {
+		_, err := client.getConn(context.Background(), dead)
+		deadErr <- err
+	}()
+	require.Eventually(t, func() bool {
+		client.poolMu.Lock()
+		defer client.poolMu.Unlock()
+		return client.dials[dead] != nil
+	}, time.Second, time.Millisecond)
+
+	// Concurrent requests to live.test share one dial, which is not held
+	// up by the dial to dead.test.
+	live := fmt.Sprintf("live.test:%d", port)
+	start := time.Now()
+	conns := make(chan *clientConn, 2)
+	for range 2 {
+		go func() {
+			cc, err := client.getConn(context.Background(), live)
+			assert.NoError(t, err)
+			conns <- cc
+		}()
+	}
+	first, second := <-conns, <-conns
+	require.NotNil(t, first)
+	assert.Same(t, first, second)
+	assert.Less(t, time.Since(start), client.handshakeTimeout)
+	client.releaseConn(first)
+	client.releaseConn(second)
+
+	require.Error(t, <-deadErr)
+}
+
+func TestPoolSkipsStaleKey(t *testing.T) {
+	// The server listens with a key ring, which drops packets for keys it
+	// does not hold, as a server would after retiring a key.
+	port, keys := newKeyedPoolTestServer(t, "hello", "live", "other")
+	resolver := &StaticResolver{
+		Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+		TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(newServerKey(t)), formatKeyRecord(keys[0])}},
+	}
+	client := NewClient(WithResolver(resolver))
+	client.handshakeTimeout = 300 * time.Millisecond
+	defer client.Close()
+
+	origin := fmt.Sprintf("qh.test:%d", port)
+	cc, err := client.getConn(context.Background(), origin)
+	require.NoError(t, err)
+	client.releaseConn(cc)
+	assert.Equal(t, keys[0], cc.key.pubKey)
+	assert.Equal(t, "hello qh.test", getTarget(t, client, "qh://"+origin+"/"))
+}
+
+func TestPoolZeroRTTWithoutWaiting(t *testing.T) {
+	// With a single key and address, the first request is sent with the key
+	// exchange, and the wait for the server's reply moves to the request.
+	port, keys := newKeyedPoolTestServer(t, "hello", "live")
+	origin := fmt.Sprintf("qh.test:%d", port)
+	newClient := func(key string) *Client {
+		client := NewClient(WithResolver(&StaticResolver{
+			Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+			TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(key)}},
+		}))
+		client.handshakeTimeout = 300 * time.Millisecond
+		t.Cleanup(func() { client.Close() })
+		return client
+	}
+
+	t.Run("LiveKey", func(t *testing.T) {
+		client := newClient(keys[0])
+		assert.Equal(t, "hello qh.test", getTarget(t, client, "qh://"+origin+"/"))
+	})
+
+	t.Run("StaleKey", func(t *testing.T) {
+		client := newClient(newServerKey(t))
+		cc, err := client.getConn(context.Background(), origin)
+		require.NoError(t, err, "the dial must not wait for the server")
+		client.releaseConn(cc)
+
+		req, err := NewRequest(GET, "qh://"+origin+"/", nil)
+		require.NoError(t, err)
+		_, err = client.DoContext(context.Background(), req)
+		var transportErr *transportError
+		require.ErrorAs(t, err, &transportErr)
+		assert.Contains(t, err.Error(), "no reply to key exchange")
+		assert.False(t, cc.alive(), "the connection must be given up")
+	})
+}
@@ -2,6 +2,7 @@ package qh
 
 import (
 	"bytes"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -53,9 +54,9 @@ func FuzzParseRequest(f *testing.F) {
 				}
 			}
 
-			// Roundtrip test: parse -> format -> parse
+			// Roundtrip test: parse -> format -> parse, output is always canonical
 			encoded := req.Format()
-			req2, err2 := ParseRequest(encoded)
+			req2, err2 := ParseRequestStrict(encoded)
 			if err2 != nil {
 				t.Errorf("Roundtrip failed: %v", err2)
 			}
@@ -77,7 +78,7 @@ func FuzzParseRequest(f *testing.F) {
 					t.Error("Roundtrip: header count mismatch")
 				}
 				for k, v := range req.Headers {
-					if req2.Headers[k] != v {
+					if !slices.Equal(req2.Headers[k], v) {
 						t.Errorf("Roundtrip: header %s mismatch", k)
 					}
 				}
@@ -109,7 +110,7 @@ func FuzzParseResponse(f *testing.F) {
 				t.Errorf("Invalid version: %d", resp.Version)
 			}
 
-			if resp.StatusCode < 100 || resp.StatusCode > 599 {
+			if resp.StatusCode < minStatusCode || resp.StatusCode > maxStatusCode {
 				t.Errorf("Invalid status code: %d", resp.StatusCode)
 			}
 
@@ -123,9 +124,9 @@ func FuzzParseResponse(f *testing.F) {
 				}
 			}
 
-			// Roundtrip test: parse -> format -> parse
+			// Roundtrip test: parse -> format -> parse, output is always canonical
 			encoded := resp.Format()
-			resp2, err2 := ParseResponse(encoded)
+			resp2, err2 := ParseResponseStrict(encoded)
 			if err2 != nil {
 				t.Errorf("Roundtrip failed: %v", err2)
 			}
@@ -141,7 +142,7 @@ func FuzzParseResponse(f *testing.F) {
 					t.Error("Roundtrip: header count mismatch")
 				}
 				for k, v := range resp.Headers {
-					if resp2.Headers[k] != v {
+					if !slices.Equal(resp2.Headers[k], v) {
 						t.Errorf("Roundtrip: header %s mismatch", k)
 					}
 				}
@@ -2,8 +2,12 @@
 package qh
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"slices"
 	"strings"
 )
 
@@ -16,11 +20,17 @@ const (
 	methodBitShift  = 3          // Method is stored in middle 3 bits (bits 5-3)
 	statusCodeMask  = 0b00111111 // Status code uses lower 6 bits
 	methodMask      = 0b00000111 // Method uses 3 bits
+	chunkedBodyFlag = 0b00000001 // Request body is chunked (bit 0)
+	reservedBits    = 0b00000110 // Reserved request bits (bits 2-1), must be 0
 	maxVersionValue = 3          // Maximum version (2 bits: 0-3)
 	maxHostLength   = 253        // Maximum host length (DNS label length limit)
 	firstByteOffset = 1          // Offset to skip the first byte in wire format
 )
 
+// ErrNonCanonicalHeaders is returned by the strict parsers when the headers
+// of a message are not in canonical order.
+var ErrNonCanonicalHeaders = errors.New("headers not in canonical order")
+
 // Method represents a QH method encoded as an integer for compact wire format.
 // Methods are encoded in 3 bits.
 type Method int
@@ -62,27 +72,122 @@ func (m Method) String() string {
 const (
 	// CustomHeader is a special header ID (0) used to indicate custom headers
 	CustomHeader byte = 0
+
+	// transferEncodingChunked is the transfer-encoding header value that marks
+	// a response body as a sequence of chunks (static table ID 0x62).
+	transferEncodingChunked = "chunked"
 )
 
 // Request represents a QH protocol request message.
 // It contains the QH method, target host and path, protocol version,
-// headers as key-value pairs, and an optional body.
+// headers, and an optional body.
 type Request struct {
-	Method  Method            // QH method (GET, POST, etc.)
-	Host    string            // Target hostname
-	Path    string            // Request path (e.g., "/api/users")
-	Version uint8             // Protocol version number
-	Headers map[string]string // Request headers as key-value pairs
-	Body    []byte            // Optional request body
+	Method  Method // QH method (GET, POST, etc.)
+	Host    string // Target hostname
+	Path    string // Request path (e.g., "/api/users")
+	Version uint8  // Protocol version number
+	Headers Header // Request headers
+	Body    []byte // Optional request body
+
+	// Port is the server port the client sends the request to; it is not
+	// part of the message. If it is 0, the client uses the server given to
+	// Client.Connect.
+	Port int
+
+	// BodyReader streams the request body. When set on a client request, the
+	// body is read from it and sent in chunks instead of Body. On the server it
+	// is always set and yields the body as it arrives.
+	BodyReader io.Reader
+
+	pathValues  map[string]string // path parameters captured by the matched route
+	maxBodySize int               // set on a streamed server request; see ResponseFunc.ServeQH
+}
+
+// PathValue returns the value of the named path parameter captured by the
+// route pattern that matched the request, or "" if there is none. The part
+// of the path matched by a trailing "*" is available as PathValue("*").
+func (r *Request) PathValue(name string) string {
+	return r.pathValues[name]
 }
 
 // Response represents a QH protocol response message.
 // It contains the protocol version, QH status code, headers, and body.
 type Response struct {
-	Version    uint8             // Protocol version number
-	StatusCode int               // QH status code
-	Headers    map[string]string // Response headers as key-value pairs
-	Body       []byte            // Response body content
+	Version    uint8  // Protocol version number
+	StatusCode int    // QH status code
+	Headers    Header // Response headers
+	Body       []byte // Response body content
+
+	// BodyReader streams the response body. When a handler sets it, the server
+	// sends the body in chunks and closes the reader afterwards. Responses
+	// returned by Client.RequestStream carry their body here instead of Body.
+	BodyReader io.ReadCloser
+}
+
+// Header holds the headers of a request or response. Keys are lowercase
+// header names. A name may have several values; each one is sent as its own
+// header field, in order.
+//
+// The methods treat names case-insensitively. Code that indexes the map
+// directly must use lowercase names.
+type Header map[string][]string
+
+// Add appends value to the values of the header name.
+func (h Header) Add(name, value string) {
+	name = strings.ToLower(name)
+	h[name] = append(h[name], value)
+}
+
+// Set replaces the values of the header name with value.
+func (h Header) Set(name, value string) {
+	h[strings.ToLower(name)] = []string{value}
+}
+
+// Get returns the first value of the header name, or "" if there is none.
+func (h Header) Get(name string) string {
+	if values := h[strings.ToLower(name)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns all values of the header name. The returned slice is not a
+// copy.
+func (h Header) Values(name string) []string {
+	return h[strings.ToLower(name)]
+}
+
+// Has reports whether the header name is present.
+func (h Header) Has(name string) bool {
+	_, ok := h[strings.ToLower(name)]
+	return ok
+}
+
+// Del removes all values of the header name.
+func (h Header) Del(name string) {
+	delete(h, strings.ToLower(name))
+}
+
+// Clone returns a deep copy of h, or nil if h is nil.
+func (h Header) Clone() Header {
+	if h == nil {
+		return nil
+	}
+	c := make(Header, len(h))
+	for name, values := range h {
+		c[name] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// headerFromMap converts single-valued headers, as accepted by the
+// convenience helpers, into a Header.
+func headerFromMap(m map[string]string) Header {
+	h := make(Header, len(m))
+	for name, value := range m {
+		h.Add(name, value)
+	}
+	return h
 }
 
 // encodeHeaders implements the three-format header encoding:
@@ -91,68 +196,148 @@ type Response struct {
 // Format 3 (custom header): <0x00><varint:keyLen><key><varint:valueLen><value>
 // NOTE: All header names MUST be normalized (converted to lowercase)
 func encodeHeaders(
-	headers map[string]string,
+	headers Header,
 	completePairs map[string]byte,
 	nameOnly map[string]byte,
 ) []byte {
+	fields := make([]headerField, 0, len(headers))
+	for _, key := range slices.Sorted(maps.Keys(headers)) {
+		fields = appendHeaderFields(fields, strings.ToLower(key), headers[key], completePairs, nameOnly)
+	}
+	slices.SortStableFunc(fields, compareHeaderFields)
+
 	var result []byte
+	for _, f := range fields {
+		result = f.appendTo(result)
+	}
+	return result
+}
+
+// Header field formats, in canonical order.
+const (
+	headerFormatPair   = 1 // Format 1: complete key-value pair
+	headerFormatName   = 2 // Format 2: known name with value
+	headerFormatCustom = 3 // Format 3: custom name and value
+)
 
-	for key, value := range headers {
-		key = strings.ToLower(key)
+// headerField is a single header field as it is encoded on the wire.
+type headerField struct {
+	format int
+	id     byte // static table ID, CustomHeader for Format 3
+	name   string
+	value  string
+}
 
-		// Try Format 1: exact match for complete key-value pair, just send header ID
-		lookupKey := key + ":" + value
-		if headerID, exists := completePairs[lookupKey]; exists {
-			result = append(result, headerID)
-			continue
-		}
+// appendHeaderFields adds a field for each value of the header name. Every
+// value uses the most compact format on its own, unless the canonical order
+// would then change the order of the values: in that case they all use
+// Format 2, or Format 3 if the name has no static table entry, which keeps
+// them in their original order.
+func appendHeaderFields(
+	fields []headerField,
+	name string,
+	values []string,
+	completePairs map[string]byte,
+	nameOnly map[string]byte,
+) []headerField {
+	start := len(fields)
+	for _, value := range values {
+		fields = append(fields, compactHeaderField(name, value, completePairs, nameOnly))
+	}
 
-		// Try Format 2: name-only match with custom value, encode ID
-		if headerID, exists := nameOnly[key]; exists {
-			result = append(result, headerID)
-			result = AppendUvarint(result, uint64(len(value)))
-			result = append(result, []byte(value)...)
-			continue
+	added := fields[start:]
+	if slices.IsSortedFunc(added, compareHeaderFields) {
+		return fields
+	}
+	for i := range added {
+		if headerID, exists := nameOnly[name]; exists {
+			added[i].format, added[i].id = headerFormatName, headerID
+		} else {
+			added[i].format, added[i].id = headerFormatCustom, CustomHeader
 		}
+	}
+	return fields
+}
+
+// compactHeaderField picks the most compact format for a single field.
+func compactHeaderField(name, value string, completePairs, nameOnly map[string]byte) headerField {
+	// Try Format 1: exact match for complete key-value pair, just send header ID
+	if headerID, exists := completePairs[name+":"+value]; exists {
+		return headerField{format: headerFormatPair, id: headerID, name: name, value: value}
+	}
+	// Try Format 2: name-only match with custom value, encode ID
+	if headerID, exists := nameOnly[name]; exists {
+		return headerField{format: headerFormatName, id: headerID, name: name, value: value}
+	}
+	// Format 3: Custom header not in static table
+	return headerField{format: headerFormatCustom, id: CustomHeader, name: name, value: value}
+}
 
-		// Format 3: Custom header not in static table
-		result = append(result, CustomHeader)
-		result = AppendUvarint(result, uint64(len(key)))
-		result = append(result, []byte(key)...)
-		result = AppendUvarint(result, uint64(len(value)))
-		result = append(result, []byte(value)...)
+// compareHeaderFields defines the canonical header order: Format 1 fields by
+// ascending ID, then Format 2 fields by ascending ID, then custom fields by
+// name.
+func compareHeaderFields(a, b headerField) int {
+	if c := cmp.Compare(a.format, b.format); c != 0 {
+		return c
+	}
+	if a.format == headerFormatCustom {
+		return strings.Compare(a.name, b.name)
 	}
+	return cmp.Compare(a.id, b.id)
+}
 
-	return result
+func (f headerField) appendTo(result []byte) []byte {
+	result = append(result, f.id)
+	switch f.format {
+	case headerFormatPair:
+		return result
+	case headerFormatCustom:
+		result = AppendUvarint(result, uint64(len(f.name)))
+		result = append(result, f.name...)
+	}
+	result = AppendUvarint(result, uint64(len(f.value)))
+	return append(result, f.value...)
 }
 
 // Format encodes a QH request into wire format bytes using varint length prefixes.
 //
 // Wire format structure:
-//   - 1 byte: Version (2 bits) | Method (3 bits) | Reserved (3 bits)
+//   - 1 byte: Version (2 bits) | Method (3 bits) | Reserved (2 bits) | Chunked (1 bit)
 //   - varint: host length, followed by host bytes
 //   - varint: path length, followed by path bytes
 //   - varint: headers length, followed by encoded headers
 //   - varint: body length, followed by body bytes
+//
+// Format always produces a length-prefixed body; BodyReader is ignored.
 func (r *Request) Format() []byte {
-	// The first byte contains: Version (2 bits, bits 7-6) | Method (3 bits, bits 5-3) | Reserved (3 bits, bits 2-0)
-	// Bit layout: [Version (2 bits) | Method (3 bits) | Reserved (3 bits)]
+	result := r.appendHead(nil, false)
+	result = AppendUvarint(result, uint64(len(r.Body)))
+	result = append(result, r.Body...)
+
+	return result
+}
+
+// appendHead encodes everything before the body section. If chunked is set,
+// the first byte announces a chunked body.
+func (r *Request) appendHead(buf []byte, chunked bool) []byte {
+	// The first byte contains: Version (2 bits, bits 7-6) | Method (3 bits, bits 5-3) |
+	// Reserved (2 bits, bits 2-1) | Chunked (1 bit, bit 0)
 	firstByte := (r.Version << versionBitShift) | (byte(r.Method) << methodBitShift)
-	result := []byte{firstByte}
-	result = AppendUvarint(result, uint64(len(r.Host)))
-	result = append(result, []byte(r.Host)...)
-	result = AppendUvarint(result, uint64(len(r.Path)))
-	result = append(result, []byte(r.Path)...)
+	if chunked {
+		firstByte |= chunkedBodyFlag
+	}
+	buf = append(buf, firstByte)
+	buf = AppendUvarint(buf, uint64(len(r.Host)))
+	buf = append(buf, []byte(r.Host)...)
+	buf = AppendUvarint(buf, uint64(len(r.Path)))
+	buf = append(buf, []byte(r.Path)...)
 
 	// Encode headers first to get total length
 	encodedHeaders := encodeHeaders(r.Headers, requestHeaderCompletePairs, requestHeaderNameOnly)
-	result = AppendUvarint(result, uint64(len(encodedHeaders)))
-	result = append(result, encodedHeaders...)
-
-	result = AppendUvarint(result, uint64(len(r.Body)))
-	result = append(result, r.Body...)
+	buf = AppendUvarint(buf, uint64(len(encodedHeaders)))
+	buf = append(buf, encodedHeaders...)
 
-	return result
+	return buf
 }
 
 // Format encodes a QH response into wire format bytes using varint length prefixes.
@@ -161,21 +346,47 @@ func (r *Request) Format() []byte {
 //   - 1 byte: Version (2 bits) | Compact status code (6 bits)
 //   - varint: headers length, followed by encoded headers
 //   - varint: body length, followed by body bytes
+//
+// If the headers contain "transfer-encoding: chunked", the body is written
+// as a single chunk followed by the terminating empty chunk instead.
 func (r *Response) Format() []byte {
+	result := r.appendHead(nil)
+
+	if isChunkedResponse(r.Headers) {
+		if len(r.Body) > 0 {
+			result = appendChunk(result, r.Body)
+		}
+		return appendChunk(result, nil)
+	}
+
+	result = AppendUvarint(result, uint64(len(r.Body)))
+	result = append(result, r.Body...)
+
+	return result
+}
+
+// appendHead encodes everything before the body section.
+func (r *Response) appendHead(buf []byte) []byte {
 	compactStatus := encodeStatusCode(r.StatusCode)
 	// First byte: Version (upper 2 bits) + Status Code (lower 6 bits)
 	firstByte := (r.Version << versionBitShift) | compactStatus
-	result := []byte{firstByte}
+	buf = append(buf, firstByte)
+	buf = appendStatusCode(buf, compactStatus, r.StatusCode)
 
 	// Encode headers first to get total length
 	encodedHeaders := encodeHeaders(r.Headers, responseHeaderCompletePairs, responseHeaderNameOnly)
-	result = AppendUvarint(result, uint64(len(encodedHeaders)))
-	result = append(result, encodedHeaders...)
+	buf = AppendUvarint(buf, uint64(len(encodedHeaders)))
+	buf = append(buf, encodedHeaders...)
 
-	result = AppendUvarint(result, uint64(len(r.Body)))
-	result = append(result, r.Body...)
+	return buf
+}
 
-	return result
+func isChunkedRequest(firstByte byte) bool {
+	return firstByte&chunkedBodyFlag != 0
+}
+
+func isChunkedResponse(headers Header) bool {
+	return headers.Get("transfer-encoding") == transferEncodingChunked
 }
 
 func parseCustomHeader(data []byte, offset int) (string, string, int, error) {
@@ -253,13 +464,17 @@ func parseHeaderEntry(
 	)
 }
 
+// parseHeaders decodes the headers section. If strict is set, the fields
+// must be in canonical order, see encodeHeaders.
 func parseHeaders(
 	data []byte,
 	offset int,
 	headersLen uint64,
 	staticTable map[byte]headerEntry,
-) (map[string]string, int, error) {
-	headers := make(map[string]string)
+	strict bool,
+) (Header, int, error) {
+	headers := make(Header)
+	var order headerOrderCheck
 	if headersLen > uint64(len(data)-offset) {
 		return nil, offset, errors.New("headers length exceeds buffer")
 	}
@@ -284,13 +499,42 @@ func parseHeaders(
 
 		offset = newOffset
 
-		key = strings.ToLower(key)
-		headers[key] = value
+		if strict {
+			if err := order.next(headerID, key, staticTable); err != nil {
+				return nil, offset, err
+			}
+		}
+
+		headers.Add(key, value) // repeated fields keep all their values, in order
 	}
 
 	return headers, offset, nil
 }
 
+// headerOrderCheck validates that header fields arrive in canonical order.
+type headerOrderCheck struct {
+	prev    headerField
+	started bool
+}
+
+func (c *headerOrderCheck) next(headerID byte, name string, staticTable map[byte]headerEntry) error {
+	f := headerField{format: headerFormatCustom, id: headerID, name: name}
+	if headerID != CustomHeader {
+		f.format = headerFormatName
+		if staticTable[headerID].Value != "" {
+			f.format = headerFormatPair
+		}
+	} else if name != strings.ToLower(name) {
+		return fmt.Errorf("%w: custom header name %q is not lowercase", ErrNonCanonicalHeaders, name)
+	}
+
+	if c.started && compareHeaderFields(c.prev, f) > 0 {
+		return fmt.Errorf("%w: header %q out of order", ErrNonCanonicalHeaders, name)
+	}
+	c.prev, c.started = f, true
+	return nil
+}
+
 // validate and skip over a length-prefixed field
 func checkField(data []byte, offset *int, fieldName string) (complete bool, length uint64, err error) {
 	length, n, err := ReadUvarint(data, *offset)
@@ -311,30 +555,90 @@ func checkField(data []byte, offset *int, fieldName string) (complete bool, leng
 	return true, length, nil
 }
 
-func IsRequestComplete(data []byte) (bool, error) {
+// checkChunks validates and skips a chunked body section
+func checkChunks(data []byte, offset *int) (bool, error) {
+	for {
+		complete, length, err := checkField(data, offset, "chunk")
+		if !complete {
+			return false, err
+		}
+		if length == 0 {
+			return true, nil
+		}
+	}
+}
+
+// requestHeadEnd returns the offset at which the body section of an encoded
+// request starts. It reports false if the request head is not complete yet.
+func requestHeadEnd(data []byte) (int, bool, error) {
 	if len(data) == 0 {
-		return false, nil
+		return 0, false, nil
 	}
 
 	offset := firstByteOffset // Skip first byte (version + method)
 
 	complete, hostLen, err := checkField(data, &offset, "host")
 	if !complete {
-		return false, err
+		return 0, false, err
 	}
 	if hostLen == 0 {
-		return false, errors.New("invalid request: empty host")
+		return 0, false, errors.New("invalid request: empty host")
 	}
 
 	if complete, _, err := checkField(data, &offset, "path"); !complete {
-		return false, err
+		return 0, false, err
 	}
 
 	// Check headers length field and skip headers section
 	if complete, _, err := checkField(data, &offset, "headers"); !complete {
+		return 0, false, err
+	}
+
+	return offset, true, nil
+}
+
+// responseHeadEnd returns the offset at which the body section of an encoded
+// response starts, together with whether the body is chunked. It reports
+// false if the response head is not complete yet.
+func responseHeadEnd(data []byte) (int, bool, bool, error) {
+	if len(data) == 0 {
+		return 0, false, false, nil
+	}
+
+	// Skip first byte (version + status) and an escaped status code
+	_, offset, err := readStatusCode(data)
+	if errors.Is(err, errVarintIncomplete) {
+		return 0, false, false, nil
+	}
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	// Check headers length field and skip headers section
+	complete, headersLen, err := checkField(data, &offset, "headers")
+	if !complete {
+		return 0, false, false, err
+	}
+
+	headersStart := offset - int(headersLen)
+	headers, _, err := parseHeaders(data, headersStart, headersLen, ResponseHeaderStaticTable, false)
+	if err != nil {
+		return 0, false, false, err
+	}
+
+	return offset, isChunkedResponse(headers), true, nil
+}
+
+func IsRequestComplete(data []byte) (bool, error) {
+	offset, complete, err := requestHeadEnd(data)
+	if !complete {
 		return false, err
 	}
 
+	if isChunkedRequest(data[0]) {
+		return checkChunks(data, &offset)
+	}
+
 	if complete, _, err := checkField(data, &offset, "body"); !complete {
 		return false, err
 	}
@@ -343,15 +647,13 @@ func IsRequestComplete(data []byte) (bool, error) {
 }
 
 func IsResponseComplete(data []byte) (bool, error) {
-	if len(data) == 0 {
-		return false, nil
+	offset, chunked, complete, err := responseHeadEnd(data)
+	if !complete {
+		return false, err
 	}
 
-	offset := firstByteOffset // Skip first byte (version + status)
-
-	// Check headers length field and skip headers section
-	if complete, _, err := checkField(data, &offset, "headers"); !complete {
-		return false, err
+	if chunked {
+		return checkChunks(data, &offset)
 	}
 
 	if complete, _, err := checkField(data, &offset, "body"); !complete {
@@ -361,68 +663,150 @@ func IsResponseComplete(data []byte) (bool, error) {
 	return true, nil
 }
 
-func ParseResponse(data []byte) (*Response, error) {
-	if len(data) == 0 {
-		return nil, errors.New("invalid response: empty data")
-	}
-
-	offset := 0
+// parseBody reads the body section starting at offset: either a single
+// length-prefixed body or a sequence of chunks ending with an empty chunk.
+func parseBody(data []byte, offset int, chunked bool) ([]byte, error) {
+	if !chunked {
+		bodyLen, n, err := ReadUvarint(data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body length: %w", err)
+		}
+		offset += n
 
-	// Parse first byte: Version (2 bits, bits 7-6) | Status Code (6 bits, bits 5-0)
-	firstByte := data[offset]
-	offset++
+		if bodyLen > uint64(len(data)-offset) {
+			return nil, errors.New("body length exceeds buffer")
+		}
+		bodyLenInt := int(bodyLen)
+		return data[offset : offset+bodyLenInt], nil
+	}
 
-	version := firstByte >> versionBitShift     // Extract upper 2 bits
-	compactStatus := firstByte & statusCodeMask // Extract lower 6 bits
+	body := []byte{}
+	for {
+		chunkLen, n, err := ReadUvarint(data, offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read chunk length: %w", err)
+		}
+		offset += n
 
-	if version > maxVersionValue {
-		return nil, fmt.Errorf("invalid version: %d", version)
+		if chunkLen == 0 {
+			return body, nil
+		}
+		if chunkLen > uint64(len(data)-offset) {
+			return nil, errors.New("chunk length exceeds buffer")
+		}
+		chunkLenInt := int(chunkLen)
+		body = append(body, data[offset:offset+chunkLenInt]...)
+		offset += chunkLenInt
 	}
+}
 
-	httpStatusCode := DecodeStatusCode(compactStatus)
+// ParseResponse decodes a complete response.
+func ParseResponse(data []byte) (*Response, error) {
+	return parseResponse(data, false)
+}
 
-	headersLen, n, err := ReadUvarint(data, offset)
+// ParseResponseStrict decodes a complete response like ParseResponse, but
+// also requires the headers to be in canonical order. Otherwise it returns an
+// error wrapping ErrNonCanonicalHeaders.
+func ParseResponseStrict(data []byte) (*Response, error) {
+	return parseResponse(data, true)
+}
+
+func parseResponse(data []byte, strict bool) (*Response, error) {
+	resp, offset, err := parseResponseHead(data, strict)
 	if err != nil {
-		return nil, fmt.Errorf("invalid response: failed to read headers length: %w", err)
+		return nil, err
 	}
-	offset += n
 
-	headers, newOffset, err := parseHeaders(data, offset, headersLen, ResponseHeaderStaticTable)
+	body, err := parseBody(data, offset, isChunkedResponse(resp.Headers))
 	if err != nil {
 		return nil, fmt.Errorf("invalid response: %w", err)
 	}
-	offset = newOffset
+	resp.Body = body
+
+	return resp, nil
+}
+
+// parseResponseHead parses the first byte and headers of a response and
+// returns the offset at which the body section starts.
+func parseResponseHead(data []byte, strict bool) (*Response, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errors.New("invalid response: empty data")
+	}
 
-	bodyLen, n, err := ReadUvarint(data, offset)
+	// Parse first byte: Version (2 bits, bits 7-6) | Status Code (6 bits, bits 5-0)
+	firstByte := data[0]
+	version := firstByte >> versionBitShift // Extract upper 2 bits
+
+	if version > maxVersionValue {
+		return nil, 0, fmt.Errorf("invalid version: %d", version)
+	}
+
+	// Lower 6 bits, followed by the full code if they hold the escape value
+	httpStatusCode, offset, err := readStatusCode(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid response: %w", err)
+	}
+
+	headersLen, n, err := ReadUvarint(data, offset)
 	if err != nil {
-		return nil, fmt.Errorf("invalid response: failed to read body length: %w", err)
+		return nil, 0, fmt.Errorf("invalid response: failed to read headers length: %w", err)
 	}
 	offset += n
 
-	if bodyLen > uint64(len(data)-offset) {
-		return nil, errors.New("invalid response: body length exceeds buffer")
+	headers, newOffset, err := parseHeaders(data, offset, headersLen, ResponseHeaderStaticTable, strict)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid response: %w", err)
 	}
-	bodyLenInt := int(bodyLen)
-	body := data[offset : offset+bodyLenInt]
+	offset = newOffset
 
 	resp := &Response{
 		Version:    version,
 		StatusCode: httpStatusCode,
 		Headers:    headers,
-		Body:       body,
 	}
 
-	return resp, nil
+	return resp, offset, nil
 }
 
+// ParseRequest decodes a complete request.
 func ParseRequest(data []byte) (*Request, error) {
+	return parseRequest(data, false)
+}
+
+// ParseRequestStrict decodes a complete request like ParseRequest, but also
+// requires the headers to be in canonical order. Otherwise it returns an
+// error wrapping ErrNonCanonicalHeaders.
+func ParseRequestStrict(data []byte) (*Request, error) {
+	return parseRequest(data, true)
+}
+
+func parseRequest(data []byte, strict bool) (*Request, error) {
+	req, offset, err := parseRequestHead(data, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := parseBody(data, offset, isChunkedRequest(data[0]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+	req.Body = body
+
+	return req, nil
+}
+
+// parseRequestHead parses everything before the body section of a request
+// and returns the offset at which the body section starts.
+func parseRequestHead(data []byte, strict bool) (*Request, int, error) {
 	if len(data) == 0 {
-		return nil, errors.New("invalid request: empty data")
+		return nil, 0, errors.New("invalid request: empty data")
 	}
 
 	offset := 0
 
-	// Parse first byte: Version (2 bits, bits 7-6) | Method (3 bits, bits 5-3) | Reserved (3 bits, bits 2-0)
+	// Parse first byte: Version (2 bits, bits 7-6) | Method (3 bits, bits 5-3) |
+	// Reserved (2 bits, bits 2-1) | Chunked (1 bit, bit 0)
 	firstByte := data[offset]
 	offset++
 
@@ -430,42 +814,46 @@ func ParseRequest(data []byte) (*Request, error) {
 	method := Method((firstByte >> methodBitShift) & methodMask) // Extract middle 3 bits
 
 	if version > maxVersionValue {
-		return nil, fmt.Errorf("invalid version: %d", version)
+		return nil, 0, fmt.Errorf("invalid version: %d", version)
 	}
 
 	if method < GET || method > OPTIONS { // valid methods are 0-6
-		return nil, fmt.Errorf("invalid method value: %d", method)
+		return nil, 0, fmt.Errorf("invalid method value: %d", method)
+	}
+
+	if firstByte&reservedBits != 0 {
+		return nil, 0, fmt.Errorf("invalid request: reserved bits set in first byte 0x%02x", firstByte)
 	}
 
 	hostLen, n, err := ReadUvarint(data, offset)
 	if err != nil {
-		return nil, fmt.Errorf("invalid request: failed to read host length: %w", err)
+		return nil, 0, fmt.Errorf("invalid request: failed to read host length: %w", err)
 	}
 	offset += n
 
 	if hostLen > uint64(len(data)-offset) {
-		return nil, errors.New("invalid request: host length exceeds buffer")
+		return nil, 0, errors.New("invalid request: host length exceeds buffer")
 	}
 	hostLenInt := int(hostLen)
 	host := string(data[offset : offset+hostLenInt])
 	offset += hostLenInt
 
 	if host == "" {
-		return nil, errors.New("invalid request: empty host")
+		return nil, 0, errors.New("invalid request: empty host")
 	}
 
 	if len(host) > maxHostLength {
-		return nil, fmt.Errorf("invalid request: host exceeds maximum length of %d characters", maxHostLength)
+		return nil, 0, fmt.Errorf("invalid request: host exceeds maximum length of %d characters", maxHostLength)
 	}
 
 	pathLen, n, err := ReadUvarint(data, offset)
 	if err != nil {
-		return nil, fmt.Errorf("invalid request: failed to read path length: %w", err)
+		return nil, 0, fmt.Errorf("invalid request: failed to read path length: %w", err)
 	}
 	offset += n
 
 	if pathLen > uint64(len(data)-offset) {
-		return nil, errors.New("invalid request: path length exceeds buffer")
+		return nil, 0, errors.New("invalid request: path length exceeds buffer")
 	}
 	pathLenInt := int(pathLen)
 	path := string(data[offset : offset+pathLenInt])
@@ -477,36 +865,23 @@ func ParseRequest(data []byte) (*Request, error) {
 
 	headersLen, n, err := ReadUvarint(data, offset)
 	if err != nil {
-		return nil, fmt.Errorf("invalid request: failed to read headers length: %w", err)
+		return nil, 0, fmt.Errorf("invalid request: failed to read headers length: %w", err)
 	}
 	offset += n
 
-	headers, newOffset, err := parseHeaders(data, offset, headersLen, RequestHeaderStaticTable)
+	headers, newOffset, err := parseHeaders(data, offset, headersLen, RequestHeaderStaticTable, strict)
 	if err != nil {
-		return nil, fmt.Errorf("invalid request: %w", err)
+		return nil, 0, fmt.Errorf("invalid request: %w", err)
 	}
 	offset = newOffset
 
-	bodyLen, n, err := ReadUvarint(data, offset)
-	if err != nil {
-		return nil, fmt.Errorf("invalid request: failed to read body length: %w", err)
-	}
-	offset += n
-
-	if bodyLen > uint64(len(data)-offset) {
-		return nil, errors.New("invalid request: body length exceeds buffer")
-	}
-	bodyLenInt := int(bodyLen)
-	body := data[offset : offset+bodyLenInt]
-
 	req := &Request{
 		Method:  method,
 		Host:    host,
 		Path:    path,
 		Version: version,
 		Headers: headers,
-		Body:    body,
 	}
 
-	return req, nil
+	return req, offset, nil
 }
@@ -1,6 +1,8 @@
 package qh
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -8,7 +10,7 @@ import (
 
 // Wire format structure Request:
 //
-//	<firstByte>         - Upper 2 bits: version (0-3), Middle 3 bits: method (0-7), Lower 3 bits: reserved
+//	<firstByte>         - Upper 2 bits: version (0-3), Middle 3 bits: method (0-7), Bits 2-1: reserved (0), Bit 0: chunked body
 //	<varint:hostLen>    - Length of host string
 //	<host>              - Host string bytes
 //	<varint:pathLen>    - Length of path string
@@ -35,7 +37,7 @@ func TestRequestFormat(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/hello",
 				Version: 0,
-				Headers: map[string]string{},
+				Headers: Header{},
 			},
 		},
 		{
@@ -45,8 +47,8 @@ func TestRequestFormat(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/api",
 				Version: 0,
-				Headers: map[string]string{
-					"accept": "application/json",
+				Headers: Header{
+					"accept": {"application/json"},
 				},
 			},
 		},
@@ -57,8 +59,8 @@ func TestRequestFormat(t *testing.T) {
 				Host:    "api.example.com",
 				Path:    "/submit",
 				Version: 0,
-				Headers: map[string]string{
-					"content-type": "application/json",
+				Headers: Header{
+					"content-type": {"application/json"},
 				},
 				Body: []byte(`{"key":"val"}`),
 			},
@@ -110,7 +112,7 @@ func TestResponseFormat(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 200,
-				Headers:    map[string]string{},
+				Headers:    Header{},
 				Body:       []byte("OK"),
 			},
 		},
@@ -119,8 +121,8 @@ func TestResponseFormat(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 200,
-				Headers: map[string]string{
-					"content-type": "text/plain",
+				Headers: Header{
+					"content-type": {"text/plain"},
 				},
 				Body: []byte("Hello"),
 			},
@@ -130,8 +132,8 @@ func TestResponseFormat(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 404,
-				Headers: map[string]string{
-					"content-type": "text/plain",
+				Headers: Header{
+					"content-type": {"text/plain"},
 				},
 				Body: []byte("Not Found"),
 			},
@@ -141,8 +143,8 @@ func TestResponseFormat(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 204,
-				Headers: map[string]string{
-					"content-type": "custom",
+				Headers: Header{
+					"content-type": {"custom"},
 				},
 				Body: []byte{},
 			},
@@ -168,9 +170,9 @@ func TestParseRequestBasic(t *testing.T) {
 		Host:    "example.com",
 		Path:    "/hello.txt",
 		Version: 0,
-		Headers: map[string]string{
-			"accept":          "1",
-			"accept-language": "en-US,en;q=0.5",
+		Headers: Header{
+			"accept":          {"1"},
+			"accept-language": {"en-US,en;q=0.5"},
 		},
 		Body: []byte{},
 	}
@@ -192,8 +194,8 @@ func TestParseRequestWithBody(t *testing.T) {
 		Host:    "example.com",
 		Path:    "/submit",
 		Version: 0,
-		Headers: map[string]string{
-			"content-type": "application/json",
+		Headers: Header{
+			"content-type": {"application/json"},
 		},
 		Body: []byte(`{"name": "test"}`),
 	}
@@ -215,7 +217,7 @@ func TestParseRequestWithMultilineBody(t *testing.T) {
 		Host:    "example.com",
 		Path:    "/submit",
 		Version: 0,
-		Headers: map[string]string{},
+		Headers: Header{},
 		Body:    []byte("line1\nline2\nline3"),
 	}
 
@@ -232,7 +234,7 @@ func TestParseRequestNoHeaders(t *testing.T) {
 		Host:    "example.com",
 		Path:    "/path",
 		Version: 0,
-		Headers: map[string]string{},
+		Headers: Header{},
 		Body:    []byte("test body"),
 	}
 
@@ -250,7 +252,7 @@ func TestParseRequestEmptyPathDefaultsToRoot(t *testing.T) {
 		Host:    "example.com",
 		Path:    "",
 		Version: 0,
-		Headers: map[string]string{},
+		Headers: Header{},
 		Body:    []byte{},
 	}
 
@@ -276,6 +278,16 @@ func TestParseRequestErrors(t *testing.T) {
 		{"host missing", []byte("\x00\x00/path\x03")},
 	}
 
+	valid := (&Request{Method: GET, Host: "example.com", Path: "/", Version: Version}).Format()
+	for _, bit := range []byte{0b010, 0b100} {
+		data := bytes.Clone(valid)
+		data[0] |= bit
+		tests = append(tests, struct {
+			name string
+			data []byte
+		}{fmt.Sprintf("reserved bit 0x%02x set", bit), data})
+	}
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			_, err := ParseRequest(tt.data)
@@ -288,9 +300,9 @@ func TestParseResponseBasic(t *testing.T) {
 	original := &Response{
 		Version:    0,
 		StatusCode: 200,
-		Headers: map[string]string{
-			"content-type": "text/plain",
-			"date":         "1758784800",
+		Headers: Header{
+			"content-type": {"text/plain"},
+			"date":         {"1758784800"},
 		},
 		Body: []byte("Hello, world!"),
 	}
@@ -308,8 +320,8 @@ func TestParseResponseSingleHeader(t *testing.T) {
 	original := &Response{
 		Version:    0,
 		StatusCode: 200,
-		Headers: map[string]string{
-			"content-type": "text/plain",
+		Headers: Header{
+			"content-type": {"text/plain"},
 		},
 		Body: []byte("Response body"),
 	}
@@ -381,7 +393,7 @@ func TestPathWithQueryParams(t *testing.T) {
 				Host:    "example.com",
 				Path:    tt.path,
 				Version: 0,
-				Headers: map[string]string{},
+				Headers: Header{},
 			}
 
 			data := req.Format()
@@ -534,6 +546,18 @@ func TestIsResponseComplete(t *testing.T) {
 			complete: false,
 			hasError: false,
 		},
+		{
+			name:     "Chunked response missing terminating chunk",
+			data:     []byte{0x14, 0x01, 0x62, 0x02, 'O', 'K'}, // 0x62 = transfer-encoding: chunked
+			complete: false,
+			hasError: false,
+		},
+		{
+			name:     "Complete chunked response",
+			data:     []byte{0x14, 0x01, 0x62, 0x02, 'O', 'K', 0x01, '!', 0x00},
+			complete: true,
+			hasError: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -576,10 +600,10 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/api/data",
 				Version: 0,
-				Headers: map[string]string{
-					"accept":          "application/json,text/plain",
-					"accept-encoding": "gzip, br",
-					"user-agent":      "QH-Client/1.0",
+				Headers: Header{
+					"accept":          {"application/json,text/plain"},
+					"accept-encoding": {"gzip, br"},
+					"user-agent":      {"QH-Client/1.0"},
 				},
 				Body: []byte{},
 			},
@@ -591,9 +615,9 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "api.example.com",
 				Path:    "/submit",
 				Version: 0,
-				Headers: map[string]string{
-					"content-type":  "application/json",
-					"authorization": "Bearer token123",
+				Headers: Header{
+					"content-type":  {"application/json"},
+					"authorization": {"Bearer token123"},
 				},
 				Body: []byte(`{"name":"test"}`),
 			},
@@ -605,8 +629,8 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "api.example.com",
 				Path:    "/user/123",
 				Version: 0,
-				Headers: map[string]string{
-					"content-type": "application/json",
+				Headers: Header{
+					"content-type": {"application/json"},
 				},
 				Body: []byte(`{"name":"updated"}`),
 			},
@@ -618,8 +642,8 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "api.example.com",
 				Path:    "/user/123",
 				Version: 0,
-				Headers: map[string]string{
-					"content-type": "application/json",
+				Headers: Header{
+					"content-type": {"application/json"},
 				},
 				Body: []byte(`{"age":"30"}`),
 			},
@@ -631,7 +655,7 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "api.example.com",
 				Path:    "/user/123",
 				Version: 0,
-				Headers: map[string]string{},
+				Headers: Header{},
 				Body:    []byte{},
 			},
 		},
@@ -642,8 +666,8 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/api/data",
 				Version: 0,
-				Headers: map[string]string{
-					"accept": "application/json,text/plain",
+				Headers: Header{
+					"accept": {"application/json,text/plain"},
 				},
 				Body: []byte{},
 			},
@@ -655,7 +679,7 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/",
 				Version: 0,
-				Headers: map[string]string{},
+				Headers: Header{},
 				Body:    []byte{},
 			},
 		},
@@ -666,10 +690,10 @@ func TestRequestRoundTrip(t *testing.T) {
 				Host:    "example.com",
 				Path:    "/custom",
 				Version: 0,
-				Headers: map[string]string{
-					"content-type":     "text/plain",
-					"x-custom-header":  "custom-value",
-					"x-another-custom": "another-value",
+				Headers: Header{
+					"content-type":     {"text/plain"},
+					"x-custom-header":  {"custom-value"},
+					"x-another-custom": {"another-value"},
 				},
 				Body: []byte("hello"),
 			},
@@ -704,10 +728,10 @@ func TestResponseRoundTrip(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 200,
-				Headers: map[string]string{
-					"content-type":  "application/json",
-					"cache-control": "max-age=3600",
-					"date":          "1758784800",
+				Headers: Header{
+					"content-type":  {"application/json"},
+					"cache-control": {"max-age=3600"},
+					"date":          {"1758784800"},
 				},
 				Body: []byte(`{"status":"ok"}`),
 			},
@@ -717,8 +741,8 @@ func TestResponseRoundTrip(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 404,
-				Headers: map[string]string{
-					"content-type": "text/plain",
+				Headers: Header{
+					"content-type": {"text/plain"},
 				},
 				Body: []byte("Not Found"),
 			},
@@ -728,8 +752,8 @@ func TestResponseRoundTrip(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 204,
-				Headers: map[string]string{
-					"content-type": "text/plain",
+				Headers: Header{
+					"content-type": {"text/plain"},
 				},
 				Body: []byte{},
 			},
@@ -739,10 +763,10 @@ func TestResponseRoundTrip(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 200,
-				Headers: map[string]string{
-					"content-type":       "application/json",
-					"x-custom-response":  "custom-value",
-					"x-another-response": "another-value",
+				Headers: Header{
+					"content-type":       {"application/json"},
+					"x-custom-response":  {"custom-value"},
+					"x-another-response": {"another-value"},
 				},
 				Body: []byte("{}"),
 			},
@@ -752,11 +776,11 @@ func TestResponseRoundTrip(t *testing.T) {
 			response: &Response{
 				Version:    0,
 				StatusCode: 200,
-				Headers: map[string]string{
-					"content-type":                 "application/json",
-					"access-control-allow-origin":  "*",
-					"access-control-allow-methods": "GET, POST, PUT",
-					"access-control-allow-headers": "Content-Type, Authorization",
+				Headers: Header{
+					"content-type":                 {"application/json"},
+					"access-control-allow-origin":  {"*"},
+					"access-control-allow-methods": {"GET, POST, PUT"},
+					"access-control-allow-headers": {"Content-Type, Authorization"},
 				},
 				Body: []byte("{}"),
 			},
@@ -772,3 +796,51 @@ func TestResponseRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestChunkedBodyRoundTrip(t *testing.T) {
+	t.Run("Request", func(t *testing.T) {
+		req := &Request{
+			Method:  POST,
+			Host:    "example.com",
+			Path:    "/upload",
+			Version: Version,
+			Headers: Header{"content-type": {"text/plain"}},
+		}
+		data := req.appendHead(nil, true)
+		data = appendChunk(data, []byte("hello "))
+		data = appendChunk(data, []byte("world"))
+
+		complete, err := IsRequestComplete(data)
+		require.NoError(t, err)
+		require.False(t, complete, "request without terminating chunk must be incomplete")
+
+		data = appendChunk(data, nil)
+		complete, err = IsRequestComplete(data)
+		require.NoError(t, err)
+		require.True(t, complete)
+
+		parsed, err := ParseRequest(data)
+		require.NoError(t, err)
+		require.Equal(t, "/upload", parsed.Path)
+		require.Equal(t, "hello world", string(parsed.Body))
+	})
+
+	t.Run("Response", func(t *testing.T) {
+		resp := &Response{
+			Version:    Version,
+			StatusCode: 200,
+			Headers:    Header{"transfer-encoding": {"chunked"}},
+			Body:       []byte("streamed"),
+		}
+		data := resp.Format()
+
+		complete, err := IsResponseComplete(data)
+		require.NoError(t, err)
+		require.True(t, complete)
+
+		parsed, err := ParseResponse(data)
+		require.NoError(t, err)
+		require.Equal(t, "streamed", string(parsed.Body))
+		require.Equal(t, "chunked", parsed.Headers.Get("transfer-encoding"))
+	})
+}
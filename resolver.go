@@ -0,0 +1,162 @@
+package qh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultResolverTTL is how long the default resolver of a Client caches
+// answers, since the system resolver does not report record TTLs.
+const defaultResolverTTL = time.Minute
+
+// Resolver looks up the IP addresses of a host and the TXT records of a DNS
+// name, from which the client takes the server key (at _qotp.<host>).
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// TTLResolver is implemented by resolvers that report the TTL of their
+// answers. A CachingResolver keeps such answers for their TTL.
+type TTLResolver interface {
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+	LookupTXTTTL(ctx context.Context, name string) ([]string, time.Duration, error)
+}
+
+// WithResolver sets the resolver used to look up server addresses and keys.
+// By default, the client uses net.DefaultResolver behind a CachingResolver
+// that keeps answers for one minute. The given resolver is used as is, so
+// wrap it in NewCachingResolver to cache its answers.
+func WithResolver(r Resolver) ClientOption {
+	return func(c *Client) {
+		c.resolver = r
+	}
+}
+
+// StaticResolver answers lookups from fixed tables instead of DNS, for
+// tests and for servers whose addresses and keys are known in advance. The
+// tables must not be modified while the resolver is in use.
+type StaticResolver struct {
+	Addrs map[string][]net.IP // host -> IP addresses
+	TXT   map[string][]string // DNS name, such as "_qotp.example.com" -> TXT records
+}
+
+// LookupIPAddr returns the addresses of host, or a not found error if the
+// table has none.
+func (r *StaticResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	ips := r.Addrs[host]
+	if len(ips) == 0 {
+		return nil, notFoundError(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: ip}
+	}
+	return addrs, nil
+}
+
+// LookupTXT returns the TXT records of name, or a not found error if the
+// table has none.
+func (r *StaticResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	records := r.TXT[name]
+	if len(records) == 0 {
+		return nil, notFoundError(name)
+	}
+	return records, nil
+}
+
+func notFoundError(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// CachingResolver caches the answers of another resolver. Answers are kept
+// for the TTL reported by the resolver if it implements TTLResolver, but for
+// at most the TTL given to NewCachingResolver, which also applies to answers
+// without a TTL. Not found answers are cached too, so a missing key record
+// is not queried again on every connection. Other errors are not cached.
+type CachingResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	addrs map[string]cacheEntry[[]net.IPAddr]
+	txt   map[string]cacheEntry[[]string]
+}
+
+type cacheEntry[T any] struct {
+	value   T
+	err     error // a not found error, cached like an answer
+	expires time.Time
+}
+
+// NewCachingResolver returns a resolver that caches the answers of r for up
+// to ttl.
+func NewCachingResolver(r Resolver, ttl time.Duration) *CachingResolver {
+	return &CachingResolver{
+		resolver: r,
+		ttl:      ttl,
+		addrs:    make(map[string]cacheEntry[[]net.IPAddr]),
+		txt:      make(map[string]cacheEntry[[]string]),
+	}
+}
+
+// LookupIPAddr returns the cached addresses of host, looking them up if they
+// are missing or expired.
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	return lookupCached(r, r.addrs, host, func() ([]net.IPAddr, time.Duration, error) {
+		if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+			return ttlResolver.LookupIPAddrTTL(ctx, host)
+		}
+		addrs, err := r.resolver.LookupIPAddr(ctx, host)
+		return addrs, r.ttl, err
+	})
+}
+
+// LookupTXT returns the cached TXT records of name, looking them up if they
+// are missing or expired.
+func (r *CachingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return lookupCached(r, r.txt, name, func() ([]string, time.Duration, error) {
+		if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+			return ttlResolver.LookupTXTTTL(ctx, name)
+		}
+		records, err := r.resolver.LookupTXT(ctx, name)
+		return records, r.ttl, err
+	})
+}
+
+// lookupCached returns the entry for name in cache, or calls lookup and
+// caches its answer. The cache is not locked during lookup, so concurrent
+// misses for the same name may each query the resolver.
+func lookupCached[T any](
+	r *CachingResolver,
+	cache map[string]cacheEntry[T],
+	name string,
+	lookup func() (T, time.Duration, error),
+) (T, error) {
+	r.mu.Lock()
+	entry, ok := cache[name]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.value, entry.err
+	}
+
+	value, ttl, err := lookup()
+	var dnsErr *net.DNSError
+	if err != nil && (!errors.As(err, &dnsErr) || !dnsErr.IsNotFound) {
+		return value, err
+	}
+
+	ttl = min(ttl, r.ttl)
+	r.mu.Lock()
+	if ttl > 0 {
+		cache[name] = cacheEntry[T]{value: value, err: err, expires: time.Now().Add(ttl)}
+	} else {
+		delete(cache, name)
+	}
+	r.mu.Unlock()
+	return value, err
+}
@@ -0,0 +1,215 @@
+package qh
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingResolver counts the lookups that reach it and reports ttl for
+// every answer.
+type countingResolver struct {
+	StaticResolver
+	ttl     time.Duration
+	err     error // returned instead of an answer if set
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	r.lookups.Add(1)
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	return addrs, r.ttl, err
+}
+
+func (r *countingResolver) LookupTXTTTL(ctx context.Context, name string) ([]string, time.Duration, error) {
+	r.lookups.Add(1)
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+	records, err := r.LookupTXT(ctx, name)
+	return records, r.ttl, err
+}
+
+func TestStaticResolver(t *testing.T) {
+	r := &StaticResolver{
+		Addrs: map[string][]net.IP{"example.com": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}},
+		TXT:   map[string][]string{"_qotp.example.com": {"v=0;k=abc"}},
+	}
+
+	addrs, err := r.LookupIPAddr(context.Background(), "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}, addrs)
+
+	records, err := r.LookupTXT(context.Background(), "_qotp.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v=0;k=abc"}, records)
+
+	var dnsErr *net.DNSError
+	_, err = r.LookupIPAddr(context.Background(), "unknown.example")
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+	_, err = r.LookupTXT(context.Background(), "_qotp.unknown.example")
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+}
+
+func TestCachingResolver(t *testing.T) {
+	ctx := context.Background()
+	newBackend := func(ttl time.Duration) *countingResolver {
+		return &countingResolver{
+			StaticResolver: StaticResolver{
+				Addrs: map[string][]net.IP{"example.com": {net.ParseIP("192.0.2.1")}},
+				TXT:   map[string][]string{"_qotp.example.com": {"v=0;k=abc"}},
+			},
+			ttl: ttl,
+		}
+	}
+
+	t.Run("CachesAnswers", func(t *testing.T) {
+		backend := newBackend(time.Hour)
+		r := NewCachingResolver(backend, time.Hour)
+		for range 3 {
+			addrs, err := r.LookupIPAddr(ctx, "example.com")
+			require.NoError(t, err)
+			assert.Equal(t, []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, addrs)
+			records, err := r.LookupTXT(ctx, "_qotp.example.com")
+			require.NoError(t, err)
+			assert.Equal(t, []string{"v=0;k=abc"}, records)
+		}
+		assert.Equal(t, int32(2), backend.lookups.Load())
+	})
+
+	t.Run("CachesNotFound", func(t *testing.T) {
+		backend := newBackend(time.Hour)
+		r := NewCachingResolver(backend, time.Hour)
+		for range 3 {
+			_, err := r.LookupTXT(ctx, "_qotp.other.example")
+			var dnsErr *net.DNSError
+			require.ErrorAs(t, err, &dnsErr)
+			assert.True(t, dnsErr.IsNotFound)
+		}
+		assert.Equal(t, int32(1), backend.lookups.Load())
+	})
+
+	t.Run("DoesNotCacheErrors", func(t *testing.T) {
+		backend := newBackend(time.Hour)
+		backend.err = &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}
+		r := NewCachingResolver(backend, time.Hour)
+		for range 2 {
+			_, err := r.LookupIPAddr(ctx, "example.com")
+			require.Error(t, err)
+		}
+		assert.Equal(t, int32(2), backend.lookups.Load())
+	})
+
+	t.Run("RespectsRecordTTL", func(t *testing.T) {
+		backend := newBackend(0)
+		r := NewCachingResolver(backend, time.Hour)
+		for range 2 {
+			_, err := r.LookupIPAddr(ctx, "example.com")
+			require.NoError(t, err)
+		}
+		assert.Equal(t, int32(2), backend.lookups.Load(), "a zero TTL must not be cached")
+	})
+
+	t.Run("CapsRecordTTL", func(t *testing.T) {
+		backend := newBackend(time.Hour)
+		r := NewCachingResolver(backend, 20*time.Millisecond)
+		_, err := r.LookupIPAddr(ctx, "example.com")
+		require.NoError(t, err)
+		assert.Eventually(t, func() bool {
+			_, err := r.LookupIPAddr(ctx, "example.com")
+			return err == nil && backend.lookups.Load() == 2
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("PlainResolverUsesCacheTTL", func(t *testing.T) {
+		backend := newBackend(0)
+		r := NewCachingResolver(&backend.StaticResolver, time.Hour)
+		first, err := r.LookupIPAddr(ctx, "example.com")
+		require.NoError(t, err)
+		backend.Addrs["example.com"] = []net.IP{net.ParseIP("192.0.2.2")}
+		second, err := r.LookupIPAddr(ctx, "example.com")
+		require.NoError(t, err)
+		assert.Equal(t, first, second)
+	})
+}
+
+func TestLookupPubKeys(t *testing.T) {
+	key, key2 := newServerKey(t), newServerKey(t)
+	tests := []struct {
+		name    string
+		records []string
+		want    []string
+	}{
+		{"valid", []string{formatKeyRecord(key)}, []string{key}},
+		{"extra whitespace", []string{"v=0; k=" + key}, []string{key}},
+		{"multiple records", []string{formatKeyRecord(key2), formatKeyRecord(key)}, []string{key2, key}},
+		{"multiple keys in a record", []string{"v=0;k=" + key + ";k=" + key2}, []string{key, key2}},
+		{"duplicate key", []string{formatKeyRecord(key), formatKeyRecord(key)}, []string{key}},
+		{"invalid key skipped", []string{"v=0;k=bm90IGEga2V5;k=" + key}, []string{key}},
+		{"wrong version", []string{"v=9;k=" + key}, nil},
+		{"missing key", []string{"v=0"}, nil},
+		{"too long", []string{formatKeyRecord(key) + ";padding=" + string(make([]byte, maxDNSTXTRecordLength))}, nil},
+		{"no record", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &StaticResolver{TXT: map[string][]string{"_qotp.example.com": tt.records}}
+			assert.Equal(t, tt.want, lookupPubKeys(context.Background(), r, "example.com"))
+		})
+	}
+}
+
+func TestClientConnectUsesResolver(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	key := base64.StdEncoding.EncodeToString(srv.listener.PubKey().Bytes())
+
+	t.Run("DNSKey", func(t *testing.T) {
+		resolver := &StaticResolver{
+			Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+			TXT:   map[string][]string{"_qotp.qh.test": {formatKeyRecord(key)}},
+		}
+		client := NewClient(WithResolver(resolver))
+		defer client.Close()
+
+		require.NoError(t, client.ConnectContext(context.Background(), net.JoinHostPort("qh.test", port)))
+		cc := defaultConn(t, client)
+		assert.Equal(t, key, cc.key.pubKey, "connection must be dialed with the DNS key (0-RTT)")
+		assert.Equal(t, addr, cc.key.addr)
+	})
+
+	t.Run("InvalidDNSKey", func(t *testing.T) {
+		resolver := &StaticResolver{
+			Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}},
+			TXT:   map[string][]string{"_qotp.qh.test": {"v=0;k=bm90IGEga2V5"}},
+		}
+		client := NewClient(WithResolver(resolver))
+		defer client.Close()
+
+		require.NoError(t, client.ConnectContext(context.Background(), net.JoinHostPort("qh.test", port)))
+		assert.Empty(t, defaultConn(t, client).key.pubKey)
+	})
+
+	t.Run("UnknownHost", func(t *testing.T) {
+		client := NewClient(WithResolver(&StaticResolver{}))
+		defer client.Close()
+
+		err := client.ConnectContext(context.Background(), "missing.test:8090")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr)
+		assert.True(t, dnsErr.IsNotFound)
+	})
+}
@@ -0,0 +1,175 @@
+package qh
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Default retry policy values, used for zero fields of a RetryPolicy.
+	defaultMaxRetries     = 3
+	defaultRetryBaseDelay = 100 * time.Millisecond
+	defaultRetryMaxDelay  = 10 * time.Second
+
+	// idempotencyKeyHeader marks a POST or PATCH request as safe to retry.
+	idempotencyKeyHeader = "idempotency-key"
+	retryAfterHeader     = "retry-after"
+)
+
+// RetryPolicy configures automatic retries of failed requests, see
+// WithRetryPolicy. Zero fields use the defaults.
+type RetryPolicy struct {
+	MaxRetries int           // retries after the first attempt; default 3
+	BaseDelay  time.Duration // delay before the first retry, doubled for every further one; default 100ms
+	MaxDelay   time.Duration // upper bound for a single delay, including retry-after; default 10s
+}
+
+// WithRetryPolicy enables automatic retries. A request is retried when it
+// fails with a transport error, such as a lost connection or a failed dial,
+// or when the server answers 503 Service Unavailable or 429 Too Many
+// Requests.
+//
+// Only idempotent requests are retried: GET, HEAD, OPTIONS, PUT and DELETE,
+// and POST or PATCH requests that carry an idempotency-key header. Requests
+// with a streamed body are never retried.
+//
+// Retries wait for an exponentially growing delay with jitter, or for the
+// time given in the retry-after header of the response. If the connection
+// was lost, the client reconnects before retrying.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(c *Client) {
+		if policy.MaxRetries <= 0 {
+			policy.MaxRetries = defaultMaxRetries
+		}
+		if policy.BaseDelay <= 0 {
+			policy.BaseDelay = defaultRetryBaseDelay
+		}
+		if policy.MaxDelay <= 0 {
+			policy.MaxDelay = defaultRetryMaxDelay
+		}
+		c.retryPolicy = &policy
+	}
+}
+
+// transportError marks a request failure caused by the connection rather
+// than by the response, which makes the request safe to retry.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+// roundTripWithRetry sends req like roundTrip and retries it according to the
+// client's retry policy.
+func (c *Client) roundTripWithRetry(ctx context.Context, origin string, req *Request) (*Response, error) {
+	policy := c.retryPolicy
+	if policy == nil || !isRetryable(req) {
+		return c.roundTrip(ctx, origin, req, false)
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.roundTrip(ctx, origin, req, false)
+
+		var transportErr *transportError
+		switch {
+		case err != nil && !errors.As(err, &transportErr):
+			return nil, err
+		case err == nil && !isRetryableStatus(resp.StatusCode):
+			return resp, nil
+		case attempt >= policy.MaxRetries:
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		if resp != nil {
+			if d, ok := retryAfter(resp.Headers.Get(retryAfterHeader), time.Now()); ok {
+				delay = min(d, policy.MaxDelay)
+			}
+			slog.Info("Retrying request", "path", req.Path, "status", resp.StatusCode,
+				"attempt", attempt+1, "delay", delay)
+		} else {
+			slog.Info("Retrying request", "path", req.Path, "error", err,
+				"attempt", attempt+1, "delay", delay)
+		}
+
+		// A lost connection is dialed again by the next attempt.
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before retry number attempt+1: the base delay
+// doubled for every earlier retry, capped at MaxDelay, of which a random
+// half is dropped to spread out retries from many clients.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.MaxDelay
+	if attempt < 32 && p.BaseDelay<<attempt < p.MaxDelay {
+		d = p.BaseDelay << attempt
+	}
+	half := d / 2
+	return half + rand.N(half+1) //nolint:gosec // jitter does not need a secure source
+}
+
+// isRetryable reports whether req may be sent again.
+func isRetryable(req *Request) bool {
+	if req.BodyReader != nil {
+		return false // a streamed body cannot be sent twice
+	}
+	switch req.Method {
+	case GET, HEAD, OPTIONS, PUT, DELETE:
+		return true
+	case POST, PATCH:
+		return req.Headers.Has(idempotencyKeyHeader)
+	default:
+		return false
+	}
+}
+
+func isRetryableStatus(code int) bool {
+	return code == StatusServiceUnavailable || code == StatusTooManyRequests
+}
+
+// retryAfter parses a retry-after header value, which is either a number of
+// seconds or an HTTP date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx, "request")
+	}
+}
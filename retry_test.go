@@ -0,0 +1,102 @@
+package qh
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithRetryPolicyDefaults(t *testing.T) {
+	c := NewClient(WithRetryPolicy(RetryPolicy{}))
+	assert.Equal(t, &RetryPolicy{
+		MaxRetries: defaultMaxRetries,
+		BaseDelay:  defaultRetryBaseDelay,
+		MaxDelay:   defaultRetryMaxDelay,
+	}, c.retryPolicy)
+
+	c = NewClient(WithRetryPolicy(RetryPolicy{MaxRetries: 5, BaseDelay: time.Second}))
+	assert.Equal(t, 5, c.retryPolicy.MaxRetries)
+	assert.Equal(t, time.Second, c.retryPolicy.BaseDelay)
+	assert.Equal(t, defaultRetryMaxDelay, c.retryPolicy.MaxDelay)
+
+	assert.Nil(t, NewClient().retryPolicy)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{MaxRetries: 10, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	for attempt, want := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second, // capped
+		time.Second,
+	} {
+		for range 20 {
+			d := p.backoff(attempt)
+			assert.GreaterOrEqual(t, d, want/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, d, want, "attempt %d", attempt)
+		}
+	}
+
+	assert.LessOrEqual(t, p.backoff(100), time.Second, "large attempt counts must not overflow")
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     *Request
+		allowed bool
+	}{
+		{"GET", &Request{Method: GET, Headers: Header{}}, true},
+		{"HEAD", &Request{Method: HEAD, Headers: Header{}}, true},
+		{"OPTIONS", &Request{Method: OPTIONS, Headers: Header{}}, true},
+		{"PUT", &Request{Method: PUT, Headers: Header{}}, true},
+		{"DELETE", &Request{Method: DELETE, Headers: Header{}}, true},
+		{"POST", &Request{Method: POST, Headers: Header{}}, false},
+		{"PATCH", &Request{Method: PATCH, Headers: Header{}}, false},
+		{"POST with idempotency-key", &Request{
+			Method: POST, Headers: Header{"idempotency-key": {"abc"}},
+		}, true},
+		{"PATCH with idempotency-key", &Request{
+			Method: PATCH, Headers: Header{"idempotency-key": {"abc"}},
+		}, true},
+		{"streamed body", &Request{Method: PUT, Headers: Header{}, BodyReader: strings.NewReader("x")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, isRetryable(tt.req))
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"3", 3 * time.Second, true},
+		{" 120 ", 2 * time.Minute, true},
+		{"Thu, 02 Jan 2025 15:04:35 GMT", 30 * time.Second, true},
+		{"Thu, 02 Jan 2025 15:00:00 GMT", 0, true}, // in the past
+		{"", 0, false},
+		{"-1", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			delay, ok := retryAfter(tt.value, now)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.delay, delay)
+		})
+	}
+}
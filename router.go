@@ -0,0 +1,217 @@
+package qh
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Route patterns
+//
+// A pattern is a path made of "/"-separated segments. Each segment is one of:
+//   - a literal, which must match the request path segment exactly
+//   - "{name}", which matches any single segment and captures it as name
+//   - "*" as the last segment, which matches the rest of the path (possibly
+//     empty) and captures it as "*"
+//
+// When several patterns match a path, the most specific one wins: segments
+// are compared from left to right, and a literal beats a parameter, which
+// beats a wildcard. The query string and fragment are ignored for matching.
+
+// wildcardName is the path value name under which a trailing "*" segment is
+// captured.
+const wildcardName = "*"
+
+type segmentKind int
+
+// Ordered from most to least specific.
+const (
+	segmentLiteral segmentKind = iota
+	segmentParam
+	segmentWildcard
+)
+
+type segment struct {
+	kind  segmentKind
+	value string // literal text or parameter name
+}
+
+type route struct {
+	pattern  string
+	segments []segment
+	handlers map[Method]Handler
+}
+
+// router matches request paths against registered patterns. Routes may be
+// added while requests are being served.
+type router struct {
+	mu     sync.RWMutex
+	routes []*route
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+// add registers handler for pattern and method, replacing any handler that
+// was registered for the same pattern and method before. It panics if the
+// pattern is invalid.
+func (rt *router) add(pattern string, method Method, handler Handler) {
+	segments, err := parsePattern(pattern)
+	if err != nil {
+		panic(fmt.Sprintf("qh: invalid route pattern %q: %v", pattern, err))
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, r := range rt.routes {
+		if r.pattern == pattern {
+			r.handlers[method] = handler
+			return
+		}
+	}
+	rt.routes = append(rt.routes, &route{
+		pattern:  pattern,
+		segments: segments,
+		handlers: map[Method]Handler{method: handler},
+	})
+}
+
+// match finds the handler for a request path and method. It returns the
+// captured path values, or, if the path matches but no route handles the
+// method, the methods that are allowed for the path.
+func (rt *router) match(path string, method Method) (Handler, map[string]string, []Method) {
+	path, _ = splitQuery(path)
+	parts := splitPath(path)
+
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	var best *route
+	var bestValues map[string]string
+	var allowed []Method
+	for _, r := range rt.routes {
+		values, ok := r.match(parts)
+		if !ok {
+			continue
+		}
+		if _, ok := r.handlers[method]; !ok {
+			for m := range r.handlers {
+				if !slices.Contains(allowed, m) {
+					allowed = append(allowed, m)
+				}
+			}
+			continue
+		}
+		if best == nil || r.moreSpecific(best) {
+			best, bestValues = r, values
+		}
+	}
+
+	if best == nil {
+		slices.Sort(allowed)
+		return nil, nil, allowed
+	}
+	return best.handlers[method], bestValues, nil
+}
+
+// match reports whether the route matches the path segments and returns the
+// captured values.
+func (r *route) match(parts []string) (map[string]string, bool) {
+	var values map[string]string
+	for i, seg := range r.segments {
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch seg.kind {
+		case segmentLiteral:
+			if parts[i] != seg.value {
+				return nil, false
+			}
+		case segmentParam:
+			if parts[i] == "" {
+				return nil, false
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[seg.value] = parts[i]
+		case segmentWildcard:
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[wildcardName] = strings.Join(parts[i:], "/")
+			return values, true
+		}
+	}
+	if len(parts) != len(r.segments) {
+		return nil, false
+	}
+	return values, true
+}
+
+// moreSpecific reports whether r takes precedence over other.
+func (r *route) moreSpecific(other *route) bool {
+	for i := range min(len(r.segments), len(other.segments)) {
+		if r.segments[i].kind != other.segments[i].kind {
+			return r.segments[i].kind < other.segments[i].kind
+		}
+	}
+	// Same kinds up to here: prefer the longer pattern.
+	return len(r.segments) > len(other.segments)
+}
+
+func parsePattern(pattern string) ([]segment, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, fmt.Errorf("pattern must start with %q", "/")
+	}
+	if strings.ContainsAny(pattern, "?#") {
+		return nil, errors.New("pattern must not contain a query or fragment")
+	}
+
+	parts := splitPath(pattern)
+	segments := make([]segment, 0, len(parts))
+	names := make(map[string]bool)
+	for i, part := range parts {
+		switch {
+		case part == wildcardName:
+			if i != len(parts)-1 {
+				return nil, fmt.Errorf("%q is only allowed as the last segment", wildcardName)
+			}
+			segments = append(segments, segment{kind: segmentWildcard})
+		case strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}"):
+			name := part[1 : len(part)-1]
+			if name == "" || strings.ContainsAny(name, "{}") {
+				return nil, fmt.Errorf("invalid parameter segment %q", part)
+			}
+			if names[name] {
+				return nil, fmt.Errorf("duplicate parameter name %q", name)
+			}
+			names[name] = true
+			segments = append(segments, segment{kind: segmentParam, value: name})
+		case strings.ContainsAny(part, "{}*"):
+			return nil, fmt.Errorf("invalid segment %q", part)
+		default:
+			segments = append(segments, segment{kind: segmentLiteral, value: part})
+		}
+	}
+	return segments, nil
+}
+
+// splitPath splits a path into its segments, without the leading slash.
+// The root path "/" has a single empty segment.
+func splitPath(path string) []string {
+	return strings.Split(strings.TrimPrefix(path, "/"), "/")
+}
+
+// formatAllow formats methods as the value of an allow header.
+func formatAllow(methods []Method) string {
+	names := make([]string, len(methods))
+	for i, m := range methods {
+		names[i] = m.String()
+	}
+	return strings.Join(names, ", ")
+}
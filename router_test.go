@@ -0,0 +1,107 @@
+package qh
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// namedHandler is a Handler that can be told apart in router tests.
+type namedHandler string
+
+func (namedHandler) ServeQH(context.Context, ResponseWriter, *Request) {}
+
+func TestRouterMatch(t *testing.T) {
+	rt := newRouter()
+	rt.add("/", GET, namedHandler("root"))
+	rt.add("/users", GET, namedHandler("users"))
+	rt.add("/users/me", GET, namedHandler("me"))
+	rt.add("/users/{id}", GET, namedHandler("user"))
+	rt.add("/users/{id}/posts/{post}", GET, namedHandler("post"))
+	rt.add("/static/*", GET, namedHandler("static"))
+	rt.add("/static/favicon.ico", GET, namedHandler("favicon"))
+
+	tests := []struct {
+		name    string
+		path    string
+		handler Handler
+		values  map[string]string
+	}{
+		{"Root", "/", namedHandler("root"), nil},
+		{"Literal", "/users", namedHandler("users"), nil},
+		{"Literal beats parameter", "/users/me", namedHandler("me"), nil},
+		{"Parameter", "/users/42", namedHandler("user"), map[string]string{"id": "42"}},
+		{"Multiple parameters", "/users/42/posts/7", namedHandler("post"), map[string]string{"id": "42", "post": "7"}},
+		{"Query string ignored", "/users/42?fields=name#top", namedHandler("user"), map[string]string{"id": "42"}},
+		{"Query string on root", "?q=1", namedHandler("root"), nil},
+		{"Wildcard", "/static/css/site.css", namedHandler("static"), map[string]string{"*": "css/site.css"}},
+		{"Wildcard empty rest", "/static/", namedHandler("static"), map[string]string{"*": ""}},
+		{"Literal beats wildcard", "/static/favicon.ico", namedHandler("favicon"), nil},
+		{"Wildcard needs its segment", "/static", nil, nil},
+		{"Empty parameter", "/users//posts/7", nil, nil},
+		{"Trailing slash is a different path", "/users/", nil, nil},
+		{"Unknown", "/unknown", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, values, allowed := rt.match(tt.path, GET)
+			require.Equal(t, tt.handler, handler)
+			require.Equal(t, tt.values, values)
+			require.Empty(t, allowed)
+		})
+	}
+}
+
+func TestRouterMethodNotAllowed(t *testing.T) {
+	rt := newRouter()
+	rt.add("/items", POST, namedHandler("create"))
+	rt.add("/items", GET, namedHandler("list"))
+	rt.add("/items/{id}", DELETE, namedHandler("delete"))
+	rt.add("/items/*", PUT, namedHandler("put"))
+
+	handler, _, allowed := rt.match("/items", PATCH)
+	require.Nil(t, handler)
+	require.Equal(t, []Method{GET, POST}, allowed)
+	require.Equal(t, "GET, POST", formatAllow(allowed))
+
+	// Methods are collected from every pattern that matches the path.
+	handler, _, allowed = rt.match("/items/1", GET)
+	require.Nil(t, handler)
+	require.Equal(t, []Method{PUT, DELETE}, allowed)
+
+	// A less specific pattern that handles the method is used.
+	handler, values, _ := rt.match("/items/1", PUT)
+	require.Equal(t, namedHandler("put"), handler)
+	require.Equal(t, map[string]string{"*": "1"}, values)
+}
+
+func TestRouterReplacesHandler(t *testing.T) {
+	rt := newRouter()
+	rt.add("/a", GET, namedHandler("old"))
+	rt.add("/a", GET, namedHandler("new"))
+
+	handler, _, _ := rt.match("/a", GET)
+	require.Equal(t, namedHandler("new"), handler)
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	patterns := []string{
+		"users",
+		"/files/*/raw",
+		"/users/{}",
+		"/users/{id}/{id}",
+		"/users/{id",
+		"/users/x{id}",
+		"/search?q",
+	}
+
+	for _, pattern := range patterns {
+		t.Run(pattern, func(t *testing.T) {
+			require.Panics(t, func() {
+				newRouter().add(pattern, GET, namedHandler("h"))
+			})
+		})
+	}
+}
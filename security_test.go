@@ -29,7 +29,7 @@ func TestOversizedHost(t *testing.T) {
 				Host:    host,
 				Path:    "/test",
 				Version: Version,
-				Headers: map[string]string{},
+				Headers: Header{},
 			}
 
 			data := req.Format()
@@ -85,14 +85,14 @@ func TestInfiniteRedirectLoop(t *testing.T) {
 	// Setup redirect loop: /a -> /b -> /a
 	srv.HandleFunc("/a", GET, func(_ *Request) *Response {
 		headers := map[string]string{
-			"location": "qh://127.0.0.1/b",
+			"location": "/b",
 		}
 		return NewResponse(302, nil, headers)
 	})
 
 	srv.HandleFunc("/b", GET, func(_ *Request) *Response {
 		headers := map[string]string{
-			"location": "qh://127.0.0.1/a",
+			"location": "/a",
 		}
 		return NewResponse(302, nil, headers)
 	})
@@ -112,7 +112,7 @@ func TestZeroMaxRedirects(t *testing.T) {
 
 	srv.HandleFunc("/redirect", GET, func(_ *Request) *Response {
 		return NewResponse(301, nil, map[string]string{
-			"location": "qh://127.0.0.1/target",
+			"location": "/target",
 		})
 	})
 
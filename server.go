@@ -1,35 +1,60 @@
 package qh
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/qo-proto/qotp"
 )
 
 const (
 	// Default server configuration values
-	defaultMaxRequestSize     = 10 * 1024 * 1024 // 10MB
-	defaultMinCompressionSize = 1024             // 1KB
+	defaultMaxRequestSize        = 10 * 1024 * 1024 // 10MB
+	defaultMaxRequestBodySize    = 1 << 30          // 1GB
+	defaultMinCompressionSize    = 1024             // 1KB
+	defaultMaxConcurrentHandlers = 256
+
+	// shutdownPollInterval is how often Shutdown checks for remaining requests.
+	shutdownPollInterval = 10 * time.Millisecond
+	// shutdownFlushDelay gives the last responses time to leave the send
+	// buffers before the listener is closed. qotp does not report when the
+	// data of a stream has been acknowledged.
+	shutdownFlushDelay = 100 * time.Millisecond
 )
 
-// Handler is a function type that processes QH requests and returns responses.
-// Handlers are registered with the server to handle specific path and method combinations.
-type Handler func(*Request) *Response
-
 // Server is a QH protocol server that listens for incoming connections
 // and routes requests to registered handlers. It supports automatic
 // response compression and configurable request size limits.
 type Server struct {
-	listener           *qotp.Listener
-	handlers           map[string]map[Method]Handler // path -> method -> handler (method parsed from request first byte)
-	supportedEncodings []Encoding                    // compression algorithms this server supports, in order of preference
-	maxRequestSize     int
+	listener           *qotp.Listener   // listener of the primary key
+	ring               *keyRing         // set if the server listens with retiring keys
+	router             *router          // route patterns -> method -> handler (method parsed from request first byte)
+	supportedEncodings []Encoding       // compression algorithms this server supports, in order of preference
+	compressionLevels  map[Encoding]int // levels set by WithCompressionLevel
+	maxRequestSize     int              // limit of a buffered request, or of the head of a streamed one
+	maxRequestBodySize int64            // limit of a streamed request body
 	minCompressionSize int
+	maxHandlers        int         // number of worker goroutines running handlers
+	jobs               chan func() // requests waiting for a free worker
+
+	ctx    context.Context // parent of all handler contexts, cancelled by Close
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	active     map[*qotp.Stream]context.CancelFunc // cancels the handler running for a stream
+	middleware []Middleware                        // applied to every request, see Use
+	inflight   int                                 // requests being received, queued or handled
+	draining   bool                                // set by Shutdown; new streams are rejected
 }
 
 // ServerOption is a functional option for configuring a Server.
@@ -37,6 +62,9 @@ type ServerOption func(*Server)
 
 // WithMaxRequestSize sets the maximum allowed request size in bytes.
 // Requests exceeding this limit will receive a 413 Payload Too Large response.
+// For a chunked request it limits the request head and how much of the body
+// is buffered for a handler that has not read it yet; beyond that, the server
+// stops reading the stream until the handler catches up.
 // Default is 10MB.
 func WithMaxRequestSize(size int) ServerOption {
 	return func(s *Server) {
@@ -44,6 +72,15 @@ func WithMaxRequestSize(size int) ServerOption {
 	}
 }
 
+// WithMaxRequestBodySize sets the maximum size in bytes of a chunked request
+// body. Once it is exceeded, the rest of the body is discarded and reading
+// Request.BodyReader fails with ErrRequestBodyTooLarge. Default is 1GB.
+func WithMaxRequestBodySize(size int64) ServerOption {
+	return func(s *Server) {
+		s.maxRequestBodySize = size
+	}
+}
+
 // WithMinCompressionSize sets the minimum response body size for compression.
 // Responses smaller than this threshold will not be compressed.
 // Default is 1KB.
@@ -53,6 +90,16 @@ func WithMinCompressionSize(size int) ServerOption {
 	}
 }
 
+// WithMaxConcurrentHandlers sets the number of handlers that may run at the
+// same time. Up to the same number of further requests wait in a queue for a
+// free worker; requests beyond that receive a 503 Service Unavailable
+// response. Default is 256.
+func WithMaxConcurrentHandlers(n int) ServerOption {
+	return func(s *Server) {
+		s.maxHandlers = n
+	}
+}
+
 // WithSupportedEncodings sets the compression encodings the server supports.
 // The server will use the first client-preferred encoding that the server
 // also supports. Default is [Zstd, Brotli, Gzip].
@@ -62,32 +109,91 @@ func WithSupportedEncodings(encodings []Encoding) ServerOption {
 	}
 }
 
+// WithCompressionLevel sets the level the server compresses responses with
+// for encoding. Higher levels compress better but take more CPU time.
+// Levels are 1 (fastest) to 9 for Gzip, 0 to 11 for Brotli and 1 to 22 for
+// Zstd, which are mapped to the four speeds of the Zstd encoder. The
+// defaults are 6 for Gzip, 4 for Brotli and 3 for Zstd. Levels out of range
+// are clamped.
+func WithCompressionLevel(encoding Encoding, level int) ServerOption {
+	return func(s *Server) {
+		if s.compressionLevels == nil {
+			s.compressionLevels = make(map[Encoding]int)
+		}
+		if encoding == Gzip && level != gzip.DefaultCompression {
+			// The gzip encoder rejects other levels, where the Brotli and
+			// Zstd encoders clamp them.
+			level = min(max(level, gzip.BestSpeed), gzip.BestCompression)
+		}
+		s.compressionLevels[encoding] = level
+	}
+}
+
 // NewServer creates a new QH server with the specified options.
 func NewServer(opts ...ServerOption) *Server {
 	s := &Server{
-		handlers:           make(map[string]map[Method]Handler),
+		router:             newRouter(),
 		supportedEncodings: []Encoding{Zstd, Brotli, Gzip},
 		maxRequestSize:     defaultMaxRequestSize,
+		maxRequestBodySize: defaultMaxRequestBodySize,
 		minCompressionSize: defaultMinCompressionSize,
+		maxHandlers:        defaultMaxConcurrentHandlers,
+		active:             make(map[*qotp.Stream]context.CancelFunc),
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
 	for _, opt := range opts {
 		opt(s)
 	}
+	s.maxHandlers = max(s.maxHandlers, 1)
+	s.jobs = make(chan func(), s.maxHandlers)
 
 	return s
 }
 
-// HandleFunc registers a handler for a given path and method.
-func (s *Server) HandleFunc(path string, method Method, handler Handler) {
-	if s.handlers[path] == nil {
-		s.handlers[path] = make(map[Method]Handler)
-	}
-	s.handlers[path][method] = handler
-	slog.Info("Registered handler", "method", method.String(), "path", path)
+// HandleFunc registers a function that returns a complete response for a
+// given route pattern and method, wrapped in the given route middleware.
+func (s *Server) HandleFunc(pattern string, method Method, handler ResponseFunc, mw ...Middleware) {
+	s.Handle(pattern, method, handler, mw...)
+}
+
+// Handle registers a handler for a given route pattern and method.
+//
+// Patterns are paths whose segments may be "{name}" to match any single
+// segment, or "*" as the last segment to match the rest of the path; the
+// matched values are available through Request.PathValue. A literal segment
+// takes precedence over a parameter, which takes precedence over a wildcard.
+// The query string is ignored for matching. Handle panics if the pattern is
+// invalid.
+//
+// The route middleware runs inside the middleware added with Use, with the
+// first one outermost.
+func (s *Server) Handle(pattern string, method Method, handler Handler, mw ...Middleware) {
+	s.router.add(pattern, method, chain(handler, mw))
+	slog.Info("Registered handler", "method", method.String(), "pattern", pattern)
+}
+
+// Use adds middleware that wraps the handling of every request, including
+// requests that end in 404 Not Found or 405 Method Not Allowed. Middleware
+// runs in the order it was added, the first one outermost.
+func (s *Server) Use(mw ...Middleware) {
+	s.mu.Lock()
+	s.middleware = append(s.middleware, mw...)
+	s.mu.Unlock()
 }
 
+// Listen opens the server's UDP socket on addr. The server key is derived
+// from the first seed, or generated randomly without one.
+//
+// Further seeds are retiring keys for a key rotation: the server keeps
+// accepting 0-RTT connections made with them, while in-band key exchanges
+// use the key of the first seed. See WriteKeyRotationRecords for the DNS
+// records to publish.
 func (s *Server) Listen(addr string, _ io.Writer, seed ...string) error {
+	if len(seed) > 1 {
+		return s.listenKeyRing(addr, seed)
+	}
+
 	opts := []qotp.ListenFunc{qotp.WithListenAddr(addr)}
 	if len(seed) > 0 && seed[0] != "" {
 		opts = append(opts, qotp.WithSeedStr(seed[0]))
@@ -100,87 +206,457 @@ func (s *Server) Listen(addr string, _ io.Writer, seed ...string) error {
 	}
 	s.listener = listener
 	slog.Info("QH server listening", "address", addr)
-	slog.Info("Server public key for DNS", "pubKey", s.getPublicKeyDNS())
+	slog.Info("Server public key for DNS", "pubKey", s.DNSRecords()[0])
 	return nil
 }
 
+func (s *Server) listenKeyRing(addr string, seeds []string) error {
+	if slices.Contains(seeds, "") {
+		return errors.New("key rotation requires a non-empty seed for every key")
+	}
+	ring, err := newKeyRing(addr, seeds)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	s.ring = ring
+	s.listener = ring.primary()
+	slog.Info("QH server listening with primary and retiring seeds", "address", addr, "retiring", len(seeds)-1)
+	for _, record := range s.DNSRecords() {
+		slog.Info("Server public key for DNS", "pubKey", record)
+	}
+	return nil
+}
+
+// PublicKey returns the base64 X25519 public key of the server, the primary
+// key if it listens with several, for clients to use with
+// WithServerPublicKey. It returns "" before Listen.
+func (s *Server) PublicKey() string {
+	return listenerKey(s.listener)
+}
+
+// DNSRecords returns the TXT records to publish at _qotp.<host> for the keys
+// the server listens with: the primary key first, followed by any retiring
+// keys. It returns nil before Listen.
+func (s *Server) DNSRecords() []string {
+	listeners := []*qotp.Listener{s.listener}
+	if s.ring != nil {
+		listeners = s.ring.listeners
+	}
+	var records []string
+	for _, l := range listeners {
+		key := listenerKey(l)
+		if key == "" {
+			return nil
+		}
+		records = append(records, formatKeyRecord(key))
+	}
+	return records
+}
+
+// listenerKey returns the base64 public key of l, or "" for a nil listener.
+func listenerKey(l *qotp.Listener) string {
+	if l == nil || l.PubKey() == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(l.PubKey().Bytes())
+}
+
 // Serve starts the server's main loop, accepting and handling incoming streams.
 func (s *Server) Serve() error {
 	if s.listener == nil {
 		return errors.New("server not listening")
 	}
 
-	slog.Info("Starting QH server loop")
+	slog.Info("Starting QH server loop", "max_handlers", s.maxHandlers)
+	for range s.maxHandlers {
+		go s.worker()
+	}
+
+	streams := make(map[*qotp.Stream]*streamState)
+	paused := make(map[*qotp.Stream]bool) // streams left unread until their handler catches up
 
-	streamBuffers := make(map[*qotp.Stream][]byte)
+	loop := s.listener.Loop
+	if s.ring != nil {
+		loop = s.ring.loop
+	}
+	loop(func(stream *qotp.Stream) (bool, error) {
+		for p := range paused {
+			s.readStream(streams, paused, p)
+		}
+		if stream != nil && !paused[stream] {
+			s.readStream(streams, paused, stream)
+		}
+		return true, nil
+	})
 
-	s.listener.Loop(func(stream *qotp.Stream) (bool, error) {
-		if stream == nil {
-			return true, nil
+	return nil
+}
+
+// readStream passes the data available on stream to the request being
+// received on it. Reading stops while the handler of a streamed request has
+// maxRequestSize or more body bytes left to read: the data then stays in the
+// QOTP receive buffer, whose flow control holds back the sender, and the
+// stream is read again on a later loop iteration.
+func (s *Server) readStream(streams map[*qotp.Stream]*streamState, paused map[*qotp.Stream]bool, stream *qotp.Stream) {
+	delete(paused, stream)
+
+	// Read returns one in-order segment at a time, so drain everything
+	// that is available before returning to the loop.
+	for {
+		if state := streams[stream]; state != nil && state.body != nil && !state.rejected &&
+			state.body.buffered() >= s.maxRequestSize {
+			paused[stream] = true
+			return
 		}
 
 		data, err := stream.Read()
-		if err != nil {
-			slog.Error("Stream read error", "error", err)
-			delete(streamBuffers, stream) // Clean up buffer on error
-			return true, nil
+		if err == nil && len(data) == 0 && stream.IsCloseRequested() {
+			// Read reports a close that arrives without data only once the
+			// close has been acknowledged in both directions, but QOTP closes
+			// the sending side as soon as it arrives. A peer closes a stream
+			// only to abandon it, so the request ends here.
+			err = io.EOF
 		}
-
 		if len(data) > 0 {
-			// Get or create buffer for this stream
-			buffer := streamBuffers[stream]
-
-			if len(buffer)+len(data) > s.maxRequestSize {
-				slog.Error("Request size exceeds limit", "bytes", len(buffer)+len(data), "limit", s.maxRequestSize)
-				s.sendErrorResponse(stream, StatusPayloadTooLarge, "Payload Too Large")
-				delete(streamBuffers, stream)
-				stream.Close()
-				return true, nil
+			state := streams[stream]
+			if state == nil {
+				state = &streamState{rejected: !s.startRequest()}
+				streams[stream] = state
+				if state.rejected {
+					slog.Info("Server shutting down, rejecting stream", "stream_id", stream.StreamID())
+					s.sendErrorResponse(stream, StatusServiceUnavailable, "Service Unavailable")
+				}
 			}
-
-			buffer = append(buffer, data...)
-			streamBuffers[stream] = buffer
-
-			slog.Debug("Received data fragment", "fragment_bytes", len(data), "total_bytes", len(buffer))
-
-			complete, checkErr := IsRequestComplete(buffer)
-			if checkErr != nil {
-				slog.Error("Request validation error", "error", checkErr)
-				s.sendErrorResponse(stream, StatusBadRequest, "Bad Request")
-				delete(streamBuffers, stream) // Clear buffer on error
-				return true, nil
+			if !s.receive(stream, state, data) {
+				s.dropStream(streams, stream)
 			}
+		}
 
-			if complete {
-				slog.Info("Complete request received", "bytes", len(buffer))
-				s.handleRequest(stream, buffer)
-				delete(streamBuffers, stream) // Clear buffer
+		if err != nil {
+			if state := streams[stream]; state != nil && state.body != nil {
+				state.body.finish(fmt.Errorf("stream closed before request body was complete: %w", err))
+			}
+			s.cancelStream(stream)
+			if !errors.Is(err, io.EOF) {
+				slog.Error("Stream read error", "error", err)
 			}
+			s.dropStream(streams, stream) // Clean up state on error
+			return
 		}
 
-		return true, nil
-	})
+		if len(data) == 0 {
+			return
+		}
+	}
+}
 
-	return nil
+// Shutdown gracefully shuts down the server. New streams are answered with
+// 503 Service Unavailable, while requests that have already started are
+// received and handled until their responses have been sent. Once no request
+// is left, or when ctx is done, the server is closed as by Close.
+//
+// If ctx is done first, Shutdown returns a *ShutdownError with the number of
+// requests that were abandoned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	slog.Info("Shutting down QH server", "inflight", s.inflightRequests())
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		abandoned := s.inflightRequests()
+		if abandoned == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			slog.Warn("Shutdown deadline reached, abandoning requests", "abandoned", abandoned)
+			if err := s.Close(); err != nil {
+				slog.Error("Failed to close listener", "error", err)
+			}
+			return &ShutdownError{Abandoned: abandoned, Err: ctx.Err()}
+		case <-ticker.C:
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(shutdownFlushDelay):
+	}
+	slog.Info("All requests finished, closing server")
+	return s.Close()
 }
 
-// Close shuts down the server's listener.
+// Close shuts down the server's listener and cancels the context of all
+// running handlers.
 func (s *Server) Close() error {
+	s.cancel()
+	if s.ring != nil {
+		return s.ring.close()
+	}
 	if s.listener != nil {
 		return s.listener.Close()
 	}
 	return nil
 }
 
-func (s *Server) getPublicKeyDNS() string {
-	if s.listener == nil || s.listener.PubKey() == nil {
-		return ""
+// ShutdownError is returned by Shutdown when its context is done before all
+// in-flight requests have finished.
+type ShutdownError struct {
+	Abandoned int   // number of requests that were still being received or handled
+	Err       error // the context error
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("shutdown: %d request(s) abandoned: %v", e.Abandoned, e.Err)
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// streamState tracks a request that is still arriving on a stream.
+type streamState struct {
+	buf      []byte       // buffered request data (the whole request, or only the head if chunked)
+	body     *bodyPipe    // set once the head of a chunked request has been handed to its handler
+	dec      *bodyDecoder // decodes the chunked body into body
+	bodySize int64        // chunked body bytes received so far
+
+	dispatched bool // the request has been handed to the worker pool
+	rejected   bool // the request has been refused or aborted; further data is discarded
+}
+
+// dropStream forgets the state of a stream. A request that never reached
+// the worker pool no longer counts as in flight.
+func (s *Server) dropStream(streams map[*qotp.Stream]*streamState, stream *qotp.Stream) {
+	state, ok := streams[stream]
+	if !ok {
+		return
+	}
+	delete(streams, stream)
+	if !state.dispatched && !state.rejected {
+		s.finishRequest()
+	}
+}
+
+// receive adds data read from a stream to the request being assembled on it.
+// It reports whether the stream state must be kept for more data.
+//
+// A buffered request is collected in full and must fit in maxRequestSize. A
+// chunked request is handed to its handler as soon as its head has arrived;
+// only the head counts against maxRequestSize and the body is streamed to
+// the handler through Request.BodyReader, up to maxRequestBodySize.
+//
+// A refused request keeps its state, so the data still arriving for it is
+// discarded instead of being taken for a new request.
+func (s *Server) receive(stream *qotp.Stream, state *streamState, data []byte) bool {
+	if state.rejected {
+		return true
+	}
+	if state.body != nil {
+		return s.feedRequestBody(state, data)
+	}
+
+	state.buf = append(state.buf, data...)
+	slog.Debug("Received data fragment", "fragment_bytes", len(data), "total_bytes", len(state.buf))
+
+	if isChunkedRequest(state.buf[0]) {
+		return s.startStreamedRequest(stream, state)
+	}
+
+	if len(state.buf) > s.maxRequestSize {
+		slog.Error("Request size exceeds limit", "bytes", len(state.buf), "limit", s.maxRequestSize)
+		return s.reject(stream, state, StatusPayloadTooLarge, "Payload Too Large")
+	}
+
+	complete, checkErr := IsRequestComplete(state.buf)
+	if checkErr != nil {
+		slog.Error("Request validation error", "error", checkErr)
+		return s.reject(stream, state, StatusBadRequest, "Bad Request")
+	}
+
+	if complete {
+		slog.Info("Complete request received", "bytes", len(state.buf))
+		requestData := state.buf
+		state.dispatched = true
+		s.dispatch(stream, func(ctx context.Context) { s.handleRequest(ctx, stream, requestData) })
+		return false
+	}
+
+	return true
+}
+
+// startStreamedRequest dispatches a chunked request to its handler once the
+// request head is complete, so the server loop can keep feeding it body data.
+func (s *Server) startStreamedRequest(stream *qotp.Stream, state *streamState) bool {
+	offset, complete, err := requestHeadEnd(state.buf)
+	if err != nil {
+		slog.Error("Request validation error", "error", err)
+		return s.reject(stream, state, StatusBadRequest, "Bad Request")
+	}
+	if (complete && offset > s.maxRequestSize) || (!complete && len(state.buf) > s.maxRequestSize) {
+		slog.Error("Request head exceeds limit", "bytes", len(state.buf), "limit", s.maxRequestSize)
+		return s.reject(stream, state, StatusPayloadTooLarge, "Payload Too Large")
+	}
+	if !complete {
+		return true
+	}
+
+	req, _, err := parseRequestHead(state.buf, false)
+	if err != nil {
+		slog.Error("Failed to parse request", "error", err)
+		return s.reject(stream, state, StatusBadRequest, "Bad Request")
+	}
+
+	encoding := Encoding(req.Headers.Get("content-encoding"))
+	if encoding != "" && !slices.Contains(s.supportedEncodings, encoding) {
+		s.sendUnsupportedEncoding(stream, encoding)
+		return s.refuse(state)
+	}
+
+	slog.Info("Streamed request started", "head_bytes", offset)
+	state.body = newBodyPipe(nil)
+	state.dec = newBodyDecoder(true)
+	var body io.ReadCloser = state.body
+	if encoding != "" {
+		// The body is decompressed as the handler reads it, so the
+		// decompressed size is bounded like the data on the wire.
+		body = newDecompressReader(state.body, encoding, s.maxRequestBodySize)
+		req.Headers.Del("content-encoding")
+	}
+	req.BodyReader = body
+	req.maxBodySize = s.maxRequestSize
+
+	state.dispatched = true
+	if !s.dispatch(stream, func(ctx context.Context) {
+		defer body.Close()
+		s.serveRequest(ctx, stream, req)
+	}) {
+		body.Close() // discard the rest of the body
+	}
+
+	rest := state.buf[offset:]
+	state.buf = nil
+	return s.feedRequestBody(state, rest)
+}
+
+// feedRequestBody passes chunked body data to the handler of a streamed
+// request. If the body is invalid or exceeds maxRequestBodySize, reading it
+// fails and the rest of the stream is discarded.
+func (s *Server) feedRequestBody(state *streamState, data []byte) bool {
+	done, err := state.dec.decode(data, func(b []byte) {
+		state.bodySize += int64(len(b))
+		if state.bodySize <= s.maxRequestBodySize {
+			state.body.write(b)
+		}
+	})
+	if err == nil && state.bodySize > s.maxRequestBodySize {
+		err = ErrRequestBodyTooLarge
+	}
+	if err != nil {
+		slog.Error("Discarding request body", "error", err, "bytes", state.bodySize)
+		state.body.finish(err)
+		state.rejected = true
+		return true
+	}
+	if done {
+		state.body.finish(nil)
+		return false
+	}
+	return true
+}
+
+// reject answers a request that is not handed to a handler with an error
+// and refuses it.
+func (s *Server) reject(stream *qotp.Stream, state *streamState, statusCode int, message string) bool {
+	s.sendErrorResponse(stream, statusCode, message)
+	return s.refuse(state)
+}
+
+// refuse marks a stream whose request has been answered without a handler,
+// so the rest of its data is discarded.
+func (s *Server) refuse(state *streamState) bool {
+	if !state.dispatched {
+		s.finishRequest()
+	}
+	state.rejected = true
+	state.buf = nil
+	return true
+}
+
+// dispatch queues a request for the worker pool and passes the job the
+// handler's context. If all workers are busy and the queue is full, it
+// answers 503 instead and reports false.
+func (s *Server) dispatch(stream *qotp.Stream, job func(ctx context.Context)) bool {
+	// The handler context is registered before the job is queued, so a peer
+	// that closes the stream while the job waits for a worker still cancels it.
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.mu.Lock()
+	s.active[stream] = cancel
+	s.mu.Unlock()
+	release := func() {
+		s.mu.Lock()
+		delete(s.active, stream)
+		s.mu.Unlock()
+		cancel()
+	}
+
+	select {
+	case s.jobs <- func() {
+		defer s.finishRequest()
+		defer release()
+		job(ctx)
+	}:
+		return true
+	default:
+		release()
+		slog.Warn("Handler queue full, rejecting request", "max_handlers", s.maxHandlers)
+		s.sendErrorResponse(stream, StatusServiceUnavailable, "Service Unavailable")
+		s.finishRequest()
+		return false
+	}
+}
+
+// startRequest counts a new request as in flight. It reports false if the
+// server is shutting down and the request must be rejected.
+func (s *Server) startRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+func (s *Server) finishRequest() {
+	s.mu.Lock()
+	s.inflight--
+	s.mu.Unlock()
+}
+
+func (s *Server) inflightRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflight
+}
+
+// worker runs queued requests until the server is closed.
+func (s *Server) worker() {
+	for {
+		select {
+		case job := <-s.jobs:
+			job()
+		case <-s.ctx.Done():
+			return
+		}
 	}
-	return fmt.Sprintf("v=%d;k=%s", qotp.ProtoVersion, base64.StdEncoding.EncodeToString(s.listener.PubKey().Bytes()))
 }
 
 // handleRequest parses a request from a stream, routes it, and sends a response.
-func (s *Server) handleRequest(stream *qotp.Stream, requestData []byte) {
+func (s *Server) handleRequest(ctx context.Context, stream *qotp.Stream, requestData []byte) {
 	slog.Debug("Received request", "bytes", len(requestData), "data", string(requestData))
 
 	req, err := ParseRequest(requestData)
@@ -189,51 +665,125 @@ func (s *Server) handleRequest(stream *qotp.Stream, requestData []byte) {
 		s.sendErrorResponse(stream, StatusBadRequest, "Bad Request")
 		return
 	}
+	if !s.decompressRequest(stream, req) {
+		return
+	}
+	req.BodyReader = bytes.NewReader(req.Body)
+
+	s.serveRequest(ctx, stream, req)
+}
+
+// decompressRequest decodes a buffered request body sent with a
+// content-encoding, so handlers see the original body. The decoded body must
+// fit in maxRequestSize. It replies with an error and returns false if the
+// body cannot be decoded, such as with 415 for an encoding the server does
+// not support.
+func (s *Server) decompressRequest(stream *qotp.Stream, req *Request) bool {
+	encoding := Encoding(req.Headers.Get("content-encoding"))
+	if encoding == "" {
+		return true
+	}
+	if !slices.Contains(s.supportedEncodings, encoding) {
+		s.sendUnsupportedEncoding(stream, encoding)
+		return false
+	}
+
+	body, err := Decompress(req.Body, encoding, s.maxRequestSize)
+	if err != nil {
+		slog.Error("Failed to decompress request body", "encoding", encoding, "error", err)
+		if errors.Is(err, errDecompressedTooLarge) {
+			s.sendErrorResponse(stream, StatusPayloadTooLarge, "Payload Too Large")
+		} else {
+			s.sendErrorResponse(stream, StatusBadRequest, "Bad Request")
+		}
+		return false
+	}
+	slog.Debug("Request body decompressed", "encoding", encoding,
+		"compressed_bytes", len(req.Body), "decompressed_bytes", len(body))
+	req.Body = body
+	req.Headers.Del("content-encoding")
+	return true
+}
 
+// sendUnsupportedEncoding answers a request sent with a content-encoding the
+// server does not support with 415 and the encodings it accepts.
+func (s *Server) sendUnsupportedEncoding(stream *qotp.Stream, encoding Encoding) {
+	slog.Error("Unsupported request content-encoding", "encoding", encoding)
+	resp := TextResponse(StatusUnsupportedMediaType, "Unsupported Media Type")
+	resp.Headers.Set("accept-encoding", formatEncodings(s.supportedEncodings))
+	if _, err := stream.Write(resp.Format()); err != nil {
+		slog.Error("Failed to write error response", "error", err)
+	}
+}
+
+// serveRequest runs the handler for a parsed request and sends its response.
+func (s *Server) serveRequest(ctx context.Context, stream *qotp.Stream, req *Request) {
 	// Validate and normalize Content-Type for requests with body
 	if req.Method == POST || req.Method == PUT || req.Method == PATCH {
 		s.validateContentType(req)
 	}
 
-	resp := s.routeRequest(req) // execute according handler
-
-	s.applyCompression(req, resp)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.mu.Lock()
+	mw := s.middleware
+	s.mu.Unlock()
 
-	// send response
-	respData := resp.Format()
-	slog.Debug("Sending response", "bytes", len(respData))
+	w := newResponseWriter(s, stream, req, cancel)
+	chain(s.routeRequest(req), mw).ServeQH(ctx, w, req) // execute according handler
+	w.finish()
+}
 
-	_, err = stream.Write(respData)
-	if err != nil {
-		slog.Error("Failed to write response", "error", err)
-		stream.Close()
-		return
+// cancelStream cancels the context of the handler running for a stream
+// after the peer has closed it.
+func (s *Server) cancelStream(stream *qotp.Stream) {
+	s.mu.Lock()
+	cancel, ok := s.active[stream]
+	s.mu.Unlock()
+	if ok {
+		slog.Debug("Stream closed by peer, cancelling handler", "stream_id", stream.StreamID())
+		cancel()
 	}
-
-	slog.Debug("Response sent, stream kept open for reuse")
 }
 
 func (s *Server) validateContentType(req *Request) {
-	contentTypeStr, hasContentType := req.Headers["content-type"]
-
-	if !hasContentType || contentTypeStr == "" {
+	if req.Headers.Get("content-type") == "" {
 		slog.Debug("content-type missing for POST, defaulting to octet-stream")
-		req.Headers["content-type"] = "application/octet-stream"
+		req.Headers.Set("content-type", "application/octet-stream")
 	}
 }
 
-func (s *Server) routeRequest(req *Request) *Response {
+func (s *Server) routeRequest(req *Request) Handler {
 	slog.Debug("Routing request", "path", req.Path, "method", req.Method.String())
 
-	// check if we have a handler for this path and method
-	if pathHandlers, exists := s.handlers[req.Path]; exists {
-		if handler, methodExists := pathHandlers[req.Method]; methodExists {
-			return handler(req) // Execute the handler for the method
-		}
+	handler, values, allowed := s.router.match(req.Path, req.Method)
+	if handler != nil {
+		req.pathValues = values
+		return handler
+	}
+
+	// the path exists, but not for this method
+	if len(allowed) > 0 {
+		return methodNotAllowedHandler(allowed)
 	}
 
 	// no handler found, return 404
+	return notFoundHandler
+}
+
+// notFoundHandler replies to requests without a matching route.
+var notFoundHandler = ResponseFunc(func(*Request) *Response {
 	return TextResponse(StatusNotFound, "Not Found")
+})
+
+// methodNotAllowedHandler replies to requests for a path that exists, but
+// not for the requested method.
+func methodNotAllowedHandler(allowed []Method) Handler {
+	return ResponseFunc(func(*Request) *Response {
+		resp := TextResponse(StatusMethodNotAllowed, "Method Not Allowed")
+		resp.Headers.Set("allow", formatAllow(allowed))
+		return resp
+	})
 }
 
 func (s *Server) sendErrorResponse(stream *qotp.Stream, statusCode int, message string) {
@@ -255,14 +805,14 @@ func (s *Server) applyCompression(req *Request, resp *Response) {
 		return
 	}
 
-	contentTypeStr, ok := resp.Headers["content-type"]
-	if ok && contentTypeStr == "application/octet-stream" {
+	if resp.Headers.Get("content-type") == "application/octet-stream" {
 		slog.Debug("Skipping compression for binary media", "content_type", "octet-stream")
 		return
 	}
 
-	acceptEncodingStr, ok := req.Headers["accept-encoding"]
-	if !ok || acceptEncodingStr == "" {
+	// Repeated accept-encoding fields are equivalent to one comma-separated list
+	acceptEncodingStr := strings.Join(req.Headers.Values("accept-encoding"), ",")
+	if acceptEncodingStr == "" {
 		return
 	}
 
@@ -275,7 +825,11 @@ func (s *Server) applyCompression(req *Request, resp *Response) {
 	}
 
 	originalSize := len(resp.Body)
-	compressed, err := Compress(resp.Body, selectedEncoding)
+	level, ok := s.compressionLevels[selectedEncoding]
+	if !ok {
+		level = defaultCompressionLevels[selectedEncoding]
+	}
+	compressed, err := compressLevel(resp.Body, selectedEncoding, level)
 	if err != nil {
 		slog.Error("Compression failed", "encoding", selectedEncoding, "error", err)
 		return
@@ -288,7 +842,7 @@ func (s *Server) applyCompression(req *Request, resp *Response) {
 	}
 
 	resp.Body = compressed
-	resp.Headers["content-encoding"] = string(selectedEncoding)
+	resp.Headers.Set("content-encoding", string(selectedEncoding))
 
 	savings := float64(originalSize-len(compressed)) / float64(originalSize) * 100
 	slog.Info("Compressed", "encoding", selectedEncoding,
@@ -299,14 +853,10 @@ func (s *Server) applyCompression(req *Request, resp *Response) {
 // NewResponse creates a new Response with the given status code, body, and headers.
 // Any headers provided will override auto-generated headers.
 func NewResponse(statusCode int, body []byte, headers map[string]string) *Response {
-	headerMap := make(map[string]string)
-
-	maps.Copy(headerMap, headers)
-
 	return &Response{
 		Version:    Version,
 		StatusCode: statusCode,
-		Headers:    headerMap,
+		Headers:    headerFromMap(headers),
 		Body:       body,
 	}
 }
@@ -1,6 +1,7 @@
 package qh
 
 import (
+	"fmt"
 	"strings"
 	"testing"
 
@@ -50,8 +51,8 @@ func TestServerMinCompressionSize(t *testing.T) {
 				Host:    "localhost",
 				Path:    "/",
 				Version: Version,
-				Headers: map[string]string{
-					"accept-encoding": "zstd, br, gzip",
+				Headers: Header{
+					"accept-encoding": {"zstd, br, gzip"},
 				},
 			}
 
@@ -59,11 +60,11 @@ func TestServerMinCompressionSize(t *testing.T) {
 			server.applyCompression(req, resp)
 
 			if tt.shouldCompress {
-				_, hasEncoding := resp.Headers["content-encoding"]
+				hasEncoding := resp.Headers.Has("content-encoding")
 				assert.True(t, hasEncoding, "response should be compressed")
 				assert.Less(t, len(resp.Body), len(tt.responseBody), "compressed body should be smaller")
 			} else {
-				_, hasEncoding := resp.Headers["content-encoding"]
+				hasEncoding := resp.Headers.Has("content-encoding")
 				assert.False(t, hasEncoding, "response should not be compressed")
 				assert.Equal(t, tt.responseBody, string(resp.Body), "body should be unchanged")
 			}
@@ -116,8 +117,8 @@ func TestServerSupportedEncodings(t *testing.T) {
 				Host:    "localhost",
 				Path:    "/",
 				Version: Version,
-				Headers: map[string]string{
-					"accept-encoding": tt.clientAccepts,
+				Headers: Header{
+					"accept-encoding": {tt.clientAccepts},
 				},
 			}
 
@@ -126,17 +127,50 @@ func TestServerSupportedEncodings(t *testing.T) {
 			server.applyCompression(req, resp)
 
 			if tt.expectedEncoding == "" {
-				_, hasEncoding := resp.Headers["content-encoding"]
+				hasEncoding := resp.Headers.Has("content-encoding")
 				assert.False(t, hasEncoding, "no compression should occur when no common encoding")
 			} else {
-				encoding, hasEncoding := resp.Headers["content-encoding"]
-				assert.True(t, hasEncoding, "response should be compressed")
-				assert.Equal(t, string(tt.expectedEncoding), encoding)
+				assert.True(t, resp.Headers.Has("content-encoding"), "response should be compressed")
+				assert.Equal(t, string(tt.expectedEncoding), resp.Headers.Get("content-encoding"))
 			}
 		})
 	}
 }
 
+func TestServerCompressionLevel(t *testing.T) {
+	var sb strings.Builder
+	for i := range 2000 {
+		fmt.Fprintf(&sb, "item %d has value %d; ", i, i*i%997)
+	}
+	body := sb.String()
+	req := &Request{
+		Method:  GET,
+		Path:    "/",
+		Version: Version,
+		Headers: Header{"accept-encoding": {"gzip"}},
+	}
+	compressedSize := func(t *testing.T, opts ...ServerOption) int {
+		t.Helper()
+		server := NewServer(opts...)
+		resp := TextResponse(200, body)
+		server.applyCompression(req, resp)
+		if !resp.Headers.Has("content-encoding") {
+			return len(resp.Body)
+		}
+		decompressed, err := Decompress(resp.Body, Gzip, len(body))
+		require.NoError(t, err)
+		assert.Equal(t, body, string(decompressed))
+		return len(resp.Body)
+	}
+
+	fastest := compressedSize(t, WithCompressionLevel(Gzip, 1))
+	best := compressedSize(t, WithCompressionLevel(Gzip, 9))
+	assert.Less(t, best, fastest)
+	assert.Equal(t, best, compressedSize(t, WithCompressionLevel(Brotli, 1), WithCompressionLevel(Gzip, 9)))
+	assert.Equal(t, best, compressedSize(t, WithCompressionLevel(Gzip, 42)), "level above range is clamped")
+	assert.Equal(t, fastest, compressedSize(t, WithCompressionLevel(Gzip, -5)), "level below range is clamped")
+}
+
 func TestServerNoCompressionForBinary(t *testing.T) {
 	server := NewServer(WithMinCompressionSize(100))
 
@@ -145,8 +179,8 @@ func TestServerNoCompressionForBinary(t *testing.T) {
 		Host:    "localhost",
 		Path:    "/",
 		Version: Version,
-		Headers: map[string]string{
-			"accept-encoding": "zstd, br, gzip",
+		Headers: Header{
+			"accept-encoding": {"zstd, br, gzip"},
 		},
 	}
 
@@ -156,7 +190,7 @@ func TestServerNoCompressionForBinary(t *testing.T) {
 
 	server.applyCompression(req, resp)
 
-	_, hasEncoding := resp.Headers["content-encoding"]
+	hasEncoding := resp.Headers.Has("content-encoding")
 	assert.False(t, hasEncoding, "binary content should not be compressed")
 }
 
@@ -244,10 +278,11 @@ func TestServerMethodMatching(t *testing.T) {
 		assert.Equal(t, "PUT response", string(resp.Body))
 	})
 
-	t.Run("DELETE to path with no DELETE handler returns 404", func(t *testing.T) {
+	t.Run("DELETE to path with no DELETE handler returns 405", func(t *testing.T) {
 		resp, err := client.DELETE("127.0.0.1", "/api/resource", nil)
 		require.NoError(t, err)
-		assert.Equal(t, 404, resp.StatusCode)
+		assert.Equal(t, 405, resp.StatusCode)
+		assert.Equal(t, "GET, POST, PUT", resp.Headers.Get("allow"))
 	})
 }
 
@@ -288,14 +323,14 @@ func TestServerResponseHelpers(t *testing.T) {
 		resp := TextResponse(200, "Hello")
 		assert.Equal(t, 200, resp.StatusCode)
 		assert.Equal(t, "Hello", string(resp.Body))
-		assert.Equal(t, "text/plain", resp.Headers["content-type"])
+		assert.Equal(t, "text/plain", resp.Headers.Get("content-type"))
 	})
 
 	t.Run("JSONResponse sets correct content-type", func(t *testing.T) {
 		resp := JSONResponse(201, `{"key":"value"}`)
 		assert.Equal(t, 201, resp.StatusCode)
 		assert.JSONEq(t, `{"key":"value"}`, string(resp.Body))
-		assert.Equal(t, "application/json", resp.Headers["content-type"])
+		assert.Equal(t, "application/json", resp.Headers.Get("content-type"))
 	})
 
 	t.Run("NewResponse constructs properly", func(t *testing.T) {
@@ -306,8 +341,8 @@ func TestServerResponseHelpers(t *testing.T) {
 		resp := NewResponse(404, []byte("Not Found"), headers)
 		assert.Equal(t, 404, resp.StatusCode)
 		assert.Equal(t, "Not Found", string(resp.Body))
-		assert.Equal(t, "text/html", resp.Headers["content-type"])
-		assert.Equal(t, "max-age=3600", resp.Headers["cache-control"])
+		assert.Equal(t, "text/html", resp.Headers.Get("content-type"))
+		assert.Equal(t, "max-age=3600", resp.Headers.Get("cache-control"))
 		assert.Equal(t, uint8(Version), resp.Version)
 	})
 
@@ -319,3 +354,14 @@ func TestServerResponseHelpers(t *testing.T) {
 		assert.Empty(t, resp.Headers)
 	})
 }
+
+func TestServerPublicKey(t *testing.T) {
+	assert.Empty(t, NewServer().PublicKey())
+
+	want, err := seedPublicKey("test")
+	require.NoError(t, err)
+	srv, _ := newTestServer(t)
+	defer srv.Close()
+	assert.Equal(t, want, srv.PublicKey())
+	assert.Equal(t, formatKeyRecord(want), srv.DNSRecords()[0])
+}
@@ -1,5 +1,7 @@
 package qh
 
+import "fmt"
+
 // Status code constants.
 // These mirror standard HTTP status codes and are used in QH responses.
 const (
@@ -60,7 +62,19 @@ const (
 	StatusQHVersionNotSupported = 505
 )
 
+// CompactStatusEscape is the compact status value reserved for status codes
+// that are not in the compact table. The full status code follows the first
+// byte of the response as a varint.
+const CompactStatusEscape = 63
+
+const (
+	// Range of status codes that can be sent with CompactStatusEscape.
+	minStatusCode = 100
+	maxStatusCode = 999
+)
+
 // statusToCompact maps HTTP status codes to compact wire format values.
+// All values must fit in 6 bits and differ from CompactStatusEscape.
 var statusToCompact = map[int]uint8{
 	// 1xx Informational
 	100: 10, // Continue
@@ -100,16 +114,16 @@ var statusToCompact = map[int]uint8{
 	407: 47, // Proxy Authentication Required
 	408: 48, // Request Timeout
 	409: 49, // Conflict
-	410: 80, // Gone
-	411: 81, // Length Required
-	412: 82, // Precondition Failed
-	413: 83, // Payload Too Large
-	414: 84, // URI Too Long
-	415: 85, // Unsupported Media Type
-	416: 86, // Range Not Satisfiable
-	417: 87, // Expectation Failed
-	422: 88, // Unprocessable Entity
-	429: 89, // Too Many Requests
+	410: 0,  // Gone
+	411: 1,  // Length Required
+	412: 2,  // Precondition Failed
+	413: 3,  // Payload Too Large
+	414: 4,  // URI Too Long
+	415: 5,  // Unsupported Media Type
+	416: 6,  // Range Not Satisfiable
+	417: 7,  // Expectation Failed
+	422: 8,  // Unprocessable Entity
+	429: 9,  // Too Many Requests
 
 	// 5xx Server Error
 	500: 50, // Internal Server Error
@@ -130,16 +144,49 @@ func init() {
 	}
 }
 
-// convert HTTP status code to compact format
+// convert HTTP status code to compact format. Codes without a compact value
+// are encoded as CompactStatusEscape followed by the full code, see
+// appendStatusCode.
 func encodeStatusCode(httpCode int) uint8 {
 	if compact, exists := statusToCompact[httpCode]; exists {
 		return compact
 	}
-	// Fallback: use compact code for 500 Internal Server Error for unmapped codes
+	if httpCode >= minStatusCode && httpCode <= maxStatusCode {
+		return CompactStatusEscape
+	}
+	// Fallback: codes that cannot be represented at all are sent as 500 Internal Server Error
 	return statusToCompact[StatusInternalServerError]
 }
 
-// convert compact format to HTTP status code
+// appendStatusCode writes the full status code after the first byte if the
+// compact value is the escape.
+func appendStatusCode(buf []byte, compact uint8, httpCode int) []byte {
+	if compact != CompactStatusEscape {
+		return buf
+	}
+	return AppendUvarint(buf, uint64(httpCode))
+}
+
+// readStatusCode decodes the status code of the response in data and
+// returns the offset of the headers length field.
+func readStatusCode(data []byte) (int, int, error) {
+	compact := data[0] & statusCodeMask
+	if compact != CompactStatusEscape {
+		return DecodeStatusCode(compact), firstByteOffset, nil
+	}
+
+	code, n, err := ReadUvarint(data, firstByteOffset)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read escaped status code: %w", err)
+	}
+	if code < minStatusCode || code > maxStatusCode {
+		return 0, 0, fmt.Errorf("escaped status code %d out of range", code)
+	}
+	return int(code), firstByteOffset + n, nil
+}
+
+// convert compact format to HTTP status code. CompactStatusEscape is not a
+// status code by itself; the full code following it must be read instead.
 func DecodeStatusCode(compact uint8) int {
 	if httpCode, exists := CompactToStatus[compact]; exists {
 		return httpCode
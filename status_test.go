@@ -22,10 +22,18 @@ func TestDecodeStatusCode(t *testing.T) {
 	require.Equal(t, 204, DecodeStatusCode(24)) // No Content
 }
 
+func TestEncodeStatusCodeEscape(t *testing.T) {
+	// unmapped codes in 100-999 are escaped, the full code follows the first byte
+	require.Equal(t, uint8(CompactStatusEscape), encodeStatusCode(419))
+	require.Equal(t, uint8(CompactStatusEscape), encodeStatusCode(451))
+	require.Equal(t, uint8(CompactStatusEscape), encodeStatusCode(999))
+}
+
 func TestEncodeStatusCodeFallback(t *testing.T) {
-	// all unmapped codes should return compact code for 500 -> 50
-	require.Equal(t, uint8(50), encodeStatusCode(419))
-	require.Equal(t, uint8(50), encodeStatusCode(451))
+	// codes that cannot be escaped return compact code for 500 -> 50
+	require.Equal(t, uint8(50), encodeStatusCode(0))
+	require.Equal(t, uint8(50), encodeStatusCode(99))
+	require.Equal(t, uint8(50), encodeStatusCode(1000))
 }
 
 func TestDecodeStatusCodeFallback(t *testing.T) {
@@ -43,3 +51,48 @@ func TestRoundTripStatusCodes(t *testing.T) { // catches mapping mistakes
 		})
 	}
 }
+
+func TestCompactStatusCodesFitFirstByte(t *testing.T) {
+	for httpCode, compact := range statusToCompact {
+		require.LessOrEqual(t, compact, uint8(statusCodeMask), "compact code of %d exceeds 6 bits", httpCode)
+		require.NotEqual(t, uint8(CompactStatusEscape), compact, "compact code of %d is the escape value", httpCode)
+	}
+}
+
+func TestEscapedStatusCodeRoundTrip(t *testing.T) {
+	for _, code := range []int{100, 200, 410, 418, 425, 429, 431, 451, 507, 511, 599, 999} {
+		resp := &Response{Version: Version, StatusCode: code, Headers: Header{"x-custom": {"v"}}, Body: []byte("body")}
+		data := resp.Format()
+
+		complete, err := IsResponseComplete(data)
+		require.NoError(t, err)
+		require.True(t, complete)
+
+		parsed, err := ParseResponse(data)
+		require.NoError(t, err, "status %d", code)
+		require.Equal(t, code, parsed.StatusCode)
+		require.Equal(t, "v", parsed.Headers.Get("x-custom"))
+		require.Equal(t, "body", string(parsed.Body))
+	}
+}
+
+func TestEscapedStatusCodeWireFormat(t *testing.T) {
+	data := (&Response{Version: Version, StatusCode: 451}).Format()
+	// escape, varint 451, no headers, empty body
+	require.Equal(t, []byte{CompactStatusEscape, 0xc3, 0x03, 0x00, 0x00}, data)
+
+	complete, err := IsResponseComplete(data[:2])
+	require.NoError(t, err)
+	require.False(t, complete)
+
+	require.Contains(t, DebugResponse(data), "Status code: 451")
+}
+
+func TestEscapedStatusCodeOutOfRange(t *testing.T) {
+	for _, code := range []uint64{0, 99, 1000} {
+		data := AppendUvarint([]byte{CompactStatusEscape}, code)
+		data = append(data, 0x00, 0x00)
+		_, err := ParseResponse(data)
+		require.Error(t, err, "status %d", code)
+	}
+}
@@ -10,6 +10,13 @@ import (
 // Returns the server and its address (e.g., "127.0.0.1:12345").
 func newTestServer(t *testing.T, opts ...ServerOption) (*Server, string) {
 	t.Helper()
+	return newSeededTestServer(t, []string{"test"}, opts...)
+}
+
+// newSeededTestServer starts a server listening with the given seeds on a
+// free local port.
+func newSeededTestServer(t *testing.T, seeds []string, opts ...ServerOption) (*Server, string) {
+	t.Helper()
 
 	// Find an available port by briefly binding to port 0
 	//nolint:noctx // Context not needed
@@ -23,7 +30,7 @@ func newTestServer(t *testing.T, opts ...ServerOption) (*Server, string) {
 	addr := fmt.Sprintf("127.0.0.1:%d", port)
 	srv := NewServer(opts...)
 
-	err = srv.Listen(addr, nil, "test")
+	err = srv.Listen(addr, nil, seeds...)
 	if err != nil {
 		t.Fatalf("Failed to start server: %v", err)
 	}
@@ -34,3 +41,15 @@ func newTestServer(t *testing.T, opts ...ServerOption) (*Server, string) {
 
 	return srv, addr
 }
+
+// defaultConn returns the pooled connection to the server given to Connect.
+func defaultConn(t *testing.T, c *Client) *clientConn {
+	t.Helper()
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	cc := c.origins[c.defaultOrigin]
+	if cc == nil {
+		t.Fatal("client has no connection to its default origin")
+	}
+	return cc
+}
@@ -0,0 +1,153 @@
+package qh
+
+import (
+	"context"
+	"net"
+)
+
+// ClientTrace is a set of hooks to run at stages of a client request, like
+// net/http/httptrace.ClientTrace. Attach it to the context of a request with
+// WithClientTrace. Any hook may be nil.
+//
+// Hooks may be called from other goroutines than the one making the request,
+// and concurrently while addresses are tried in parallel. The DNS, key and
+// connect hooks only run when a new connection is dialed, not when the
+// request reuses a pooled one.
+type ClientTrace struct {
+	// DNSStart is called when the addresses and keys of a host are looked up.
+	DNSStart func(DNSStartInfo)
+	// DNSDone is called when the address lookup has finished.
+	DNSDone func(DNSDoneInfo)
+	// KeyLookupDone is called with the server keys the connection is dialed
+	// with, after the DNS key lookup and the known hosts check.
+	KeyLookupDone func(KeyLookupDoneInfo)
+	// ConnectStart is called when a connection attempt to addr starts.
+	ConnectStart func(addr string)
+	// ConnectDone is called when a connection attempt to addr has finished,
+	// with a nil err if it succeeded.
+	ConnectDone func(addr string, err error)
+	// WroteRequest is called when the request has been written to the stream.
+	WroteRequest func(WroteRequestInfo)
+	// GotFirstResponseChunk is called when the first data of the response
+	// has arrived.
+	GotFirstResponseChunk func()
+	// DecompressDone is called when a compressed response body has been
+	// decompressed.
+	DecompressDone func(DecompressDoneInfo)
+	// RedirectFollowed is called when a redirect response is followed, before
+	// the new request is sent.
+	RedirectFollowed func(RedirectInfo)
+}
+
+// DNSStartInfo is passed to ClientTrace.DNSStart.
+type DNSStartInfo struct {
+	Host string
+}
+
+// DNSDoneInfo is passed to ClientTrace.DNSDone.
+type DNSDoneInfo struct {
+	Addrs []net.IP // in the order they are tried
+	Err   error
+}
+
+// KeyLookupDoneInfo is passed to ClientTrace.KeyLookupDone.
+type KeyLookupDoneInfo struct {
+	Host string
+	// Keys are the base64 server keys the connection is dialed with (0-RTT),
+	// in the order they are tried. It is empty if the connection falls back
+	// to the in-band key exchange.
+	Keys []string
+	// Err is set if the keys were rejected, such as with a *KeyMismatchError.
+	Err error
+}
+
+// WroteRequestInfo is passed to ClientTrace.WroteRequest.
+type WroteRequestInfo struct {
+	Err error // set if the request could not be written
+}
+
+// DecompressDoneInfo is passed to ClientTrace.DecompressDone.
+type DecompressDoneInfo struct {
+	Encoding       Encoding
+	CompressedSize int
+	Size           int // size of the decompressed body
+	Err            error
+}
+
+// RedirectInfo is passed to ClientTrace.RedirectFollowed.
+type RedirectInfo struct {
+	StatusCode int    // status of the redirect response
+	Method     Method // method of the new request
+	URL        *URL   // where the new request goes, see Request.URL
+}
+
+type clientTraceKey struct{}
+
+// WithClientTrace returns a context based on ctx that runs the hooks of
+// trace for requests made with it.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	return context.WithValue(ctx, clientTraceKey{}, trace)
+}
+
+// ContextClientTrace returns the ClientTrace attached to ctx, or nil.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientTraceKey{}).(*ClientTrace)
+	return trace
+}
+
+// The methods below run a hook if it is set. They may be called on a nil
+// *ClientTrace.
+
+func (t *ClientTrace) dnsStart(info DNSStartInfo) {
+	if t != nil && t.DNSStart != nil {
+		t.DNSStart(info)
+	}
+}
+
+func (t *ClientTrace) dnsDone(info DNSDoneInfo) {
+	if t != nil && t.DNSDone != nil {
+		t.DNSDone(info)
+	}
+}
+
+func (t *ClientTrace) keyLookupDone(info KeyLookupDoneInfo) {
+	if t != nil && t.KeyLookupDone != nil {
+		t.KeyLookupDone(info)
+	}
+}
+
+func (t *ClientTrace) connectStart(addr string) {
+	if t != nil && t.ConnectStart != nil {
+		t.ConnectStart(addr)
+	}
+}
+
+func (t *ClientTrace) connectDone(addr string, err error) {
+	if t != nil && t.ConnectDone != nil {
+		t.ConnectDone(addr, err)
+	}
+}
+
+func (t *ClientTrace) wroteRequest(info WroteRequestInfo) {
+	if t != nil && t.WroteRequest != nil {
+		t.WroteRequest(info)
+	}
+}
+
+func (t *ClientTrace) gotFirstResponseChunk() {
+	if t != nil && t.GotFirstResponseChunk != nil {
+		t.GotFirstResponseChunk()
+	}
+}
+
+func (t *ClientTrace) decompressDone(info DecompressDoneInfo) {
+	if t != nil && t.DecompressDone != nil {
+		t.DecompressDone(info)
+	}
+}
+
+func (t *ClientTrace) redirectFollowed(info RedirectInfo) {
+	if t != nil && t.RedirectFollowed != nil {
+		t.RedirectFollowed(info)
+	}
+}
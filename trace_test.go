@@ -0,0 +1,126 @@
+package qh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// traceRecorder records the hooks of a ClientTrace in the order they run.
+type traceRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *traceRecorder) add(format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+}
+
+func (r *traceRecorder) trace() *ClientTrace {
+	return &ClientTrace{
+		DNSStart: func(info DNSStartInfo) { r.add("DNSStart %s", info.Host) },
+		DNSDone:  func(info DNSDoneInfo) { r.add("DNSDone %v %v", info.Addrs, info.Err) },
+		KeyLookupDone: func(info KeyLookupDoneInfo) {
+			r.add("KeyLookupDone %s keys=%d %v", info.Host, len(info.Keys), info.Err)
+		},
+		ConnectStart:          func(addr string) { r.add("ConnectStart %s", addr) },
+		ConnectDone:           func(addr string, err error) { r.add("ConnectDone %s %v", addr, err) },
+		WroteRequest:          func(info WroteRequestInfo) { r.add("WroteRequest %v", info.Err) },
+		GotFirstResponseChunk: func() { r.add("GotFirstResponseChunk") },
+		DecompressDone: func(info DecompressDoneInfo) {
+			r.add("DecompressDone %s %t %d %v", info.Encoding, info.CompressedSize < info.Size, info.Size, info.Err)
+		},
+		RedirectFollowed: func(info RedirectInfo) {
+			r.add("RedirectFollowed %d %s %s", info.StatusCode, info.Method, info.URL)
+		},
+	}
+}
+
+func (r *traceRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.events
+	r.events = nil
+	return events
+}
+
+func TestClientTrace(t *testing.T) {
+	srv, addr := newTestServer(t)
+	defer srv.Close()
+	body := strings.Repeat("traced ", 1000)
+	srv.HandleFunc("/old", GET, func(_ *Request) *Response {
+		resp := TextResponse(StatusFound, "")
+		resp.Headers.Set("location", "/new")
+		return resp
+	})
+	srv.HandleFunc("/new", GET, func(_ *Request) *Response {
+		return TextResponse(200, body)
+	})
+
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	resolver := &StaticResolver{Addrs: map[string][]net.IP{"qh.test": {net.IPv4(127, 0, 0, 1)}}}
+	client := NewClient(WithResolver(resolver))
+	defer client.Close()
+
+	rec := &traceRecorder{}
+	ctx, cancel := context.WithTimeout(WithClientTrace(context.Background(), rec.trace()), 10*time.Second)
+	defer cancel()
+	resp, err := client.Get(ctx, "qh://qh.test:"+port+"/old")
+	require.NoError(t, err)
+	assert.Equal(t, body, string(resp.Body))
+
+	assert.Equal(t, []string{
+		"DNSStart qh.test",
+		"DNSDone [127.0.0.1] <nil>",
+		"KeyLookupDone qh.test keys=0 <nil>",
+		"ConnectStart " + addr,
+		"ConnectDone " + addr + " <nil>",
+		"WroteRequest <nil>",
+		"GotFirstResponseChunk",
+		"RedirectFollowed 302 GET qh://qh.test:" + port + "/new",
+		"WroteRequest <nil>",
+		"GotFirstResponseChunk",
+		fmt.Sprintf("DecompressDone zstd true %d <nil>", len(body)),
+	}, rec.take())
+
+	t.Run("ReusedConnection", func(t *testing.T) {
+		_, err := client.Get(ctx, "qh://qh.test:"+port+"/new")
+		require.NoError(t, err)
+		events := rec.take()
+		require.NotEmpty(t, events)
+		assert.Equal(t, "WroteRequest <nil>", events[0], "no DNS or connect hooks for a pooled connection")
+	})
+
+	t.Run("ServerKey", func(t *testing.T) {
+		client := NewClient(WithResolver(resolver), WithServerPublicKey("qh.test", srv.PublicKey()))
+		defer client.Close()
+
+		require.NoError(t, client.ConnectContext(ctx, "qh.test:"+port))
+		assert.Equal(t, []string{
+			"KeyLookupDone qh.test keys=1 <nil>",
+			"DNSStart qh.test",
+			"DNSDone [127.0.0.1] <nil>",
+			"ConnectStart " + addr,
+			"ConnectDone " + addr + " <nil>",
+		}, rec.take())
+	})
+}
+
+func TestClientTraceNil(t *testing.T) {
+	assert.Nil(t, ContextClientTrace(context.Background()))
+
+	// Hooks are optional, and a nil trace is a no-op.
+	var trace *ClientTrace
+	trace.dnsStart(DNSStartInfo{Host: "example.com"})
+	(&ClientTrace{}).gotFirstResponseChunk()
+}
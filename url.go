@@ -0,0 +1,114 @@
+package qh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidURL is returned by ParseURL for strings that are not a valid qh
+// URI.
+var ErrInvalidURL = errors.New("invalid qh URL")
+
+// URL is a parsed qh URI of the form "qh://host[:port][/path][?query]", as
+// defined in spec §2.4.
+type URL struct {
+	Host     string // host name or IP address, without brackets
+	Port     int    // server port, DefaultPort if the URI has none
+	Path     string // escaped path, "/" if the URI has none
+	RawQuery string // encoded query, without the '?'
+}
+
+// ParseURL parses a qh URI. The scheme must be "qh" and the host must not be
+// empty. A missing port defaults to DefaultPort and a missing path to "/".
+// A fragment is dropped, since it is never sent to the server.
+func ParseURL(rawURL string) (*URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q: %w", ErrInvalidURL, rawURL, err)
+	}
+	switch {
+	case u.Scheme != "qh":
+		return nil, fmt.Errorf("%w %q: scheme must be qh", ErrInvalidURL, rawURL)
+	case u.Opaque != "":
+		return nil, fmt.Errorf("%w %q: missing //", ErrInvalidURL, rawURL)
+	case u.User != nil:
+		return nil, fmt.Errorf("%w %q: user info is not supported", ErrInvalidURL, rawURL)
+	case u.Hostname() == "":
+		return nil, fmt.Errorf("%w %q: empty host", ErrInvalidURL, rawURL)
+	}
+
+	port := DefaultPort
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("%w %q: invalid port", ErrInvalidURL, rawURL)
+		}
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return &URL{Host: u.Hostname(), Port: port, Path: path, RawQuery: u.RawQuery}, nil
+}
+
+// Addr returns the "host:port" address of the server.
+func (u *URL) Addr() string {
+	return net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+}
+
+// RequestURI returns the path and query as sent in the path field of a
+// request.
+func (u *URL) RequestURI() string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// Query parses RawQuery and returns the values. Malformed pairs are dropped.
+func (u *URL) Query() url.Values {
+	v, _ := url.ParseQuery(u.RawQuery)
+	return v
+}
+
+// String reassembles the URL. The port is omitted if it is DefaultPort or 0.
+func (u *URL) String() string {
+	host := u.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if u.Port != 0 && u.Port != DefaultPort {
+		host += ":" + strconv.Itoa(u.Port)
+	}
+	return "qh://" + host + u.RequestURI()
+}
+
+// URL returns the URL the request is sent to. Its port is 0 if the request
+// goes to the server given to Client.Connect.
+func (r *Request) URL() *URL {
+	path, rawQuery := splitQuery(r.Path)
+	return &URL{Host: r.Host, Port: r.Port, Path: path, RawQuery: rawQuery}
+}
+
+// Query parses the query part of the request path and returns the values.
+// Malformed pairs are dropped.
+func (r *Request) Query() url.Values {
+	_, rawQuery := splitQuery(r.Path)
+	v, _ := url.ParseQuery(rawQuery)
+	return v
+}
+
+// splitQuery splits a request path into the path and the raw query. A
+// fragment is dropped.
+func splitQuery(path string) (string, string) {
+	path, _, _ = strings.Cut(path, "#")
+	path, rawQuery, _ := strings.Cut(path, "?")
+	if path == "" {
+		path = "/"
+	}
+	return path, rawQuery
+}
@@ -0,0 +1,82 @@
+package qh
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		want   URL
+	}{
+		{"qh://example.com", URL{Host: "example.com", Port: DefaultPort, Path: "/"}},
+		{"qh://example.com/", URL{Host: "example.com", Port: DefaultPort, Path: "/"}},
+		{"qh://example.com:9000/api/users", URL{Host: "example.com", Port: 9000, Path: "/api/users"}},
+		{"qh://example.com/api?x=1&y=a%20b", URL{Host: "example.com", Port: DefaultPort, Path: "/api", RawQuery: "x=1&y=a%20b"}},
+		{"qh://example.com/a%2Fb#section", URL{Host: "example.com", Port: DefaultPort, Path: "/a%2Fb"}},
+		{"qh://127.0.0.1:8080", URL{Host: "127.0.0.1", Port: 8080, Path: "/"}},
+		{"qh://[::1]/", URL{Host: "::1", Port: DefaultPort, Path: "/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rawURL, func(t *testing.T) {
+			u, err := ParseURL(tt.rawURL)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, *u)
+		})
+	}
+}
+
+func TestParseURLInvalid(t *testing.T) {
+	for _, rawURL := range []string{
+		"",
+		"example.com/path",
+		"http://example.com/",
+		"qh:example.com",
+		"qh:///path",
+		"qh://:8090/",
+		"qh://user@example.com/",
+		"qh://example.com:0/",
+		"qh://example.com:65536/",
+		"qh://example.com:http/",
+		"qh://exa mple.com/",
+	} {
+		t.Run(rawURL, func(t *testing.T) {
+			_, err := ParseURL(rawURL)
+			require.ErrorIs(t, err, ErrInvalidURL)
+		})
+	}
+}
+
+func TestURLMethods(t *testing.T) {
+	u := &URL{Host: "example.com", Port: 9000, Path: "/search", RawQuery: "q=go&q=qh&page=2"}
+	assert.Equal(t, "example.com:9000", u.Addr())
+	assert.Equal(t, "/search?q=go&q=qh&page=2", u.RequestURI())
+	assert.Equal(t, "qh://example.com:9000/search?q=go&q=qh&page=2", u.String())
+	assert.Equal(t, url.Values{"q": {"go", "qh"}, "page": {"2"}}, u.Query())
+
+	for _, rawURL := range []string{"qh://example.com/", "qh://[::1]:9000/a?b=c", "qh://10.0.0.1/x/y"} {
+		u, err := ParseURL(rawURL)
+		require.NoError(t, err)
+		assert.Equal(t, rawURL, u.String())
+	}
+}
+
+func TestRequestURLAndQuery(t *testing.T) {
+	req := &Request{Host: "example.com", Port: 9000, Path: "/search?q=go&page=2#top"}
+	assert.Equal(t, &URL{Host: "example.com", Port: 9000, Path: "/search", RawQuery: "q=go&page=2"}, req.URL())
+	assert.Equal(t, "qh://example.com:9000/search?q=go&page=2", req.URL().String())
+	assert.Equal(t, "go", req.Query().Get("q"))
+	assert.Equal(t, "2", req.Query().Get("page"))
+
+	req = &Request{Host: "example.com", Path: "/plain"}
+	assert.Equal(t, "qh://example.com/plain", req.URL().String())
+	assert.Empty(t, req.Query())
+
+	req = &Request{Host: "example.com", Path: "?only=query"}
+	assert.Equal(t, "/", req.URL().Path)
+	assert.Equal(t, "query", req.Query().Get("only"))
+}